@@ -0,0 +1,454 @@
+package analyzer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Anomaly detection configuration
+var (
+	// DynamoDB table holding baselines (partition key: id)
+	anomalyBaselineTable = os.Getenv("ANOMALY_BASELINE_TABLE")
+	// Slack channels receiving alerts (falls back to DIGEST_CHANNELS)
+	anomalyChannels = splitList(envOrDefault("ANOMALY_CHANNELS", os.Getenv("DIGEST_CHANNELS")))
+	// "rolling" keeps one baseline per key, "seasonal" keeps one per key and hour-of-week
+	anomalyBaselineMode = envOrDefault("ANOMALY_BASELINE_MODE", "rolling")
+	// Z-score above which an hourly count is flagged
+	anomalyZThreshold = envFloat("ANOMALY_Z_THRESHOLD", 3.0)
+	// Hourly counts below this are never flagged (avoids noise on tiny volumes)
+	anomalyMinCount = envFloat("ANOMALY_MIN_COUNT", 100)
+	// Baseline samples required before a key can be flagged
+	anomalyMinSamples = envInt("ANOMALY_MIN_SAMPLES", 24)
+	// Samples the baselines mostly remember (a week of hours when rolling, 8 weeks of the same hour when seasonal)
+	anomalyBaselineWindow = envInt("ANOMALY_BASELINE_WINDOW", defaultBaselineWindow(anomalyBaselineMode))
+	// Keys tracked per target and dimension; the ones with the smallest baselines are dropped beyond this
+	anomalyMaxTrackedKeys = envInt("ANOMALY_MAX_TRACKED_KEYS", 100)
+)
+
+// defaultBaselineWindow returns the default number of samples a baseline remembers in a mode
+func defaultBaselineWindow(mode string) int {
+	if mode == "seasonal" {
+		return 8
+	}
+	return 24 * 7
+}
+
+// anomalyDimensions are the hourly counts tracked per target
+var anomalyDimensions = []DigestQuery{
+	{
+		Name:  "action",
+		Title: "Requests by action",
+		SQL: `SELECT {{action}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'{{account_filter}}
+GROUP BY {{action}}`,
+	},
+	{
+		Name:  "rule",
+		Title: "Rule triggers",
+		SQL: `SELECT {{rule}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'
+    AND {{action}} IN ('BLOCK', 'COUNT'){{account_filter}}
+GROUP BY {{rule}}
+ORDER BY value DESC
+LIMIT 19`,
+	},
+	{
+		Name:    "source_ip",
+		Title:   "Top talkers",
+		NewKeys: true,
+		SQL: `SELECT {{source_ip}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'{{account_filter}}
+GROUP BY {{source_ip}}
+ORDER BY value DESC
+LIMIT 19`,
+	},
+	{
+		Name:  "host",
+		Title: "Requests by host",
+		SQL: `SELECT {{host}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'{{account_filter}}
+GROUP BY {{host}}
+ORDER BY value DESC
+LIMIT 19`,
+	},
+}
+
+// Baseline is the exponentially weighted mean and variance of one hourly count, so old traffic fades out
+// over about ANOMALY_BASELINE_WINDOW samples
+type Baseline struct {
+	ID        string   `dynamodbav:"id"`
+	Count     int      `dynamodbav:"count"` // Samples seen
+	Mean      float64  `dynamodbav:"mean"`
+	Variance  float64  `dynamodbav:"variance"`
+	M2        float64  `dynamodbav:"m2,omitempty"`   // Sum of squared deviations of baselines written before the weighting
+	Keys      []string `dynamodbav:"keys,omitempty"` // Keys tracked for the dimension (run counters only)
+	UpdatedAt string   `dynamodbav:"updated_at"`
+}
+
+// StdDev returns the standard deviation of the baseline
+func (b Baseline) StdDev() float64 {
+	if b.Count < 2 {
+		return 0
+	}
+	return math.Sqrt(b.Variance)
+}
+
+// Add folds a new observation into the baseline. Early samples are averaged equally until the window is
+// reached, then each sample weighs 2/(window+1).
+func (b *Baseline) Add(x float64) {
+	if b.M2 > 0 && b.Variance == 0 && b.Count >= 2 {
+		b.Variance = b.M2 / float64(b.Count-1)
+	}
+	b.M2 = 0
+
+	b.Count++
+	alpha := math.Max(2/float64(anomalyBaselineWindow+1), 1/float64(b.Count))
+	delta := x - b.Mean
+	b.Mean += alpha * delta
+	b.Variance = (1 - alpha) * (b.Variance + alpha*delta*delta)
+}
+
+// faded reports whether a key has been absent long enough that its baseline can be dropped
+func (b Baseline) faded() bool {
+	return b.Count >= anomalyBaselineWindow && b.Mean < 0.5
+}
+
+// Anomaly is a flagged hourly count
+type Anomaly struct {
+	Target    WAFTarget
+	Dimension DigestQuery
+	Key       string
+	Value     float64
+	Baseline  Baseline
+	ZScore    float64
+	New       bool
+	SQL       string
+}
+
+// baselineID builds the baseline key for a target/dimension/key, per hour-of-week in seasonal mode
+func baselineID(target, dimension, key string, hour time.Time) string {
+	slot := "all"
+	if anomalyBaselineMode == "seasonal" {
+		slot = fmt.Sprintf("how%03d", int(hour.Weekday())*24+hour.Hour())
+	}
+	return strings.Join([]string{target, dimension, key, slot}, "#")
+}
+
+// runAnomalyDetection checks the last full hour of every target against its baselines and posts alerts
+func runAnomalyDetection(ctx context.Context) error {
+	if anomalyBaselineTable == "" {
+		slog.WarnContext(ctx, "ANOMALY_BASELINE_TABLE is not set, skipping anomaly detection")
+		return nil
+	}
+
+	end := time.Now().UTC().Truncate(time.Hour)
+	start := end.Add(-time.Hour)
+	slog.InfoContext(ctx, "Running anomaly detection", "start", start, "end", end)
+
+	type dimensionResult struct {
+		target    WAFTarget
+		dimension DigestQuery
+		sql       string
+		runs      Baseline
+		values    []keyValue
+	}
+
+	db := getDynamoClient()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var results []dimensionResult
+	for _, target := range wafTargets {
+		// Anomaly dimensions are SQL; CloudWatch Logs targets are not tracked
+		if target.LogGroup != "" {
+			continue
+		}
+		for _, dim := range anomalyDimensions {
+			wg.Add(1)
+			go func(target WAFTarget, dim DigestQuery) {
+				defer wg.Done()
+				// Runs per dimension tell whether baselines are warm enough to call a key "new"
+				runsID := baselineID(target.Name, dim.Name, "_runs", start)
+				runs, err := loadBaseline(db, runsID)
+				if err != nil {
+					slog.WarnContext(ctx, "Failed to load baseline", "id", runsID, "error", err)
+					return
+				}
+
+				sql := renderDigestSQL(dim, target, start, end)
+				_, rows, errMsg, _ := executeQuery(ctx, sql, target.Region)
+				if errMsg != "" {
+					slog.WarnContext(ctx, "Anomaly query failed", "target", target.Name, "dimension", dim.Name, "error", errMsg)
+					return
+				}
+				values := rowsToKeyValues(rows)
+
+				// Tracked keys outside this hour's top rows are counted explicitly; only keys the query
+				// does not return at all count as zero, so their baselines decay
+				seen := make(map[string]bool)
+				for _, kv := range values {
+					seen[kv.Key] = true
+				}
+				var missing []string
+				for _, key := range runs.Keys {
+					if !seen[key] {
+						missing = append(missing, key)
+					}
+				}
+				if len(missing) > 0 {
+					_, rows, errMsg, _ := executeQuery(ctx, keyedDigestSQL(sql, missing), target.Region)
+					if errMsg != "" {
+						// Without their counts the missing keys are left untouched this hour
+						slog.WarnContext(ctx, "Anomaly query for tracked keys failed", "target", target.Name, "dimension", dim.Name, "error", errMsg)
+					} else {
+						values = append(values, rowsToKeyValues(rows)...)
+						for _, kv := range values {
+							seen[kv.Key] = true
+						}
+						for _, key := range missing {
+							if !seen[key] {
+								values = append(values, keyValue{Key: key})
+							}
+						}
+					}
+				}
+
+				mu.Lock()
+				results = append(results, dimensionResult{target, dim, sql, runs, values})
+				mu.Unlock()
+			}(target, dim)
+		}
+	}
+	wg.Wait()
+
+	var anomalies []Anomaly
+	for _, r := range results {
+		runs := r.runs
+		warm := runs.Count >= anomalyMinSamples
+
+		// Tracked keys whose count could not be read keep their baselines as they are
+		var keys []trackedKey
+		seen := make(map[string]bool)
+		for _, kv := range r.values {
+			seen[kv.Key] = true
+		}
+		for _, key := range runs.Keys {
+			if !seen[key] {
+				keys = append(keys, trackedKey{key: key, mean: math.Inf(1)})
+			}
+		}
+
+		for _, kv := range r.values {
+			id := baselineID(r.target.Name, r.dimension.Name, kv.Key, start)
+			baseline, err := loadBaseline(db, id)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to load baseline", "id", id, "error", err)
+				keys = append(keys, trackedKey{key: kv.Key, mean: math.Inf(1)})
+				continue
+			}
+
+			if a, flagged := evaluateAnomaly(r.target, r.dimension, kv, baseline, warm); flagged {
+				a.SQL = r.sql
+				anomalies = append(anomalies, a)
+			}
+
+			baseline.Add(kv.Value)
+			if baseline.faded() {
+				if err := deleteBaseline(db, id); err != nil {
+					slog.WarnContext(ctx, "Failed to delete baseline", "id", id, "error", err)
+				}
+				continue
+			}
+			keys = append(keys, trackedKey{key: kv.Key, mean: baseline.Mean})
+			baseline.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+			if err := saveBaseline(db, baseline); err != nil {
+				slog.WarnContext(ctx, "Failed to save baseline", "id", id, "error", err)
+			}
+		}
+
+		// Each tracked key costs a read and a write every hour, so only the busiest are kept
+		sort.SliceStable(keys, func(i, j int) bool { return keys[i].mean > keys[j].mean })
+		if len(keys) > anomalyMaxTrackedKeys {
+			for _, k := range keys[anomalyMaxTrackedKeys:] {
+				id := baselineID(r.target.Name, r.dimension.Name, k.key, start)
+				if err := deleteBaseline(db, id); err != nil {
+					slog.WarnContext(ctx, "Failed to delete baseline", "id", id, "error", err)
+				}
+			}
+			keys = keys[:anomalyMaxTrackedKeys]
+		}
+		runs.Keys = nil
+		for _, k := range keys {
+			runs.Keys = append(runs.Keys, k.key)
+		}
+		runs.Add(1)
+		runs.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		if err := saveBaseline(db, runs); err != nil {
+			slog.WarnContext(ctx, "Failed to save baseline", "id", runs.ID, "error", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Anomaly detection finished", "anomalies", len(anomalies))
+	for _, a := range anomalies {
+		postAnomalyAlert(a, start, end)
+	}
+	return nil
+}
+
+// trackedKey is a key kept in a dimension's run counter, ranked by its baseline mean
+type trackedKey struct {
+	key  string
+	mean float64
+}
+
+// evaluateAnomaly decides whether an hourly count deviates from its baseline
+func evaluateAnomaly(target WAFTarget, dim DigestQuery, kv keyValue, baseline Baseline, warm bool) (Anomaly, bool) {
+	a := Anomaly{Target: target, Dimension: dim, Key: kv.Key, Value: kv.Value, Baseline: baseline}
+	if kv.Value < anomalyMinCount {
+		return a, false
+	}
+
+	// A key never seen before that is already among the top talkers
+	if baseline.Count == 0 {
+		a.New = dim.NewKeys && warm
+		return a, a.New
+	}
+	if baseline.Count < anomalyMinSamples {
+		return a, false
+	}
+
+	// Only spikes matter; a floor on the deviation keeps flat baselines from flagging small changes
+	std := math.Max(baseline.StdDev(), math.Max(1, baseline.Mean*0.1))
+	a.ZScore = (kv.Value - baseline.Mean) / std
+	return a, a.ZScore >= anomalyZThreshold
+}
+
+// loadBaseline reads a baseline, returning an empty one when it does not exist yet
+func loadBaseline(db *dynamodb.DynamoDB, id string) (Baseline, error) {
+	out, err := db.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(anomalyBaselineTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	})
+	if err != nil {
+		return Baseline{ID: id}, err
+	}
+
+	baseline := Baseline{ID: id}
+	if out.Item != nil {
+		if err := dynamodbattribute.UnmarshalMap(out.Item, &baseline); err != nil {
+			return Baseline{ID: id}, err
+		}
+	}
+	return baseline, nil
+}
+
+// saveBaseline writes a baseline back to DynamoDB
+func saveBaseline(db *dynamodb.DynamoDB, baseline Baseline) error {
+	item, err := dynamodbattribute.MarshalMap(baseline)
+	if err != nil {
+		return err
+	}
+	_, err = db.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(anomalyBaselineTable),
+		Item:      item,
+	})
+	return err
+}
+
+// deleteBaseline removes the baseline of a key that is no longer seen
+func deleteBaseline(db *dynamodb.DynamoDB, id string) error {
+	_, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(anomalyBaselineTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	})
+	return err
+}
+
+// investigationQuestion builds the pre-filled question for the "Investigate" button
+func investigationQuestion(a Anomaly, start, end time.Time) string {
+	window := fmt.Sprintf("between %s and %s UTC", start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"))
+	switch a.Dimension.Name {
+	case "source_ip":
+		return fmt.Sprintf("For the %s WAF, break down requests from source IP %s by hostname, action and rule %s", a.Target.Name, a.Key, window)
+	case "rule":
+		return fmt.Sprintf("For the %s WAF, show the top source IPs and hostnames that triggered rule %s %s", a.Target.Name, a.Key, window)
+	case "host":
+		return fmt.Sprintf("For the %s WAF, show the top source IPs and actions for hostname %s %s", a.Target.Name, a.Key, window)
+	default:
+		return fmt.Sprintf("For the %s WAF, show the top source IPs and rules for %s requests %s", a.Target.Name, a.Key, window)
+	}
+}
+
+// anomalyAlertBlocks builds the alert for a channel. Baselines use raw keys; the alert shows the key redacted
+// like any other result, and the Investigate button refers to the question when it would reveal the key
+// (the button is left out when the question cannot be kept server-side).
+func anomalyAlertBlocks(a Anomaly, start, end time.Time, rule RedactionRule) (string, []map[string]interface{}) {
+	key := rule.redactValue(a.Key)
+	var detail string
+	if a.New {
+		detail = fmt.Sprintf("New top talker `%s`: %s requests (not seen before)", key, formatNumber(a.Value))
+	} else {
+		detail = fmt.Sprintf("%s `%s`: %s (baseline %.1f ± %.1f, z=%.1f)",
+			a.Dimension.Title, key, formatNumber(a.Value), a.Baseline.Mean, a.Baseline.StdDev(), a.ZScore)
+	}
+
+	text := fmt.Sprintf(":rotating_light: *WAF anomaly* on *%s* (%s - %s UTC)\n%s",
+		a.Target.Name, start.Format("2006-01-02 15:04"), end.Format("15:04"), detail)
+
+	blocks := []map[string]interface{}{
+		{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": text},
+		},
+		{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": "*Supporting query:*\n```\n" + a.SQL + "\n```"},
+		},
+	}
+
+	question, err := buttonValueFor(investigationQuestion(a, start, end), rule)
+	if err != nil {
+		slog.Warn("Anomaly alert posted without the Investigate button", "error", err)
+		return text, blocks
+	}
+	blocks = append(blocks, map[string]interface{}{
+		"type": "actions",
+		"elements": []map[string]interface{}{
+			slackButton("Investigate", "investigate", question, "primary"),
+		},
+	})
+	return text, blocks
+}
+
+// postAnomalyAlert posts an alert with the supporting query and an "Investigate" action
+func postAnomalyAlert(a Anomaly, start, end time.Time) {
+	if len(anomalyChannels) == 0 {
+		slog.Warn("No anomaly channels configured, alert not posted", "target", a.Target.Name, "dimension", a.Dimension.Name, "key", a.Key)
+		return
+	}
+
+	for _, channel := range anomalyChannels {
+		text, blocks := anomalyAlertBlocks(a, start, end, redactionFor([]string{a.Target.Name}, channel))
+		if err := postBlocksToSlack(channel, text, blocks); err != nil {
+			slog.Warn("Failed to post anomaly alert", "channel", channel, "error", err)
+		}
+	}
+}
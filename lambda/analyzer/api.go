@@ -0,0 +1,505 @@
+package analyzer
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// JSON API configuration
+var (
+	// Comma separated API keys accepted in the x-api-key header
+	apiKeys = splitList(os.Getenv("API_KEYS"))
+	// Comma separated IAM principal ARN prefixes allowed when API Gateway uses IAM authorization
+	apiAllowedPrincipals = splitList(os.Getenv("API_ALLOWED_PRINCIPALS"))
+	// DynamoDB table recording who started each async query (partition key "query_id", TTL attribute "expires_at").
+	// Without it async queries can only be polled on the instance that started them.
+	apiQueryTable = os.Getenv("API_QUERY_TABLE")
+
+	// Async queries started on this instance (without API_QUERY_TABLE)
+	apiQueries   = make(map[string]apiQuery)
+	apiQueriesMu sync.Mutex
+)
+
+// Async queries can be polled for this long after they start
+const apiQueryTTL = 24 * time.Hour
+
+// apiQuery records an async query started through the API, so only its owner can read the results
+type apiQuery struct {
+	QueryID   string `dynamodbav:"query_id"`
+	Owner     string `dynamodbav:"owner"`
+	Region    string `dynamodbav:"region"`
+	Target    string `dynamodbav:"target"`
+	ExpiresAt int64  `dynamodbav:"expires_at"`
+}
+
+// APIAskRequest is the body of POST /v1/ask
+type APIAskRequest struct {
+	Question string `json:"question"`
+	Async    bool   `json:"async"`
+	Analyze  *bool  `json:"analyze"` // default true
+	DryRun   bool   `json:"dry_run"`
+}
+
+// APIQueryRequest is the body of POST /v1/query
+type APIQueryRequest struct {
+	SQL   string `json:"sql"`
+	Async bool   `json:"async"`
+}
+
+// APIColumn describes a result column
+type APIColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// APIStats are the execution statistics returned with results
+type APIStats struct {
+	DataScannedBytes  int64  `json:"data_scanned_bytes"`
+	EngineExecutionMs int64  `json:"engine_execution_ms"`
+	QueueMs           int64  `json:"queue_ms"`
+	Cached            bool   `json:"cached"`
+	CachedAt          string `json:"cached_at,omitempty"`
+	ReusedResult      bool   `json:"reused_result"`
+}
+
+// APITargetResult is the per-target outcome of a fan-out question
+type APITargetResult struct {
+	Name    string `json:"name"`
+	Region  string `json:"region"`
+	QueryID string `json:"query_id,omitempty"`
+	Rows    int    `json:"rows"`
+	Error   string `json:"error,omitempty"`
+}
+
+// APIResponse is the JSON body returned by the /v1 endpoints
+type APIResponse struct {
+	QueryID  string            `json:"query_id,omitempty"`
+	Region   string            `json:"region,omitempty"`
+	Target   string            `json:"target,omitempty"` // target whose role ran the query (pass it when polling)
+	Status   string            `json:"status"`           // SUCCEEDED, RUNNING, QUEUED, FAILED, CANCELLED, GENERATED
+	SQL      string            `json:"sql,omitempty"`
+	Template string            `json:"template,omitempty"`
+	Columns  []APIColumn       `json:"columns,omitempty"`
+	Rows     [][]string        `json:"rows,omitempty"`
+	Stats    *APIStats         `json:"stats,omitempty"`
+	Targets  []APITargetResult `json:"targets,omitempty"` // fan-out questions only
+	Analysis string            `json:"analysis,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Athena query execution IDs are UUIDs
+var queryIDPattern = regexp.MustCompile(`^[0-9a-fA-F-]{36}$`)
+
+// isAPIRequest determines whether a request targets the JSON API
+func isAPIRequest(req events.APIGatewayProxyRequest) bool {
+	return strings.HasPrefix(req.Path, "/v1/")
+}
+
+// handleAPIRequest routes /v1 requests
+func handleAPIRequest(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	caller, owner, ok := authenticateAPIRequest(req)
+	if !ok {
+		slog.WarnContext(ctx, "Rejecting unauthenticated API request", "path", req.Path)
+		return apiError(401, "unauthorized"), nil
+	}
+	slog.InfoContext(ctx, "API request", "method", req.HTTPMethod, "path", req.Path, "caller", caller, "owner", owner)
+
+	// API callers are matched by their owner ID in the "users" of the access policy and rate limited like Slack users
+	grant := authorize(owner, "")
+
+	body := requestBody(req)
+	switch {
+	case req.HTTPMethod == "POST" && req.Path == "/v1/ask":
+		var ask APIAskRequest
+		if err := json.Unmarshal([]byte(body), &ask); err != nil || strings.TrimSpace(ask.Question) == "" {
+			return apiError(400, "request body must be JSON with a non-empty \"question\""), nil
+		}
+		return handleAPIAsk(ctx, ask, grant, caller, owner), nil
+
+	case req.HTTPMethod == "POST" && req.Path == "/v1/query":
+		var q APIQueryRequest
+		if err := json.Unmarshal([]byte(body), &q); err != nil || strings.TrimSpace(q.SQL) == "" {
+			return apiError(400, "request body must be JSON with a non-empty \"sql\""), nil
+		}
+		return handleAPIQuery(ctx, q.SQL, q.Async, grant, caller, owner), nil
+
+	case req.HTTPMethod == "GET" && strings.HasPrefix(req.Path, "/v1/queries/"):
+		qid := strings.TrimPrefix(req.Path, "/v1/queries/")
+		if !queryIDPattern.MatchString(qid) {
+			return apiError(400, "invalid query id"), nil
+		}
+		query, ok, err := lookupAPIQuery(qid)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to look up async query", "query_id", qid, "error", err)
+			return apiError(500, "failed to look up query"), nil
+		}
+		if !ok || query.Owner != owner {
+			// Queries started by other callers, or not through the API, are not disclosed
+			return apiJSON(404, APIResponse{QueryID: qid, Status: "UNKNOWN", Error: "unknown query id"}), nil
+		}
+		target, _ := findTarget(query.Target)
+		return handleAPIGetQuery(query.Region, qid, target, grant), nil
+
+	default:
+		return apiError(404, "not found"), nil
+	}
+}
+
+// authenticateAPIRequest accepts IAM-authorized callers (verified by API Gateway) or a configured API key.
+// It returns the caller shown in logs and audit records, and the owner ID of the async queries the caller starts.
+func authenticateAPIRequest(req events.APIGatewayProxyRequest) (string, string, bool) {
+	// IAM authorization: API Gateway has already verified the SigV4 signature
+	if arn := req.RequestContext.Identity.UserArn; arn != "" {
+		if len(apiAllowedPrincipals) == 0 {
+			return arn, arn, true
+		}
+		for _, prefix := range apiAllowedPrincipals {
+			if strings.HasPrefix(arn, prefix) {
+				return arn, arn, true
+			}
+		}
+		slog.Warn("IAM principal is not in API_ALLOWED_PRINCIPALS", "principal", arn)
+		return arn, "", false
+	}
+
+	key := headerValue(req.Headers, "x-api-key")
+	if key == "" {
+		return "", "", false
+	}
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			// Keys sharing a prefix are told apart by a hash of the whole key
+			sum := sha256.Sum256([]byte(key))
+			return "api-key:" + key[:min(4, len(key))] + "...", "api-key:" + hex.EncodeToString(sum[:8]), true
+		}
+	}
+	return "", "", false
+}
+
+// recordAPIQuery remembers who started an async query and where it runs
+func recordAPIQuery(query apiQuery) error {
+	query.ExpiresAt = time.Now().Add(apiQueryTTL).Unix()
+	if apiQueryTable == "" {
+		apiQueriesMu.Lock()
+		defer apiQueriesMu.Unlock()
+		for id, q := range apiQueries {
+			if q.ExpiresAt < time.Now().Unix() {
+				delete(apiQueries, id)
+			}
+		}
+		apiQueries[query.QueryID] = query
+		return nil
+	}
+
+	item, err := dynamodbattribute.MarshalMap(query)
+	if err != nil {
+		return err
+	}
+	if _, err := getDynamoClient().PutItem(&dynamodb.PutItemInput{TableName: aws.String(apiQueryTable), Item: item}); err != nil {
+		return fmt.Errorf("failed to record async query: %v", err)
+	}
+	return nil
+}
+
+// lookupAPIQuery returns the record of an async query started through the API
+func lookupAPIQuery(qid string) (apiQuery, bool, error) {
+	var query apiQuery
+	if apiQueryTable == "" {
+		apiQueriesMu.Lock()
+		query = apiQueries[qid]
+		apiQueriesMu.Unlock()
+	} else {
+		out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(apiQueryTable),
+			Key:            map[string]*dynamodb.AttributeValue{"query_id": {S: aws.String(qid)}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return apiQuery{}, false, err
+		}
+		if err := dynamodbattribute.UnmarshalMap(out.Item, &query); err != nil {
+			return apiQuery{}, false, err
+		}
+	}
+	if query.QueryID == "" || query.ExpiresAt < time.Now().Unix() {
+		return apiQuery{}, false, nil
+	}
+	return query, true, nil
+}
+
+// handleAPIAsk generates SQL for a question and runs it
+func handleAPIAsk(ctx context.Context, ask APIAskRequest, grant AccessGrant, caller, owner string) events.APIGatewayProxyResponse {
+	respond := func(code int, result APIResponse) events.APIGatewayProxyResponse {
+		auditAPIRequest(caller, accessAsk, ask.Question, result)
+		return apiJSON(code, result)
+	}
+
+	if !grant.allowsKind(accessAsk) {
+		return respond(403, APIResponse{Status: "DENIED", Error: "ask requests are not enabled for this caller"})
+	}
+	// Refuse questions about targets the caller cannot query before calling Bedrock
+	fanOutQuestion := isFanOutQuestion(ask.Question)
+	if !fanOutQuestion {
+		if target, ok := targetForQuestion(ask.Question); ok && !grant.allowsTarget(target) {
+			return respond(403, APIResponse{Status: "DENIED", Error: fmt.Sprintf("the `%s` WAF is not available to this caller", target.Name)})
+		}
+	}
+	if msg := checkRateLimits(owner, ""); msg != "" {
+		return respond(429, APIResponse{Status: "LIMITED", Error: msg})
+	}
+	var result APIResponse
+	tokensBefore := bedrockTokensUsed.Load()
+	defer func() {
+		var scanned int64
+		if result.Stats != nil {
+			scanned = result.Stats.DataScannedBytes
+		}
+		recordUsage(owner, "", usage{Questions: 1, BedrockTokens: bedrockTokensUsed.Load() - tokensBefore, ScannedBytes: scanned})
+	}()
+
+	sql, templateName, err := generateSQL(ctx, ask.Question, defaultLocation)
+	if err != nil {
+		return respond(502, APIResponse{Status: "FAILED", Error: "SQL generation failed: " + err.Error()})
+	}
+
+	// Fan-out questions are checked per target when the query can fan out; other queries need every table they read
+	fanOut := fanOutQuestion && !isLogsInsightsQuery(sql)
+	reason := grant.checkQueryAccess(sql)
+	if _, ok := fanOutSource(sql); ok && fanOut {
+		reason = ""
+	}
+	if reason != "" {
+		return respond(403, APIResponse{Status: "DENIED", SQL: sql, Template: templateName, Error: reason})
+	}
+
+	if ask.DryRun {
+		return respond(200, APIResponse{Status: "GENERATED", SQL: sql, Template: templateName})
+	}
+	if fanOut && ask.Async {
+		return respond(400, APIResponse{Status: "FAILED", SQL: sql, Template: templateName, Error: "questions about every target cannot run async; set \"async\" to false"})
+	}
+
+	var code int
+	var rows []*athena.Row
+	if fanOut {
+		code, result, rows = runAPIFanOutQuery(ctx, ask.Question, sql, templateName, grant)
+	} else {
+		code, result, rows = runAPIQuery(ctx, sql, templateName, ask.Async, owner, grant)
+	}
+	if result.Status == "SUCCEEDED" && (ask.Analyze == nil || *ask.Analyze) {
+		result.Analysis = analyzeResults(ctx, sql, rows, ask.Question)
+	}
+	return respond(code, result)
+}
+
+// handleAPIQuery runs raw SQL (synchronously or async)
+func handleAPIQuery(ctx context.Context, sql string, async bool, grant AccessGrant, caller, owner string) events.APIGatewayProxyResponse {
+	respond := func(code int, result APIResponse) events.APIGatewayProxyResponse {
+		auditAPIRequest(caller, accessSQL, "", result)
+		return apiJSON(code, result)
+	}
+
+	if !grant.allowsKind(accessSQL) {
+		return respond(403, APIResponse{Status: "DENIED", SQL: sql, Error: "sql requests are not enabled for this caller"})
+	}
+	if reason := grant.checkQueryAccess(sql); reason != "" {
+		return respond(403, APIResponse{Status: "DENIED", SQL: sql, Error: reason})
+	}
+	if msg := checkRateLimits(owner, ""); msg != "" {
+		return respond(429, APIResponse{Status: "LIMITED", SQL: sql, Error: msg})
+	}
+
+	code, result, _ := runAPIQuery(ctx, sql, "", async, owner, grant)
+	var scanned int64
+	if result.Stats != nil {
+		scanned = result.Stats.DataScannedBytes
+	}
+	recordUsage(owner, "", usage{Questions: 1, ScannedBytes: scanned})
+	return respond(code, result)
+}
+
+// auditAPIRequest writes the audit record of an API request (async queries are recorded when started)
+func auditAPIRequest(caller, kind, question string, result APIResponse) {
+	record := AuditRecord{
+		Source:          "api",
+		User:            caller,
+		Kind:            kind,
+		Question:        question,
+		PromptVersion:   promptVersion,
+		ModelID:         bedrockModelID,
+		Template:        result.Template,
+		GeneratedSQL:    result.SQL,
+		PreprocessedSQL: preprocessSqlQuery(result.SQL),
+		QueryID:         result.QueryID,
+		Region:          result.Region,
+		Target:          result.Target,
+		Rows:            len(result.Rows),
+		Outcome:         "success",
+		Error:           result.Error,
+	}
+	if result.Stats != nil {
+		record.DataScannedBytes = result.Stats.DataScannedBytes
+	}
+	switch result.Status {
+	case "FAILED":
+		record.Outcome = "error"
+	case "DENIED":
+		record.Outcome = "denied"
+	case "LIMITED":
+		record.Outcome = "limited"
+	}
+	writeAudit(record)
+}
+
+// runAPIQuery runs SQL synchronously, or starts it for the owner and returns the query ID for polling.
+// Synchronous results are subject to the grant's result limits.
+func runAPIQuery(ctx context.Context, sql, templateName string, async bool, owner string, grant AccessGrant) (int, APIResponse, []*athena.Row) {
+	if async {
+		qid, region, target, errMsg := startAthenaQuery(sql)
+		if errMsg != "" {
+			return 400, APIResponse{Status: "FAILED", SQL: sql, Template: templateName, Error: errMsg}, nil
+		}
+		if err := recordAPIQuery(apiQuery{QueryID: qid, Owner: owner, Region: region, Target: target}); err != nil {
+			slog.ErrorContext(ctx, "Failed to record async query", "query_id", qid, "error", err)
+			return 500, APIResponse{QueryID: qid, Region: region, Target: target, Status: "FAILED", SQL: sql, Template: templateName, Error: "failed to record the query for polling"}, nil
+		}
+		return 202, APIResponse{QueryID: qid, Region: region, Target: target, Status: "QUEUED", SQL: sql, Template: templateName}, nil
+	}
+
+	qid, rows, errMsg, stats := runAthenaQuery(ctx, sql)
+	if errMsg != "" {
+		return 400, APIResponse{QueryID: qid, Region: stats.Region, Status: "FAILED", SQL: sql, Template: templateName, Error: errMsg}, nil
+	}
+	rows, reason := grant.applyResultLimits(rows, stats)
+	if reason != "" {
+		return 403, APIResponse{QueryID: qid, Region: stats.Region, Status: "DENIED", SQL: sql, Template: templateName, Error: reason,
+			Stats: &APIStats{DataScannedBytes: stats.DataScannedBytes}}, nil
+	}
+
+	rows = redactRows(rows, redactionFor(resultTargetNames(sql, stats, nil), ""))
+	result := apiResultFromRows(rows, stats)
+	result.QueryID = qid
+	result.Region = stats.Region
+	result.Target = stats.Target
+	result.Status = "SUCCEEDED"
+	result.SQL = sql
+	result.Template = templateName
+	return 200, result, rows
+}
+
+// runAPIFanOutQuery runs a question's SQL on every target the grant allows and reports the per-target outcome
+func runAPIFanOutQuery(ctx context.Context, question, sql, templateName string, grant AccessGrant) (int, APIResponse, []*athena.Row) {
+	qid, rows, errMsg, stats, fanOut := runQuestionQuery(ctx, question, sql, grant.allowsTarget)
+
+	var targets []APITargetResult
+	for _, r := range fanOut {
+		targets = append(targets, APITargetResult{Name: r.Target.Name, Region: r.Target.Region, QueryID: r.QueryID, Rows: max(len(r.Rows)-1, 0), Error: r.Err})
+	}
+	if errMsg != "" {
+		return 400, APIResponse{QueryID: qid, Region: stats.Region, Status: "FAILED", SQL: sql, Template: templateName, Targets: targets, Error: errMsg}, nil
+	}
+	rows, reason := grant.applyResultLimits(rows, stats)
+	if reason != "" {
+		return 403, APIResponse{QueryID: qid, Region: stats.Region, Status: "DENIED", SQL: sql, Template: templateName, Targets: targets, Error: reason,
+			Stats: &APIStats{DataScannedBytes: stats.DataScannedBytes}}, nil
+	}
+
+	rows = redactRows(rows, redactionFor(resultTargetNames(sql, stats, fanOut), ""))
+	result := apiResultFromRows(rows, stats)
+	result.QueryID = qid
+	result.Region = stats.Region
+	result.Status = "SUCCEEDED"
+	result.SQL = sql
+	result.Template = templateName
+	result.Targets = targets
+	return 200, result, rows
+}
+
+// handleAPIGetQuery polls an async query and returns its results once finished, subject to the grant's result limits
+func handleAPIGetQuery(region, qid string, target WAFTarget, grant AccessGrant) events.APIGatewayProxyResponse {
+	state, rows, stats, errMsg := getAthenaQueryStatus(region, qid, target)
+	if state == "" {
+		return apiJSON(404, APIResponse{QueryID: qid, Region: region, Status: "UNKNOWN", Error: errMsg})
+	}
+	if errMsg != "" {
+		return apiJSON(200, APIResponse{QueryID: qid, Region: region, Status: state, Error: errMsg})
+	}
+	if state != "SUCCEEDED" {
+		return apiJSON(200, APIResponse{QueryID: qid, Region: region, Status: state})
+	}
+
+	rows, reason := grant.applyResultLimits(rows, stats)
+	if reason != "" {
+		return apiJSON(403, APIResponse{QueryID: qid, Region: region, Status: "DENIED", Error: reason})
+	}
+
+	var targetNames []string
+	if target.Name != "" {
+		targetNames = []string{target.Name}
+	}
+	result := apiResultFromRows(redactRows(rows, redactionFor(targetNames, "")), stats)
+	result.QueryID = qid
+	result.Region = region
+	result.Status = state
+	return apiJSON(200, result)
+}
+
+// apiResultFromRows converts Athena rows and statistics to the API representation
+func apiResultFromRows(rows []*athena.Row, stats QueryStats) APIResponse {
+	headers, values := rowValues(rows)
+
+	columns := make([]APIColumn, len(headers))
+	for i, h := range headers {
+		columns[i] = APIColumn{Name: h}
+		if i < len(stats.ColumnTypes) {
+			columns[i].Type = stats.ColumnTypes[i]
+		}
+	}
+
+	apiStats := &APIStats{
+		DataScannedBytes:  stats.DataScannedBytes,
+		EngineExecutionMs: stats.EngineExecutionMs,
+		QueueMs:           stats.QueueMs,
+		Cached:            stats.Cached,
+		ReusedResult:      stats.ReusedResult,
+	}
+	if stats.Cached {
+		apiStats.CachedAt = stats.CachedAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+
+	if values == nil {
+		values = [][]string{}
+	}
+	return APIResponse{Columns: columns, Rows: values, Stats: apiStats}
+}
+
+// apiJSON builds a JSON API response
+func apiJSON(code int, body interface{}) events.APIGatewayProxyResponse {
+	b, err := json.Marshal(body)
+	if err != nil {
+		slog.Error("Failed to encode API response", "error", err)
+		return response(500, `{"error":"internal error"}`)
+	}
+	return response(code, string(b))
+}
+
+// apiError builds a JSON error response
+func apiError(code int, msg string) events.APIGatewayProxyResponse {
+	return apiJSON(code, APIResponse{Status: "ERROR", Error: msg})
+}
@@ -1,83 +1,98 @@
-package main
+package analyzer
 
 import (
 	"context"
+	"encoding/csv"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// runAthenaQuery executes an Athena query and retrieves the results
-func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, string, string) {
+// QueryStats describes how a query was executed
+type QueryStats struct {
+	Region            string
+	Target            string // Registered target the query ran for (empty when the table is not registered)
+	DataScannedBytes  int64
+	EngineExecutionMs int64
+	QueueMs           int64
+	ReusedResult      bool      // Athena returned a previous result (ResultReuseConfiguration)
+	Cached            bool      // Rows came from the application query cache
+	CachedAt          time.Time // When the cached rows were stored
+	ColumnTypes       []string  // Athena column types from the result metadata
+}
+
+// validateQuery rejects queries that could modify data
+func validateQuery(query string) string {
 	// Basic SQL injection check (simplified implementation)
 	if strings.Contains(strings.ToUpper(query), "DROP") ||
 		strings.Contains(strings.ToUpper(query), "DELETE") ||
 		strings.Contains(strings.ToUpper(query), "INSERT") ||
 		strings.Contains(strings.ToUpper(query), "UPDATE") {
-		return "", nil, "Invalid SQL command detected", ""
+		return "Invalid SQL command detected"
+	}
+	return validateDialect(query)
+}
+
+// runAthenaQuery executes an Athena query and retrieves the results
+func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, string, QueryStats) {
+	if errMsg := validateQuery(query); errMsg != "" {
+		return "", nil, errMsg, QueryStats{}
 	}
 
+	_, span := startSpan(ctx, "preprocess")
 	query = preprocessSqlQuery(query)
+	span.End()
 
-	// Detect region from query and get appropriate Athena client
+	// Detect region from query
 	region := getQueryRegion(query)
-	client := getAthenaClient(region)
-	log.Printf("Executing query (region: %s)", region)
-
-	// Build S3 bucket path (based on region)
-	s3Path := fmt.Sprintf("s3://%s/", athenaOutput)
-	if region == "us-east-1" && strings.Contains(athenaOutput, "ap-northeast-1") {
-		// Replace region part in bucket name
-		s3Path = strings.Replace(s3Path, "ap-northeast-1", "us-east-1", 1)
-
-		// Fix bucket name - use correct bucket name for us-east-1
-		// Get correct bucket name from IAM policy specified in lambda.tf
-		if strings.Contains(s3Path, "xxx") {
-			s3Path = strings.Replace(s3Path, "xxx", "xxx", 1)
-		}
 
-		log.Printf("Adjusted S3 path for us-east-1: %s", s3Path)
+	// Return stored rows when the same query ran recently
+	cacheKey := queryCacheKey(query, region)
+	if qid, rows, types, cachedAt, ok := getCachedQueryResult(cacheKey); ok {
+		slog.InfoContext(ctx, "Query cache hit", "key", cacheKey, "age", time.Since(cachedAt).Round(time.Second).String(), "query_id", qid, "region", region)
+		target, _ := targetForQuery(query)
+		return qid, rows, "", QueryStats{Region: region, Target: target.Name, Cached: true, CachedAt: cachedAt, ColumnTypes: types}
 	}
 
-	// Adjust database name based on region before query execution
-	dbName := athenaDB
-	// Separate table name from database name (in case of dot separation)
-	dbParts := strings.Split(dbName, ".")
-	dbNameOnly := dbParts[0]
-
-	if region == "us-east-1" {
-		// Replace database name for us-east-1 region
-		dbNameOnly = strings.Replace(dbNameOnly, "ap_northeast_1", "us_east_1", -1)
-		dbNameOnly = strings.Replace(dbNameOnly, "ap-northeast-1", "us-east-1", -1)
-		log.Printf("Adjusted database name for us-east-1: %s", dbNameOnly)
+	qid, rows, errMsg, stats := executeQuery(ctx, query, region)
+	if errMsg == "" {
+		putCachedQueryResult(cacheKey, qid, region, rows, stats.ColumnTypes)
 	}
+	return qid, rows, errMsg, stats
+}
 
-	log.Printf("Using database name: %s", dbNameOnly)
+// runAthenaQueryInRegion executes an already validated query in the given region and retrieves the results
+func runAthenaQueryInRegion(ctx context.Context, query string, region string) (qid string, rows []*athena.Row, errMsg string, stats QueryStats) {
+	target, _ := targetForQuery(query)
+	client := getAthenaClient(region, target)
+	stats = QueryStats{Region: region, Target: target.Name}
+	slog.InfoContext(ctx, "Executing query", "region", region, "target", target.Name)
+
+	ctx, span := startSpan(ctx, "athena.query", attribute.String("aws.region", region), attribute.String("athena.target", target.Name))
+	defer func() {
+		span.SetAttributes(attribute.String("athena.query_id", qid),
+			attribute.Int64("athena.data_scanned_bytes", stats.DataScannedBytes),
+			attribute.Int64("athena.queue_ms", stats.QueueMs),
+			attribute.Int64("athena.execution_ms", stats.EngineExecutionMs))
+		endSpan(span, errMsg)
+	}()
 
-	out, err := client.StartQueryExecution(&athena.StartQueryExecutionInput{
-		QueryString: aws.String(query),
-		QueryExecutionContext: &athena.QueryExecutionContext{
-			Database: aws.String(dbNameOnly),
-		},
-		ResultConfiguration: &athena.ResultConfiguration{
-			OutputLocation: aws.String(s3Path),
-		},
-		WorkGroup: aws.String(athenaWorkgroup),
-	})
-	if err != nil {
-		errMsg := fmt.Sprintf("Athena start error: %v", err)
-		log.Printf(errMsg)
-		return "", nil, errMsg, region
+	startCtx, start := startSpan(ctx, "athena.start")
+	qid, errMsg = startQueryExecution(startCtx, client, query, region, target)
+	start.SetAttributes(attribute.String("athena.query_id", qid))
+	endSpan(start, errMsg)
+	if errMsg != "" {
+		return "", nil, errMsg, stats
 	}
-
-	qid := *out.QueryExecutionId
-	log.Printf("Started Athena query with ID: %s", qid)
+	ctx = withLogAttrs(ctx, "query_id", qid, "region", region)
 
 	// Query timeout setting (45 seconds) - set sufficiently shorter than overall Lambda timeout
 	queryTimeout := 45 * time.Second
@@ -88,6 +103,10 @@ func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, s
 	doneCh := make(chan struct{})
 	var errorMsg string
 	var state string
+	var finalStatus *athena.QueryExecution
+	var attempts int
+	// Status calls are not cancelled with the query context; the timeout is handled below
+	pollCtx, poll := startSpan(context.WithoutCancel(ctx), "athena.poll", attribute.String("athena.query_id", qid))
 
 	// Goroutine to poll query status
 	go func() {
@@ -97,31 +116,31 @@ func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, s
 		ticker := time.NewTicker(2 * time.Second)
 		defer ticker.Stop()
 
-		attempts := 0
 		for {
 			select {
 			case <-queryContext.Done():
 				// Context was cancelled or timed out
-				log.Printf("Query context done: %v", queryContext.Err())
+				slog.DebugContext(ctx, "Query context done", "error", queryContext.Err())
 				return
 			case <-ticker.C:
 				// Check query status
 				attempts++
-				status, err := client.GetQueryExecution(&athena.GetQueryExecutionInput{
+				status, err := client.GetQueryExecutionWithContext(pollCtx, &athena.GetQueryExecutionInput{
 					QueryExecutionId: aws.String(qid),
 				})
 
 				if err != nil {
 					errorMsg = fmt.Sprintf("Failed to get query status: %v", err)
-					log.Printf(errorMsg)
+					slog.ErrorContext(ctx, "Failed to get query status", "error", err)
 					return
 				}
 
 				state = *status.QueryExecution.Status.State
-				log.Printf("Query execution state: %s (attempt %d)", state, attempts)
+				finalStatus = status.QueryExecution
+				slog.DebugContext(ctx, "Query execution state", "state", state, "attempt", attempts)
 
 				if state == "SUCCEEDED" {
-					log.Printf("Query succeeded after %d attempts", attempts)
+					slog.InfoContext(ctx, "Query succeeded", "attempts", attempts)
 					return
 				} else if state == "FAILED" {
 					// Get detailed error cause
@@ -131,11 +150,11 @@ func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, s
 					}
 
 					errorMsg = fmt.Sprintf("Athena query failed: %s", stateReason)
-					log.Printf("%s\nQuery: %s", errorMsg, query)
+					slog.ErrorContext(ctx, "Athena query failed", "reason", stateReason, "sql", query)
 					return
 				} else if state == "CANCELLED" {
 					errorMsg = "Athena query was cancelled"
-					log.Printf(errorMsg)
+					slog.WarnContext(ctx, errorMsg)
 					return
 				}
 			}
@@ -150,41 +169,220 @@ func runAthenaQuery(ctx context.Context, query string) (string, []*athena.Row, s
 			if errorMsg == "" {
 				errorMsg = fmt.Sprintf("Athena query did not complete successfully. Final state: %s", state)
 			}
-			return qid, nil, errorMsg, region
+			poll.SetAttributes(attribute.String("athena.state", state), attribute.Int("athena.poll_attempts", attempts))
+			endSpan(poll, errorMsg)
+			return qid, nil, errorMsg, stats
 		}
+		poll.SetAttributes(attribute.String("athena.state", state), attribute.Int("athena.poll_attempts", attempts))
+		endSpan(poll, errorMsg)
+		stats = queryStatsFrom(region, finalStatus)
+		stats.Target = target.Name
+		putMetrics(ctx, map[string]string{"Target": target.Name},
+			metric{Name: "AthenaQueueTime", Unit: unitMilliseconds, Value: float64(stats.QueueMs)},
+			metric{Name: "AthenaExecutionTime", Unit: unitMilliseconds, Value: float64(stats.EngineExecutionMs)},
+			metric{Name: "AthenaBytesScanned", Unit: unitBytes, Value: float64(stats.DataScannedBytes)})
 	case <-queryContext.Done():
 		// Query timed out - force cancellation
-		log.Printf("Query timed out after %v. Cancelling query...", queryTimeout)
+		slog.WarnContext(ctx, "Query timed out, cancelling", "timeout", queryTimeout.String())
+		endSpan(poll, "timed out")
 		_, err := client.StopQueryExecution(&athena.StopQueryExecutionInput{
 			QueryExecutionId: aws.String(qid),
 		})
 
 		if err != nil {
-			log.Printf("Failed to cancel query: %v", err)
+			slog.ErrorContext(ctx, "Failed to cancel query", "error", err)
 		}
 
-		return qid, nil, fmt.Sprintf("Query timed out (%.0f seconds elapsed). Execution aborted.", queryTimeout.Seconds()), region
+		return qid, nil, fmt.Sprintf("Query timed out (%.0f seconds elapsed). Execution aborted.", queryTimeout.Seconds()), stats
 	}
 
 	// Get results (only on success)
-	res, err := client.GetQueryResults(&athena.GetQueryResultsInput{
+	resultsCtx, results := startSpan(ctx, "athena.results", attribute.String("athena.query_id", qid))
+	res, err := client.GetQueryResultsWithContext(resultsCtx, &athena.GetQueryResultsInput{
 		QueryExecutionId: aws.String(qid),
 		MaxResults:       aws.Int64(20), // Limit to maximum 20 rows
 	})
+	if err != nil {
+		endSpan(results, err.Error())
+	} else {
+		results.SetAttributes(attribute.Int("rows", len(res.ResultSet.Rows)))
+		results.End()
+	}
 
 	if err != nil {
 		errorMsg = fmt.Sprintf("Failed to get query results: %v", err)
-		log.Printf(errorMsg)
-		return qid, nil, errorMsg, region
+		slog.ErrorContext(ctx, "Failed to get query results", "error", err)
+		return qid, nil, errorMsg, stats
 	}
 
 	// Even if additional pagination is needed, use only the first page
 	// This prevents prompts like "Continue iteration?"
 	if res.NextToken != nil {
-		log.Printf("Additional data available, but using only first 20 rows (NextToken: %s...)", (*res.NextToken)[:min(10, len(*res.NextToken))])
+		slog.DebugContext(ctx, "Additional data available, using only the first 20 rows")
 	}
 
-	return qid, res.ResultSet.Rows, "", region
+	stats.ColumnTypes = columnTypes(res.ResultSet)
+	return qid, res.ResultSet.Rows, "", stats
+}
+
+// startQueryExecution starts a query in the region's database and output location, returning its ID.
+// Targets in other accounts can override the workgroup and output location.
+func startQueryExecution(ctx context.Context, client *athena.Athena, query string, region string, target WAFTarget) (string, string) {
+	// Build S3 bucket path (based on region)
+	s3Path := fmt.Sprintf("s3://%s/", athenaOutput)
+	if region == "us-east-1" && strings.Contains(athenaOutput, "ap-northeast-1") {
+		// Replace region part in bucket name
+		s3Path = strings.Replace(s3Path, "ap-northeast-1", "us-east-1", 1)
+
+		// Fix bucket name - use correct bucket name for us-east-1
+		// Get correct bucket name from IAM policy specified in lambda.tf
+		if strings.Contains(s3Path, "xxx") {
+			s3Path = strings.Replace(s3Path, "xxx", "xxx", 1)
+		}
+
+		slog.Debug("Adjusted S3 path for us-east-1", "output_location", s3Path)
+	}
+
+	// Adjust database name based on region before query execution
+	dbName := athenaDB
+	// Separate table name from database name (in case of dot separation)
+	dbParts := strings.Split(dbName, ".")
+	dbNameOnly := dbParts[0]
+
+	if region == "us-east-1" {
+		// Replace database name for us-east-1 region
+		dbNameOnly = strings.Replace(dbNameOnly, "ap_northeast_1", "us_east_1", -1)
+		dbNameOnly = strings.Replace(dbNameOnly, "ap-northeast-1", "us-east-1", -1)
+		slog.Debug("Adjusted database name for us-east-1", "database", dbNameOnly)
+	}
+
+	slog.Debug("Using database", "database", dbNameOnly)
+
+	workgroup := athenaWorkgroup
+	if target.Workgroup != "" {
+		workgroup = target.Workgroup
+	}
+	if target.OutputLocation != "" {
+		s3Path = target.OutputLocation
+	}
+
+	out, err := client.StartQueryExecutionWithContext(ctx, &athena.StartQueryExecutionInput{
+		QueryString: aws.String(query),
+		QueryExecutionContext: &athena.QueryExecutionContext{
+			Database: aws.String(dbNameOnly),
+		},
+		ResultConfiguration: &athena.ResultConfiguration{
+			OutputLocation: aws.String(s3Path),
+		},
+		WorkGroup:                aws.String(workgroup),
+		ResultReuseConfiguration: resultReuseConfiguration(),
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("Athena start error: %v", err)
+		slog.Error("Athena start error", "region", region, "error", err)
+		return "", errMsg
+	}
+
+	qid := *out.QueryExecutionId
+	slog.Info("Started Athena query", "query_id", qid, "region", region)
+	return qid, ""
+
+}
+
+// startAthenaQuery validates and starts a query without waiting for it (used for async API requests).
+// It returns the query ID, region and the name of the target the query runs for.
+func startAthenaQuery(query string) (string, string, string, string) {
+	if !isAthenaBackend() || isLogsInsightsQuery(query) {
+		return "", "", "", "Async queries require the Athena backend"
+	}
+	if errMsg := validateQuery(query); errMsg != "" {
+		return "", "", "", errMsg
+	}
+
+	query = preprocessSqlQuery(query)
+	region := getQueryRegion(query)
+	target, _ := targetForQuery(query)
+	qid, errMsg := startQueryExecution(context.Background(), getAthenaClient(region, target), query, region, target)
+	return qid, region, target.Name, errMsg
+}
+
+// getAthenaQueryStatus returns the state of a query and, once it succeeded, its first page of results
+func getAthenaQueryStatus(region, qid string, target WAFTarget) (string, []*athena.Row, QueryStats, string) {
+	client := getAthenaClient(region, target)
+	stats := QueryStats{Region: region}
+
+	status, err := client.GetQueryExecution(&athena.GetQueryExecutionInput{
+		QueryExecutionId: aws.String(qid),
+	})
+	if err != nil {
+		return "", nil, stats, fmt.Sprintf("Failed to get query status: %v", err)
+	}
+
+	state := aws.StringValue(status.QueryExecution.Status.State)
+	switch state {
+	case "SUCCEEDED":
+		stats = queryStatsFrom(region, status.QueryExecution)
+	case "FAILED":
+		return state, nil, stats, fmt.Sprintf("Athena query failed: %s", aws.StringValue(status.QueryExecution.Status.StateChangeReason))
+	case "CANCELLED":
+		return state, nil, stats, "Athena query was cancelled"
+	default:
+		return state, nil, stats, ""
+	}
+
+	res, err := client.GetQueryResults(&athena.GetQueryResultsInput{
+		QueryExecutionId: aws.String(qid),
+		MaxResults:       aws.Int64(20),
+	})
+	if err != nil {
+		return state, nil, stats, fmt.Sprintf("Failed to get query results: %v", err)
+	}
+	stats.ColumnTypes = columnTypes(res.ResultSet)
+	return state, res.ResultSet.Rows, stats, ""
+}
+
+// columnTypes extracts the column types from a result set
+func columnTypes(rs *athena.ResultSet) []string {
+	if rs == nil || rs.ResultSetMetadata == nil {
+		return nil
+	}
+	var types []string
+	for _, c := range rs.ResultSetMetadata.ColumnInfo {
+		types = append(types, aws.StringValue(c.Type))
+	}
+	return types
+}
+
+// resultReuseConfiguration enables Athena query result reuse when ATHENA_RESULT_REUSE_MINUTES is set
+func resultReuseConfiguration() *athena.ResultReuseConfiguration {
+	if athenaResultReuseMinutes <= 0 {
+		return nil
+	}
+	return &athena.ResultReuseConfiguration{
+		ResultReuseByAgeConfiguration: &athena.ResultReuseByAgeConfiguration{
+			Enabled:         aws.Bool(true),
+			MaxAgeInMinutes: aws.Int64(int64(athenaResultReuseMinutes)),
+		},
+	}
+}
+
+// queryStatsFrom extracts execution statistics from a finished query
+func queryStatsFrom(region string, execution *athena.QueryExecution) QueryStats {
+	stats := QueryStats{Region: region}
+	if execution == nil || execution.Statistics == nil {
+		return stats
+	}
+
+	s := execution.Statistics
+	stats.DataScannedBytes = aws.Int64Value(s.DataScannedInBytes)
+	stats.EngineExecutionMs = aws.Int64Value(s.EngineExecutionTimeInMillis)
+	stats.QueueMs = aws.Int64Value(s.QueryQueueTimeInMillis)
+	if s.ResultReuseInformation != nil {
+		stats.ReusedResult = aws.BoolValue(s.ResultReuseInformation.ReusedPreviousResult)
+	}
+	slog.Info("Query statistics", "query_id", aws.StringValue(execution.QueryExecutionId), "region", region,
+		"scanned_bytes", stats.DataScannedBytes, "execution_ms", stats.EngineExecutionMs, "queue_ms", stats.QueueMs, "reused", stats.ReusedResult)
+	return stats
 }
 
 // preprocessSqlQuery performs preprocessing of SQL queries
@@ -226,28 +424,10 @@ func preprocessSqlQuery(query string) string {
 		query = re.ReplaceAllStringFunc(query, func(match string) string {
 			submatches := re.FindStringSubmatch(match)
 			if len(submatches) >= 3 {
+				// Literals are UTC like the table, as the prompt asks; only the type is fixed here
 				date1 := submatches[1]
 				date2 := submatches[2]
 
-				// Attempt to convert from JST to UTC (only when timezone is not specified)
-				if !strings.Contains(date1, "+") && !strings.Contains(date1, "Z") {
-					if t, err := time.Parse("2006-01-02 15:04:05", date1); err == nil {
-						// Interpret as JST and convert to UTC (subtract 9 hours)
-						utcTime := t.Add(-9 * time.Hour)
-						date1 = utcTime.Format("2006-01-02 15:04:05")
-						log.Printf("JST to UTC conversion: %s -> %s", submatches[1], date1)
-					}
-				}
-
-				if !strings.Contains(date2, "+") && !strings.Contains(date2, "Z") {
-					if t, err := time.Parse("2006-01-02 15:04:05", date2); err == nil {
-						// Interpret as JST and convert to UTC (subtract 9 hours)
-						utcTime := t.Add(-9 * time.Hour)
-						date2 = utcTime.Format("2006-01-02 15:04:05")
-						log.Printf("JST to UTC conversion: %s -> %s", submatches[2], date2)
-					}
-				}
-
 				// Explicit cast to timestamp
 				return fmt.Sprintf("time_dt BETWEEN TIMESTAMP '%s' AND TIMESTAMP '%s'", date1, date2)
 			}
@@ -278,12 +458,17 @@ func preprocessSqlQuery(query string) string {
 		}
 	}
 
-	log.Printf("Preprocessed query: %s", query)
+	slog.Debug("Preprocessed query", "sql", query)
 	return query
 }
 
-// formatAthenaResults formats Athena query results
+// formatAthenaResults formats Athena query results (timestamps in the workspace timezone)
 func formatAthenaResults(rows []*athena.Row) string {
+	return formatAthenaResultsIn(rows, defaultLocation)
+}
+
+// formatAthenaResultsIn formats Athena query results with timestamps shown in the given timezone
+func formatAthenaResultsIn(rows []*athena.Row, loc *time.Location) string {
 	if len(rows) == 0 {
 		return "No results found"
 	}
@@ -310,7 +495,7 @@ func formatAthenaResults(rows []*athena.Row) string {
 
 	// If there are no normal columns, use _col format columns as well
 	if len(headers) == 0 && len(colHeaders) > 0 {
-		log.Printf("No normal columns found, using _col format columns")
+		slog.Debug("No normal columns found, using _col format columns")
 		// _col0 gets special treatment (usually excluded as it's a row number)
 		for i, data := range rows[0].Data {
 			if data.VarCharValue != nil {
@@ -363,7 +548,7 @@ func formatAthenaResults(rows []*athena.Row) string {
 			if colIdx < len(rows[i].Data) {
 				data := rows[i].Data[colIdx]
 				if data.VarCharValue != nil {
-					valueLen := len(*data.VarCharValue)
+					valueLen := len(formatCellValue(headers[colIndex], *data.VarCharValue, loc))
 					if valueLen > colWidths[colIndex] {
 						colWidths[colIndex] = valueLen
 					}
@@ -400,7 +585,7 @@ func formatAthenaResults(rows []*athena.Row) string {
 			if colIdx < len(rows[i].Data) {
 				data := rows[i].Data[colIdx]
 				if data.VarCharValue != nil {
-					value = *data.VarCharValue
+					value = formatCellValue(headers[colIndex], *data.VarCharValue, loc)
 				} else {
 					value = "NULL"
 				}
@@ -425,12 +610,10 @@ func formatAthenaResults(rows []*athena.Row) string {
 	return sb.String()
 }
 
-// getAthenaClient function: generates Athena client based on region
-func getAthenaClient(region string) *athena.Athena {
-	log.Printf("Creating Athena client (region: %s)", region)
-	return athena.New(session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})))
+// getAthenaClient function: generates Athena client based on region (with the target's role when configured)
+func getAthenaClient(region string, target WAFTarget) *athena.Athena {
+	slog.Debug("Creating Athena client", "region", region, "target", target.Name)
+	return athena.New(getTargetSession(region, target))
 }
 
 // formatResultsForAnalysis formats results for analysis
@@ -466,7 +649,7 @@ func formatResultsForAnalysis(rows []*athena.Row) string {
 
 	// If there are no normal columns, use _col format columns as well
 	if len(headers) == 0 && len(colHeaders) > 0 {
-		log.Printf("For analysis: No normal columns found, using _col format columns")
+		slog.Debug("For analysis: no normal columns found, using _col format columns")
 		// _col0 gets special treatment (usually excluded as it's a row number)
 		for i, data := range rows[0].Data {
 			if data.VarCharValue != nil {
@@ -512,7 +695,7 @@ func formatResultsForAnalysis(rows []*athena.Row) string {
 			if colIdx < len(rows[i].Data) {
 				data := rows[i].Data[colIdx]
 				if data.VarCharValue != nil {
-					valueLen := len(*data.VarCharValue)
+					valueLen := len(formatCellValue(headers[colIndex], *data.VarCharValue, defaultLocation))
 					if valueLen > colWidths[colIndex] {
 						colWidths[colIndex] = valueLen
 					}
@@ -546,7 +729,7 @@ func formatResultsForAnalysis(rows []*athena.Row) string {
 			if colIdx < len(rows[i].Data) {
 				data := rows[i].Data[colIdx]
 				if data.VarCharValue != nil {
-					value = *data.VarCharValue
+					value = formatCellValue(headers[colIndex], *data.VarCharValue, defaultLocation)
 				} else {
 					value = "NULL"
 				}
@@ -582,3 +765,44 @@ func extractDateRange(query string) string {
 
 	return "unknown" // When date range cannot be determined
 }
+
+// Largest result file read for an export
+const maxExportBytes = 50 << 20
+
+// fetchQueryResultCSV reads the complete result of a finished query from its output location in S3, with the
+// target's role like the query itself (GetQueryResults only returns the first page)
+func fetchQueryResultCSV(ctx context.Context, region, qid string, target WAFTarget) ([]*athena.Row, error) {
+	execution, err := getAthenaClient(region, target).GetQueryExecutionWithContext(ctx, &athena.GetQueryExecutionInput{
+		QueryExecutionId: aws.String(qid),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get query execution: %v", err)
+	}
+	location := ""
+	if execution.QueryExecution != nil && execution.QueryExecution.ResultConfiguration != nil {
+		location = aws.StringValue(execution.QueryExecution.ResultConfiguration.OutputLocation)
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+	if !strings.HasPrefix(location, "s3://") || !ok || key == "" {
+		return nil, fmt.Errorf("query has no S3 result location")
+	}
+
+	object, err := getS3Client(region, target).GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read query result: %v", err)
+	}
+	defer object.Body.Close()
+	if aws.Int64Value(object.ContentLength) > maxExportBytes {
+		return nil, fmt.Errorf("query result is larger than %s", formatBytes(maxExportBytes))
+	}
+
+	records, err := csv.NewReader(io.LimitReader(object.Body, maxExportBytes)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query result: %v", err)
+	}
+	rows := make([]*athena.Row, 0, len(records))
+	for _, r := range records {
+		rows = append(rows, stringsToRow(r))
+	}
+	return rows, nil
+}
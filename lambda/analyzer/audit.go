@@ -0,0 +1,367 @@
+package analyzer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Audit configuration
+var (
+	// Where audit records go: "log" (CloudWatch Logs as JSON lines, default), "s3" or "dynamodb"
+	auditSinkName = envOrDefault("AUDIT_SINK", "log")
+	auditBucket   = os.Getenv("AUDIT_BUCKET")
+	auditPrefix   = envOrDefault("AUDIT_PREFIX", "waf-audit/")
+	auditTable    = os.Getenv("AUDIT_TABLE")
+	// Log group searched by the "log" sink when listing activity (the function's own log group by default)
+	auditLogGroup = envOrDefault("AUDIT_LOG_GROUP", os.Getenv("AWS_LAMBDA_LOG_GROUP_NAME"))
+
+	auditSink = newAuditSink(auditSinkName)
+)
+
+// How far back recent activity is searched
+const auditLookbackDays = 7
+
+// AuditRecord is the audit trail entry written for every request
+type AuditRecord struct {
+	Day              string `json:"day" dynamodbav:"day"` // UTC date (DynamoDB partition key)
+	ID               string `json:"id" dynamodbav:"id"`   // Time-ordered unique ID (DynamoDB sort key)
+	Time             string `json:"time" dynamodbav:"time"`
+	Source           string `json:"source" dynamodbav:"source"` // mention, slash, button, api, mcp, cli
+	User             string `json:"user" dynamodbav:"user"`
+	Channel          string `json:"channel,omitempty" dynamodbav:"channel,omitempty"`
+	Team             string `json:"team,omitempty" dynamodbav:"team,omitempty"`
+	Kind             string `json:"kind" dynamodbav:"kind"` // ask, sql, export, block
+	Question         string `json:"question,omitempty" dynamodbav:"question,omitempty"`
+	PromptVersion    string `json:"prompt_version,omitempty" dynamodbav:"prompt_version,omitempty"`
+	ModelID          string `json:"model_id,omitempty" dynamodbav:"model_id,omitempty"`
+	Template         string `json:"template,omitempty" dynamodbav:"template,omitempty"`
+	GeneratedSQL     string `json:"generated_sql,omitempty" dynamodbav:"generated_sql,omitempty"`
+	PreprocessedSQL  string `json:"preprocessed_sql,omitempty" dynamodbav:"preprocessed_sql,omitempty"`
+	QueryID          string `json:"query_id,omitempty" dynamodbav:"query_id,omitempty"`
+	Region           string `json:"region,omitempty" dynamodbav:"region,omitempty"`
+	Target           string `json:"target,omitempty" dynamodbav:"target,omitempty"`
+	DataScannedBytes int64  `json:"data_scanned_bytes" dynamodbav:"data_scanned_bytes"`
+	Rows             int    `json:"rows" dynamodbav:"rows"`
+	Outcome          string `json:"outcome" dynamodbav:"outcome"` // success, error, denied, limited, clarify
+	Error            string `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	MessageTS        string `json:"message_ts,omitempty" dynamodbav:"message_ts,omitempty"`
+}
+
+// AuditSink stores audit records and lists recent ones
+type AuditSink interface {
+	Write(record AuditRecord) error
+	// Recent returns up to limit records, newest first, optionally only those of one user
+	Recent(limit int, user string) ([]AuditRecord, error)
+}
+
+// newAuditSink returns the configured audit sink (the log sink when the configuration is incomplete)
+func newAuditSink(name string) AuditSink {
+	switch strings.ToLower(name) {
+	case "s3":
+		if auditBucket != "" {
+			return s3AuditSink{}
+		}
+		slog.Warn("AUDIT_SINK=s3 requires AUDIT_BUCKET, writing audit records to the log")
+	case "dynamodb":
+		if auditTable != "" {
+			return dynamoAuditSink{}
+		}
+		slog.Warn("AUDIT_SINK=dynamodb requires AUDIT_TABLE, writing audit records to the log")
+	}
+	return logAuditSink{}
+}
+
+type auditContextKey struct{}
+
+// withAuditSource attaches the request source and Slack team to a context for the audit record
+func withAuditSource(ctx context.Context, source, team string) context.Context {
+	return context.WithValue(ctx, auditContextKey{}, AuditRecord{Source: source, Team: team})
+}
+
+// newAuditRecord starts an audit record with the source attached to the context
+func newAuditRecord(ctx context.Context, channel, user, kind, question string) AuditRecord {
+	record, _ := ctx.Value(auditContextKey{}).(AuditRecord)
+	record.Channel = channel
+	record.User = user
+	record.Kind = kind
+	record.Question = question
+	return record
+}
+
+// setQueryResult fills the query fields and outcome of a record from an executed query
+func (r *AuditRecord) setQueryResult(sql, qid string, rows []*athena.Row, errMsg string, stats QueryStats, fanOut []FanOutResult) {
+	if r.GeneratedSQL == "" {
+		r.GeneratedSQL = sql
+	}
+	r.PreprocessedSQL = preprocessSqlQuery(sql)
+	r.QueryID, r.Region = qid, stats.Region
+	r.Target = strings.Join(resultTargetNames(sql, stats, fanOut), ",")
+	r.DataScannedBytes, r.Rows = stats.DataScannedBytes, max(len(rows)-1, 0)
+	r.Outcome = "success"
+	if errMsg != "" {
+		r.Outcome, r.Error = "error", errMsg
+	}
+}
+
+// localAuditUser identifies the operating system user of the CLI and the stdio MCP server in audit records
+func localAuditUser() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	return "local:" + name
+}
+
+// writeAudit stamps a record and writes it to the audit sink (failures are logged, never fatal)
+func writeAudit(record AuditRecord) {
+	now := time.Now().UTC()
+	b := make([]byte, 4)
+	rand.Read(b)
+	record.Day = now.Format("2006-01-02")
+	record.ID = now.Format("20060102T150405.000000000") + "-" + hex.EncodeToString(b)
+	record.Time = now.Format(time.RFC3339)
+
+	if err := auditSink.Write(record); err != nil {
+		slog.Error("Failed to write audit record", "id", record.ID, "error", err)
+		// Keep the record in the function log so it is not lost
+		logAuditSink{}.Write(record)
+	}
+}
+
+// logAuditSink writes records as structured log lines with msg "AUDIT" and the record under "audit"
+// (CloudWatch Logs in Lambda)
+type logAuditSink struct{}
+
+// Write logs the record regardless of LOG_LEVEL
+func (logAuditSink) Write(record AuditRecord) error {
+	auditLogger.Info("AUDIT", "audit", record)
+	return nil
+}
+
+// Recent searches the audit log group for AUDIT lines, widening the window until it has limit records
+func (logAuditSink) Recent(limit int, user string) ([]AuditRecord, error) {
+	if auditLogGroup == "" {
+		return nil, fmt.Errorf("AUDIT_LOG_GROUP is not set")
+	}
+
+	// Events come oldest first, so each window is read to the end before keeping the newest
+	var records []AuditRecord
+	for _, window := range auditLogWindows {
+		var err error
+		if records, err = searchAuditLog(time.Now().Add(-window), user); err != nil {
+			return nil, err
+		}
+		if len(records) >= limit {
+			break
+		}
+	}
+	return newestAuditRecords(records, limit), nil
+}
+
+// Windows searched in turn by the "log" sink, up to the look-back limit
+var auditLogWindows = []time.Duration{time.Hour, 24 * time.Hour, auditLookbackDays * 24 * time.Hour}
+
+// searchAuditLog reads every AUDIT line logged since start
+func searchAuditLog(start time.Time, user string) ([]AuditRecord, error) {
+	client := cloudwatchlogs.New(baseSession)
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName:  aws.String(auditLogGroup),
+		FilterPattern: aws.String(`{ $.msg = "AUDIT" }`),
+		StartTime:     aws.Int64(start.UnixMilli()),
+	}
+	var records []AuditRecord
+	err := client.FilterLogEventsPages(input, func(page *cloudwatchlogs.FilterLogEventsOutput, last bool) bool {
+		for _, e := range page.Events {
+			// Lambda may prefix the JSON line with a timestamp and request ID
+			msg := aws.StringValue(e.Message)
+			i := strings.Index(msg, "{")
+			if i < 0 {
+				continue
+			}
+			var line struct {
+				Msg   string      `json:"msg"`
+				Audit AuditRecord `json:"audit"`
+			}
+			if json.Unmarshal([]byte(strings.TrimSpace(msg[i:])), &line) == nil && line.Msg == "AUDIT" && (user == "" || line.Audit.User == user) {
+				records = append(records, line.Audit)
+			}
+		}
+		return true
+	})
+	return records, err
+}
+
+// s3AuditSink writes each record as a JSON line object under <prefix>dt=YYYY-MM-DD/ (queryable with Athena)
+type s3AuditSink struct{}
+
+// Write stores the record as a one-line JSONL object
+func (s3AuditSink) Write(record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s3.New(baseSession).PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(auditBucket),
+		Key:         aws.String(fmt.Sprintf("%sdt=%s/%s.jsonl", auditPrefix, record.Day, record.ID)),
+		Body:        bytes.NewReader(append(b, '\n')),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	return err
+}
+
+// Recent reads the newest objects of the last days (keys sort by time within a day)
+func (s3AuditSink) Recent(limit int, user string) ([]AuditRecord, error) {
+	client := s3.New(baseSession)
+	var records []AuditRecord
+	for d := 0; d < auditLookbackDays && len(records) < limit; d++ {
+		day := time.Now().UTC().AddDate(0, 0, -d).Format("2006-01-02")
+		var keys []string
+		err := client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(auditBucket),
+			Prefix: aws.String(fmt.Sprintf("%sdt=%s/", auditPrefix, day)),
+		}, func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, o := range page.Contents {
+				keys = append(keys, aws.StringValue(o.Key))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, key := range keys {
+			if len(records) >= limit {
+				break
+			}
+			out, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String(auditBucket), Key: aws.String(key)})
+			if err != nil {
+				return nil, err
+			}
+			scanner := bufio.NewScanner(out.Body)
+			scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				var r AuditRecord
+				if json.Unmarshal(scanner.Bytes(), &r) == nil && (user == "" || r.User == user) {
+					records = append(records, r)
+				}
+			}
+			out.Body.Close()
+		}
+	}
+	return newestAuditRecords(records, limit), nil
+}
+
+// dynamoAuditSink writes records to a table with partition key "day" and sort key "id" (both strings)
+type dynamoAuditSink struct{}
+
+// Write puts the record item
+func (dynamoAuditSink) Write(record AuditRecord) error {
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return err
+	}
+	_, err = getDynamoClient().PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(auditTable),
+		Item:      item,
+	})
+	return err
+}
+
+// Recent queries the last days newest first
+func (dynamoAuditSink) Recent(limit int, user string) ([]AuditRecord, error) {
+	db := getDynamoClient()
+	var records []AuditRecord
+	for d := 0; d < auditLookbackDays && len(records) < limit; d++ {
+		input := &dynamodb.QueryInput{
+			TableName:                aws.String(auditTable),
+			KeyConditionExpression:   aws.String("#day = :day"),
+			ExpressionAttributeNames: map[string]*string{"#day": aws.String("day")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":day": {S: aws.String(time.Now().UTC().AddDate(0, 0, -d).Format("2006-01-02"))},
+			},
+			ScanIndexForward: aws.Bool(false),
+		}
+		if user != "" {
+			input.FilterExpression = aws.String("#user = :user")
+			input.ExpressionAttributeNames["#user"] = aws.String("user")
+			input.ExpressionAttributeValues[":user"] = &dynamodb.AttributeValue{S: aws.String(user)}
+		}
+
+		err := db.QueryPages(input, func(page *dynamodb.QueryOutput, last bool) bool {
+			var items []AuditRecord
+			if err := dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); err != nil {
+				slog.Warn("Failed to unmarshal audit records", "error", err)
+				return false
+			}
+			records = append(records, items...)
+			return len(records) < limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newestAuditRecords(records, limit), nil
+}
+
+// newestAuditRecords sorts records newest first and keeps the first limit
+func newestAuditRecords(records []AuditRecord, limit int) []AuditRecord {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].ID > records[j].ID })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// formatAuditRecords lists audit records for Slack or the terminal, one line each
+func formatAuditRecords(records []AuditRecord, loc *time.Location) string {
+	if len(records) == 0 {
+		return "No recent activity."
+	}
+
+	var sb strings.Builder
+	for _, r := range records {
+		when := r.Time
+		if t, err := time.Parse(time.RFC3339, r.Time); err == nil {
+			when = t.In(loc).Format("2006-01-02 15:04 MST")
+		}
+		request := r.Question
+		if request == "" {
+			request = r.GeneratedSQL
+		}
+		request = truncateText(request, 80)
+		line := fmt.Sprintf("%s %s %s %s %s", when, r.User, r.Kind, r.Outcome, strings.Join(strings.Fields(request), " "))
+		if r.Outcome == "success" {
+			line += fmt.Sprintf(" (%d rows, %s", r.Rows, formatBytes(r.DataScannedBytes))
+			if r.Target != "" {
+				line += ", " + r.Target
+			}
+			line += ")"
+		} else if r.Error != "" {
+			line += " — " + r.Error
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,180 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Bedrock model used for SQL generation and analysis (BEDROCK_MODEL_ID overrides)
+var bedrockModelID = envOrDefault("BEDROCK_MODEL_ID", "apac.anthropic.claude-3-sonnet-20240229-v1:0")
+
+// Bedrock tokens (input + output) used by this instance, read before and after a request for daily quotas.
+// A Lambda instance handles one request at a time; in server mode concurrent requests share the counter.
+var bedrockTokensUsed atomic.Int64
+
+// Input and output tokens used by this instance, kept apart for cost estimates (eval command)
+var (
+	bedrockInputTokensUsed  atomic.Int64
+	bedrockOutputTokensUsed atomic.Int64
+)
+
+// promptVersion identifies the prompt templates in audit records; bump it when the prompts change
+const promptVersion = "2026.10-1"
+
+// callBedrock calls the Bedrock service with a prompt; purpose (sql, template_match, analysis, ...) labels the metrics and span
+func callBedrock(ctx context.Context, purpose, prompt string) (string, error) {
+	body := map[string]interface{}{
+		"anthropic_version": "bedrock-2023-05-31",
+		"max_tokens":        1000,
+		"messages": []map[string]interface{}{
+			{
+				"role": "user",
+				"content": []map[string]string{
+					{
+						"type": "text",
+						"text": prompt,
+					},
+				},
+			},
+		},
+	}
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal Bedrock request: %w", err)
+	}
+
+	input := &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(bedrockModelID),
+		ContentType: awsString("application/json"),
+		Accept:      awsString("application/json"),
+		Body:        jsonBody,
+	}
+
+	ctx, span := startSpan(ctx, "bedrock.invoke",
+		attribute.String("bedrock.model", bedrockModelID),
+		attribute.String("bedrock.purpose", purpose),
+		attribute.String("aws.region", aws.StringValue(bedrockClient.Config.Region)))
+	defer span.End()
+
+	started := time.Now()
+	output, err := bedrockClient.InvokeModelWithContext(ctx, input)
+	latency := time.Since(started)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		putCount(ctx, "BedrockErrors", map[string]string{"Model": bedrockModelID, "Purpose": purpose})
+		return "", fmt.Errorf("InvokeModel failed: %w", err)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(output.Body, &parsed); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return "", fmt.Errorf("failed to parse Bedrock response: %w", err)
+	}
+
+	if usage, ok := parsed["usage"].(map[string]interface{}); ok {
+		in, _ := usage["input_tokens"].(float64)
+		out, _ := usage["output_tokens"].(float64)
+		bedrockTokensUsed.Add(int64(in + out))
+		bedrockInputTokensUsed.Add(int64(in))
+		bedrockOutputTokensUsed.Add(int64(out))
+		span.SetAttributes(attribute.Int64("bedrock.input_tokens", int64(in)), attribute.Int64("bedrock.output_tokens", int64(out)))
+		putMetrics(ctx, map[string]string{"Model": bedrockModelID, "Purpose": purpose},
+			metric{Name: "BedrockLatency", Unit: unitMilliseconds, Value: milliseconds(latency)},
+			metric{Name: "BedrockInputTokens", Unit: unitCount, Value: in},
+			metric{Name: "BedrockOutputTokens", Unit: unitCount, Value: out})
+	}
+
+	// Extract text from Claude's response structure (content[])
+	contentList, ok := parsed["content"].([]interface{})
+	if !ok || len(contentList) == 0 {
+		span.SetStatus(codes.Error, "invalid content structure")
+		return "", fmt.Errorf("invalid content structure in Bedrock response")
+	}
+
+	first, _ := contentList[0].(map[string]interface{})
+	text, ok := first["text"].(string)
+	if !ok {
+		span.SetStatus(codes.Error, "no text field")
+		return "", fmt.Errorf("no text field in Bedrock content")
+	}
+
+	return text, nil
+}
+
+// buildPrompt constructs a prompt for generating Athena SQL queries from user text.
+// Tables, columns and examples follow the schema dialect of each registered target.
+func buildPrompt(userText string, loc *time.Location) string {
+	var sb strings.Builder
+	sb.WriteString("Generate an Athena SQL query based on the following user request.\n\n")
+
+	sb.WriteString("### Table Information:\n")
+	var dialects []SchemaDialect
+	exampleTable := make(map[string]string)
+	for _, t := range wafTargets {
+		d := t.Dialect()
+		sb.WriteString(fmt.Sprintf("- Table: %s (%s, %s schema)\n", t.FullTableName(), t.Description, d.Label))
+		if _, ok := exampleTable[d.Name]; !ok {
+			exampleTable[d.Name] = t.FullTableName()
+			dialects = append(dialects, d)
+		}
+	}
+
+	for _, d := range dialects {
+		if len(dialects) > 1 {
+			sb.WriteString(fmt.Sprintf("\n### Main Columns (%s tables):\n", d.Label))
+		} else {
+			sb.WriteString("\n### Main Columns:\n")
+		}
+		sb.WriteString(d.ColumnsDescription)
+	}
+
+	sb.WriteString("\n### SQL Examples:\n\n")
+	for _, d := range dialects {
+		if len(dialects) > 1 {
+			sb.WriteString(fmt.Sprintf("-- %s tables\n\n", d.Label))
+		}
+		sb.WriteString(strings.ReplaceAll(d.Examples, "{{table}}", exampleTable[d.Name]))
+		sb.WriteString("\n")
+	}
+	if len(dialects) > 1 {
+		sb.WriteString("Only use the columns of the schema the queried table has.\n\n")
+	}
+
+	sb.WriteString(timeContextPrompt(userText, loc, time.Now()) + "\n")
+	sb.WriteString("### User Request: " + userText + "\n\n")
+	sb.WriteString("Please generate only the SQL query without any explanation.")
+	return sb.String()
+}
+
+// analyzeResults analyzes the results of an Athena query and provides a summary
+func analyzeResults(ctx context.Context, query string, results []*athena.Row, userText string) string {
+	if len(results) <= 1 { // Header only, or no data
+		return "No data found. Please try different search criteria."
+	}
+
+	ctx, span := startSpan(ctx, "analysis", attribute.Int("rows", len(results)-1))
+	defer span.End()
+
+	// Create analysis prompt
+	analysisPrompt := "[ANALYSIS PROMPT MASKED]"
+
+	// Call Bedrock for analysis; the results are still shown when it fails
+	analysisResult, err := callBedrock(ctx, "analysis", analysisPrompt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Analysis failed", "error", err)
+		return "Analysis is not available right now."
+	}
+	return analysisResult
+}
@@ -0,0 +1,199 @@
+package analyzer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Query result caching configuration
+var (
+	// Athena result reuse max age in minutes (0 disables)
+	athenaResultReuseMinutes = envInt("ATHENA_RESULT_REUSE_MINUTES", 0)
+	// DynamoDB table for the application query cache (partition key: cache_key), disabled when unset
+	queryCacheTable = os.Getenv("QUERY_CACHE_TABLE")
+	// How long cached rows are served
+	queryCacheTTL = time.Duration(envInt("QUERY_CACHE_TTL_MINUTES", 15)) * time.Minute
+)
+
+// cachedQueryResult is the DynamoDB item of the query cache
+type cachedQueryResult struct {
+	CacheKey  string   `dynamodbav:"cache_key"`
+	QueryID   string   `dynamodbav:"query_id"`
+	Region    string   `dynamodbav:"region"`
+	Rows      string   `dynamodbav:"rows"` // JSON encoded [][]*string
+	Types     []string `dynamodbav:"column_types"`
+	CreatedAt int64    `dynamodbav:"created_at"`
+	ExpiresAt int64    `dynamodbav:"expires_at"` // DynamoDB TTL attribute
+}
+
+// normalizeSQL collapses whitespace and lowercases everything outside string literals
+func normalizeSQL(query string) string {
+	var sb strings.Builder
+	inLiteral := false
+	lastSpace := false
+
+	for _, r := range strings.TrimSpace(query) {
+		if r == '\'' {
+			inLiteral = !inLiteral
+		}
+		if !inLiteral && (r == ' ' || r == '\n' || r == '\t' || r == '\r') {
+			if !lastSpace {
+				sb.WriteRune(' ')
+			}
+			lastSpace = true
+			continue
+		}
+		lastSpace = false
+		if inLiteral {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteString(strings.ToLower(string(r)))
+		}
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(sb.String()), ";"))
+}
+
+// queryCacheKey builds the cache key from the normalized SQL and every target the query reads (name, region, role,
+// account, table and workgroup), so targets that share SQL but not credentials never share results.
+// Queries on unregistered tables only run with the function's own credentials and are keyed by region.
+func queryCacheKey(query, region string) string {
+	parts := []string{normalizeSQL(query)}
+	targets, unregistered := queryTables(query)
+	for _, t := range targets {
+		parts = append(parts, strings.Join([]string{t.Name, t.Region, t.RoleARN, t.AccountID, t.FullTableName(), t.Workgroup}, "|"))
+	}
+	if len(targets) == 0 || len(unregistered) > 0 {
+		parts = append(parts, "region|"+region)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// getCachedQueryResult returns cached rows that are younger than the cache TTL
+func getCachedQueryResult(key string) (string, []*athena.Row, []string, time.Time, bool) {
+	if queryCacheTable == "" {
+		return "", nil, nil, time.Time{}, false
+	}
+
+	out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(queryCacheTable),
+		Key: map[string]*dynamodb.AttributeValue{
+			"cache_key": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		slog.Warn("Query cache lookup failed", "error", err)
+		return "", nil, nil, time.Time{}, false
+	}
+	if out.Item == nil {
+		return "", nil, nil, time.Time{}, false
+	}
+
+	var item cachedQueryResult
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &item); err != nil {
+		slog.Warn("Failed to decode cached query result", "error", err)
+		return "", nil, nil, time.Time{}, false
+	}
+
+	// DynamoDB TTL deletion is lazy, so check the age here as well
+	createdAt := time.Unix(item.CreatedAt, 0)
+	if time.Since(createdAt) > queryCacheTTL {
+		return "", nil, nil, time.Time{}, false
+	}
+
+	var values [][]*string
+	if err := json.Unmarshal([]byte(item.Rows), &values); err != nil {
+		slog.Warn("Failed to decode cached rows", "error", err)
+		return "", nil, nil, time.Time{}, false
+	}
+
+	rows := make([]*athena.Row, 0, len(values))
+	for _, v := range values {
+		row := &athena.Row{}
+		for _, cell := range v {
+			row.Data = append(row.Data, &athena.Datum{VarCharValue: cell})
+		}
+		rows = append(rows, row)
+	}
+	return item.QueryID, rows, item.Types, createdAt, true
+}
+
+// putCachedQueryResult stores the rows of a successful query
+func putCachedQueryResult(key, qid, region string, rows []*athena.Row, types []string) {
+	if queryCacheTable == "" {
+		return
+	}
+
+	values := make([][]*string, 0, len(rows))
+	for _, row := range rows {
+		var v []*string
+		for _, d := range row.Data {
+			v = append(v, d.VarCharValue)
+		}
+		values = append(values, v)
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		slog.Warn("Failed to encode rows for cache", "error", err)
+		return
+	}
+
+	now := time.Now()
+	item, err := dynamodbattribute.MarshalMap(cachedQueryResult{
+		CacheKey:  key,
+		QueryID:   qid,
+		Region:    region,
+		Rows:      string(encoded),
+		Types:     types,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(queryCacheTTL).Unix(),
+	})
+	if err != nil {
+		slog.Warn("Failed to encode cache item", "error", err)
+		return
+	}
+
+	if _, err := getDynamoClient().PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(queryCacheTable),
+		Item:      item,
+	}); err != nil {
+		slog.Warn("Failed to store query result in cache", "error", err)
+	}
+}
+
+// describeCacheStatus returns a short note on whether the result was cached and how old it is
+func describeCacheStatus(stats QueryStats) string {
+	switch {
+	case stats.Cached:
+		return fmt.Sprintf("cached result, %s old", formatAge(time.Since(stats.CachedAt)))
+	case stats.ReusedResult:
+		return "reused Athena result"
+	default:
+		return ""
+	}
+}
+
+// formatAge formats a duration as a short human readable age
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return strconv.Itoa(int(d.Seconds())) + "s"
+	case d < time.Hour:
+		return strconv.Itoa(int(d.Minutes())) + "m"
+	default:
+		return strconv.Itoa(int(d.Hours())) + "h"
+	}
+}
@@ -0,0 +1,348 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Clarification of ambiguous questions (CLARIFY_QUESTIONS): "rules" checks the question against the target registry
+// and known time and metric phrases, "bedrock" lets the model decide what is missing, "off" answers every question as asked
+var clarifyMode = strings.ToLower(envOrDefault("CLARIFY_QUESTIONS", "off"))
+
+// Parts of a question the pipeline otherwise has to guess
+const (
+	missingTarget    = "target"
+	missingTimeRange = "time_range"
+	missingMetric    = "metric"
+)
+
+// Select element answering each missing part
+var clarifySelects = map[string]string{missingTarget: "clarify_target", missingTimeRange: "clarify_window", missingMetric: "clarify_metric"}
+
+// Time range phrases that make a question specific enough (relative ranges are resolved by resolveRelativeRanges)
+var clarifyTimePattern = regexp.MustCompile(`(?i)\b(\d{4}-\d{1,2}-\d{1,2}|\d{1,2}/\d{1,2}|\d+\s*(m|h|d|w|mins?|minutes?|hours?|days?|weeks?|months?)|(last|past|this|previous)\s+(hour|day|night|week|month|year)|since|between|until|ago|today|yesterday|tonight|this morning|right now|currently|recent(ly)?|latest|january|february|march|april|may|june|july|august|september|october|november|december)\b`)
+
+// Words that say what to measure or list
+var clarifyMetricPattern = regexp.MustCompile(`(?i)\b(how many|count|counts|number of|total|top|most|least|list|trend|per|by (hour|day|ip|country|rule|uri|path|host)|rate|ratio|percent(age)?|ips?|addresses|rules?|countr(y|ies)|uris?|paths?|urls?|hosts?|user[- ]agents?|methods?|status|requests? from|requests? to|sqli|xss|bots?|block(ed|s)?|allow(ed|s)?)\b`)
+
+// Look-back windows offered when the time range is missing (phrases understood by resolveRelativeRanges)
+var clarifyTimeRanges = []string{"last 1 hour", "last 24 hours", "last 7 days", "last 30 days"}
+
+// ClarifyRequest is carried by the buttons of a clarification message
+type ClarifyRequest struct {
+	Question string   `json:"q"`
+	User     string   `json:"u"`
+	Missing  []string `json:"m"`
+	Thread   string   `json:"t,omitempty"` // Thread the answer is posted in
+}
+
+// intentResponse is the JSON object returned by the intent prompt
+type intentResponse struct {
+	Missing []string `json:"missing"`
+}
+
+// missingQuestionParts returns what the question leaves open (target, time range, metric)
+func missingQuestionParts(ctx context.Context, text string) []string {
+	ctx, span := startSpan(ctx, "intent", attribute.String("clarify.mode", clarifyMode))
+	defer span.End()
+
+	missing := missingPartsByRules(text)
+	if clarifyMode == "bedrock" {
+		prompt := buildPromptSpan(ctx, "intent", func() string { return buildIntentPrompt(text) })
+		response, err := callBedrock(ctx, "intent", prompt)
+		if err == nil {
+			var parsed []string
+			if parsed, err = parseIntentResponse(response); err == nil {
+				missing = parsed
+			}
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Intent analysis failed, using rules", "error", err)
+		}
+	}
+
+	// A single WAF (or a question about all of them) never needs a target choice
+	if len(wafTargets) < 2 || isFanOutQuestion(text) {
+		missing = removeString(missing, missingTarget)
+	}
+	span.SetAttributes(attribute.StringSlice("clarify.missing", missing))
+	return missing
+}
+
+// missingPartsByRules checks the question against the target registry and known time and metric phrases
+func missingPartsByRules(text string) []string {
+	var missing []string
+	if _, ok := targetForQuestion(text); !ok {
+		missing = append(missing, missingTarget)
+	}
+	if !clarifyTimePattern.MatchString(text) {
+		missing = append(missing, missingTimeRange)
+	}
+	if !clarifyMetricPattern.MatchString(text) {
+		missing = append(missing, missingMetric)
+	}
+	return missing
+}
+
+// buildIntentPrompt asks Bedrock which parts of the question are missing
+func buildIntentPrompt(userText string) string {
+	var sb strings.Builder
+	sb.WriteString("Decide whether the question below says enough to query WAF logs without guessing.\n\n")
+
+	sb.WriteString("### WAF Targets:\n")
+	for _, t := range wafTargets {
+		sb.WriteString(fmt.Sprintf("- %s: %s (%s)\n", t.Name, t.Description, t.Region))
+	}
+
+	sb.WriteString(`
+### Missing Parts:
+- target: the question does not say which WAF (a question about all WAFs names them all)
+- time_range: the question has no time period (e.g. last 24 hours, yesterday, since Monday)
+- metric: the question does not say what to count, rank or list (e.g. blocked requests, top IPs, rules)
+
+### User Request: ` + userText + `
+
+Respond with only a JSON object like {"missing": ["time_range"]}. Use {"missing": []} when the question can be answered as asked.`)
+
+	return sb.String()
+}
+
+// parseIntentResponse extracts the missing parts from Bedrock's response, ignoring unknown names
+func parseIntentResponse(response string) ([]string, error) {
+	start := strings.Index(response, "{")
+	end := strings.LastIndex(response, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object in response")
+	}
+	var parsed intentResponse
+	if err := json.Unmarshal([]byte(response[start:end+1]), &parsed); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, m := range parsed.Missing {
+		if m == missingTarget || m == missingTimeRange || m == missingMetric {
+			missing = append(missing, m)
+		}
+	}
+	return missing, nil
+}
+
+// removeString returns the list without the value
+func removeString(list []string, value string) []string {
+	var out []string
+	for _, v := range list {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// requestClarification replies in the thread of an ambiguous question with choices for what is missing.
+// It reports whether a clarification was posted; the question is answered as asked otherwise.
+// It is called once the user passed the access policy, before rate limits are checked.
+func requestClarification(ctx context.Context, grant AccessGrant, channel, user, text string) bool {
+	threadTS := threadFromContext(ctx)
+	if clarifyMode == "off" || threadTS == "" {
+		return false
+	}
+
+	missing := missingQuestionParts(ctx, text)
+	if len(missing) == 0 {
+		return false
+	}
+	b, _ := json.Marshal(ClarifyRequest{Question: text, User: user, Missing: missing, Thread: threadTS})
+	value := string(b)
+	if len(value) > 2000 {
+		// Slack limits button values; long questions are specific enough
+		return false
+	}
+
+	blocks := clarificationBlocks(text, missing, value, grant.allowsTarget)
+	if _, err := callSlackAPI("chat.postMessage", map[string]interface{}{
+		"channel":   channel,
+		"thread_ts": threadTS,
+		"text":      "I need a bit more detail to answer this question",
+		"blocks":    blocks,
+	}); err != nil {
+		slog.ErrorContext(ctx, "Failed to post clarification, answering as asked", "error", err)
+		return false
+	}
+	slog.InfoContext(ctx, "Asked for clarification", "missing", missing)
+	putCount(ctx, "ClarificationRequests", map[string]string{"Missing": strings.Join(missing, "+")})
+	return true
+}
+
+// clarificationBlocks builds the clarifying question with a select for each missing part
+func clarificationBlocks(text string, missing []string, value string, allowed func(WAFTarget) bool) []map[string]interface{} {
+	var asks []string
+	var elements []map[string]interface{}
+	for _, m := range missing {
+		switch m {
+		case missingTarget:
+			asks = append(asks, "which WAF")
+			var options []map[string]interface{}
+			for _, t := range wafTargets {
+				if allowed(t) && len(options) < 99 {
+					options = append(options, selectOption(fmt.Sprintf("%s (%s)", t.Name, t.Region), t.Name))
+				}
+			}
+			if len(fanOutKeywords) > 0 {
+				options = append(options, selectOption("All WAFs", fanOutKeywords[0]))
+			}
+			elements = append(elements, staticSelect(clarifySelects[missingTarget], "Choose a WAF", options))
+		case missingTimeRange:
+			asks = append(asks, "which time range")
+			var options []map[string]interface{}
+			for _, r := range clarifyTimeRanges {
+				options = append(options, selectOption(strings.ToUpper(r[:1])+r[1:], r))
+			}
+			elements = append(elements, staticSelect(clarifySelects[missingTimeRange], "Choose a time range", options))
+		case missingMetric:
+			asks = append(asks, "what to look at")
+			var options []map[string]interface{}
+			for _, t := range clarifyMetricTemplates() {
+				options = append(options, selectOption(t.Description, t.Name))
+			}
+			elements = append(elements, staticSelect(clarifySelects[missingMetric], "Choose what to show", options))
+		}
+	}
+	elements = append(elements,
+		slackButton("Answer", "clarify_submit", value, "primary"),
+		slackButton("Answer as asked", "clarify_skip", value, ""))
+
+	return []map[string]interface{}{
+		{
+			"type": "section",
+			"text": map[string]interface{}{
+				"type": "mrkdwn",
+				"text": fmt.Sprintf("To answer _%s_ I need to know %s.", text, joinWords(asks)),
+			},
+		},
+		{
+			"type":     "actions",
+			"block_id": "clarify",
+			"elements": elements,
+		},
+	}
+}
+
+// clarifyMetricTemplates returns the templates offered as metrics: those needing no parameter besides target, window and limit
+func clarifyMetricTemplates() []QueryTemplate {
+	var templates []QueryTemplate
+	for _, t := range queryTemplates {
+		ok := true
+		for _, p := range t.Params {
+			if p.Type != "target" && p.Type != "window" && p.Type != "limit" {
+				ok = false
+			}
+		}
+		if ok && len(templates) < 100 {
+			templates = append(templates, t)
+		}
+	}
+	return templates
+}
+
+// staticSelect builds a Block Kit static select element
+func staticSelect(actionID, placeholder string, options []map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "static_select",
+		"action_id":   actionID,
+		"placeholder": map[string]interface{}{"type": "plain_text", "text": placeholder},
+		"options":     options,
+	}
+}
+
+// selectOption builds an option of a static select (Slack limits the text to 75 characters)
+func selectOption(text, value string) map[string]interface{} {
+	text = truncateText(text, 75)
+	return map[string]interface{}{
+		"text":  map[string]interface{}{"type": "plain_text", "text": text},
+		"value": value,
+	}
+}
+
+// joinWords joins words as "a, b and c"
+func joinWords(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " and " + words[len(words)-1]
+}
+
+// clarifiedQuestion adds the user's choices to the original question
+func clarifiedQuestion(req ClarifyRequest, choices map[string]string) string {
+	var details []string
+	if target := choices["clarify_target"]; target != "" {
+		if _, ok := findTarget(target); ok {
+			details = append(details, fmt.Sprintf("on the %s WAF", target))
+		} else {
+			details = append(details, "across "+target)
+		}
+	}
+	if window := choices["clarify_window"]; window != "" {
+		details = append(details, "for the "+window)
+	}
+	if metric := choices["clarify_metric"]; metric != "" {
+		if t, ok := findQueryTemplate(metric); ok {
+			details = append(details, "showing "+strings.ToLower(t.Description[:1])+t.Description[1:])
+		}
+	}
+	if len(details) == 0 {
+		return req.Question
+	}
+	return fmt.Sprintf("%s (%s)", req.Question, strings.Join(details, ", "))
+}
+
+// handleClarifyAction continues the pipeline once the asker answers a clarification
+func handleClarifyAction(ctx context.Context, interaction SlackInteraction, actionID, value string) {
+	var req ClarifyRequest
+	if err := json.Unmarshal([]byte(value), &req); err != nil {
+		slog.WarnContext(ctx, "Invalid clarification value", "error", err)
+		return
+	}
+	if interaction.User.ID != req.User {
+		postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+			"response_type":    "ephemeral",
+			"replace_original": false,
+			"text":             fmt.Sprintf("Only <@%s> can answer this question. Mention me to ask your own.", req.User),
+		})
+		return
+	}
+
+	question := req.Question
+	if actionID == "clarify_submit" {
+		choices := interaction.selectedOptions("clarify")
+		var unanswered []string
+		for _, m := range req.Missing {
+			if choices[clarifySelects[m]] == "" {
+				unanswered = append(unanswered, strings.ReplaceAll(m, "_", " "))
+			}
+		}
+		if len(unanswered) > 0 {
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             fmt.Sprintf("Please choose the %s first, or use *Answer as asked*.", joinWords(unanswered)),
+			})
+			return
+		}
+		question = clarifiedQuestion(req, choices)
+	}
+
+	slog.InfoContext(ctx, "Clarification answered", "action", actionID, "question", question)
+	putCount(ctx, "ClarificationAnswers", map[string]string{"Action": strings.TrimPrefix(actionID, "clarify_")})
+	postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+		"replace_original": true,
+		"text":             fmt.Sprintf(":mag: Answering _%s_", question),
+	})
+	answerLater(ctx, DeferredAnswer{Channel: interaction.Channel.ID, User: req.User, Text: question, Kind: accessAsk,
+		Source: "button", Team: interaction.Team.ID, ThreadTS: req.Thread})
+}
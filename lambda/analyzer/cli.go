@@ -0,0 +1,167 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// RunCommand runs a subcommand of the handler binary when it is not started by the Lambda runtime.
+// It reports whether a command was handled and its exit code.
+// "serve" runs the HTTP server, "mcp" the MCP server, "audit" lists recent activity, "eval" runs the SQL quality suite
+// and "replay" replays a recorded fixture. The terminal CLI is a separate binary (cmd/wafask).
+func RunCommand(args []string) (bool, int) {
+	if len(args) < 2 {
+		return false, 0
+	}
+
+	switch args[1] {
+	case "serve":
+		return true, runServeCommand(args[2:])
+	case "mcp":
+		return true, runMCPCommand(args[2:])
+	case "audit":
+		return true, runAuditCommand(args[2:])
+	case "eval":
+		return true, runEvalCommand(args[2:])
+	case "replay":
+		return true, runReplayCommand(args[2:])
+	default:
+		return false, 0
+	}
+}
+
+// RunAskCommand answers a question (or runs raw SQL) from the terminal (the wafask CLI)
+func RunAskCommand(args []string) int {
+	fs := flag.NewFlagSet("wafask", flag.ContinueOnError)
+	rawSQL := fs.String("sql", "", "run this SQL instead of generating it from a question")
+	format := fs.String("format", "text", "table format: text, csv, json or markdown")
+	dryRun := fs.Bool("dry-run", false, "only print the generated SQL")
+	noAnalysis := fs.Bool("no-analysis", false, "skip the Bedrock analysis of the results")
+	verbose := fs.Bool("verbose", false, "print logs to stderr")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: wafask [flags] <question>\n       wafask [flags] -sql <query>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if !*verbose {
+		setLogOutput(io.Discard)
+	}
+
+	question := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if question == "" && *rawSQL == "" {
+		fs.Usage()
+		return 2
+	}
+
+	formatter, ok := map[string]func(rows []*athena.Row) string{
+		"text":     formatRowsText,
+		"csv":      formatRowsCSV,
+		"json":     formatRowsJSON,
+		"markdown": formatRowsMarkdown,
+	}[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	ctx, span := startRequestSpan(withAuditSource(context.Background(), "cli", ""), "cli")
+	defer span.End()
+
+	kind := accessAsk
+	if *rawSQL != "" {
+		kind = accessSQL
+	}
+	audit := newAuditRecord(ctx, "", localAuditUser(), kind, question)
+	audit.PromptVersion, audit.ModelID = promptVersion, bedrockModelID
+	defer func() { writeAudit(audit) }()
+
+	sql := *rawSQL
+	templateName := ""
+	if sql == "" {
+		var err error
+		if sql, templateName, err = generateSQL(ctx, question, defaultLocation); err != nil {
+			audit.Outcome, audit.Error = "error", err.Error()
+			fmt.Fprintf(os.Stderr, "SQL generation failed: %v\n", err)
+			return 1
+		}
+	}
+	audit.Outcome, audit.Template, audit.GeneratedSQL = "success", templateName, sql
+	audit.PreprocessedSQL = preprocessSqlQuery(sql)
+
+	fmt.Println("-- SQL")
+	if templateName != "" {
+		fmt.Printf("-- template: %s\n", templateName)
+	}
+	fmt.Println(strings.TrimSpace(sql))
+	if *dryRun {
+		return 0
+	}
+
+	qid, rows, errMsg, stats, fanOut := runQuestionQuery(ctx, question, sql, nil)
+	audit.setQueryResult(sql, qid, rows, errMsg, stats, fanOut)
+	if errMsg != "" {
+		fmt.Fprintf(os.Stderr, "Query failed (region: %s, query ID: %s): %s\n", stats.Region, qid, errMsg)
+		return 1
+	}
+
+	fmt.Printf("\n-- Result: %d rows (region: %s, query ID: %s", max(len(rows)-1, 0), stats.Region, qid)
+	if cacheStatus := describeCacheStatus(stats); cacheStatus != "" {
+		fmt.Printf(", %s", cacheStatus)
+	}
+	fmt.Println(")")
+	if fanOut != nil {
+		fmt.Print(formatFanOutSummary(fanOut))
+	}
+	rows = redactRows(rows, redactionFor(resultTargetNames(sql, stats, fanOut), ""))
+	fmt.Print(formatter(rows))
+
+	if !*noAnalysis {
+		fmt.Println("\n-- Analysis")
+		text := question
+		if text == "" {
+			text = sql
+		}
+		fmt.Println(analyzeResults(ctx, sql, rows, text))
+	}
+	return 0
+}
+
+// runAuditCommand prints recent audit records from the configured audit sink
+func runAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	limit := fs.Int("n", 20, "number of records")
+	user := fs.String("user", "", "only records of this Slack user ID or API caller")
+	asJSON := fs.Bool("json", false, "print the records as JSON lines")
+	verbose := fs.Bool("verbose", false, "print logs to stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbose {
+		setLogOutput(io.Discard)
+	}
+
+	records, err := auditSink.Recent(*limit, *user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list audit records: %v\n", err)
+		return 1
+	}
+	if !*asJSON {
+		fmt.Print(formatAuditRecords(records, defaultLocation))
+		return 0
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range records {
+		enc.Encode(r)
+	}
+	return 0
+}
@@ -0,0 +1,232 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// Logs Insights queries carry their target and time window in a header line, e.g.
+// "-- logs-insights target=edge window=24h", so they flow through the same pipeline as SQL.
+var logsInsightsHeaderPattern = regexp.MustCompile(`^--\s*logs-insights\s+target=(\S+)\s+window=(\S+)\s*\n`)
+
+// Default look-back window when Bedrock does not choose one
+var logsInsightsDefaultWindow = envOrDefault("LOGS_INSIGHTS_DEFAULT_WINDOW", "24h")
+
+// logsInsightsExecutor runs CloudWatch Logs Insights queries for targets configured with a log group
+type logsInsightsExecutor struct{}
+
+// Execute runs the Logs Insights query in the target's region and returns Athena-shaped rows
+func (logsInsightsExecutor) Execute(ctx context.Context, query string, region string) (string, []*athena.Row, string, QueryStats) {
+	stats := QueryStats{Region: region}
+
+	target, hours, body, errMsg := parseLogsInsightsQuery(query)
+	if errMsg != "" {
+		return "", nil, errMsg, stats
+	}
+	stats.Region = target.Region
+	client := cloudwatchlogs.New(getTargetSession(target.Region, target))
+	slog.InfoContext(ctx, "Executing Logs Insights query", "log_group", target.LogGroup, "region", target.Region, "window_hours", hours)
+
+	end := time.Now()
+	start := end.Add(-time.Duration(hours) * time.Hour)
+	out, err := client.StartQueryWithContext(ctx, &cloudwatchlogs.StartQueryInput{
+		LogGroupNames: aws.StringSlice(splitList(target.LogGroup)),
+		QueryString:   aws.String(body),
+		StartTime:     aws.Int64(start.Unix()),
+		EndTime:       aws.Int64(end.Unix()),
+		Limit:         aws.Int64(19),
+	})
+	if err != nil {
+		errMsg := fmt.Sprintf("Logs Insights start error: %v", err)
+		slog.ErrorContext(ctx, "Logs Insights start error", "error", err)
+		return "", nil, errMsg, stats
+	}
+	qid := aws.StringValue(out.QueryId)
+	slog.InfoContext(ctx, "Started Logs Insights query", "query_id", qid)
+
+	// Same timeout as Athena queries (45 seconds), polled every 2 seconds
+	queryTimeout := 45 * time.Second
+	queryContext, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	began := time.Now()
+	attempts := 0
+	for {
+		select {
+		case <-queryContext.Done():
+			slog.WarnContext(ctx, "Logs Insights query timed out, cancelling it", "query_id", qid, "timeout", queryTimeout.String())
+			if _, err := client.StopQuery(&cloudwatchlogs.StopQueryInput{QueryId: aws.String(qid)}); err != nil {
+				slog.WarnContext(ctx, "Failed to cancel query", "query_id", qid, "error", err)
+			}
+			return qid, nil, fmt.Sprintf("Query timed out (%.0f seconds elapsed). Execution aborted.", queryTimeout.Seconds()), stats
+
+		case <-ticker.C:
+			attempts++
+			res, err := client.GetQueryResultsWithContext(queryContext, &cloudwatchlogs.GetQueryResultsInput{QueryId: aws.String(qid)})
+			if err != nil {
+				if queryContext.Err() != nil {
+					continue
+				}
+				errMsg := fmt.Sprintf("Failed to get query status: %v", err)
+				slog.ErrorContext(ctx, "Failed to get query status", "query_id", qid, "error", err)
+				return qid, nil, errMsg, stats
+			}
+
+			status := aws.StringValue(res.Status)
+			slog.DebugContext(ctx, "Logs Insights query state", "query_id", qid, "state", status, "attempt", attempts)
+			switch status {
+			case cloudwatchlogs.QueryStatusComplete:
+				if res.Statistics != nil {
+					stats.DataScannedBytes = int64(aws.Float64Value(res.Statistics.BytesScanned))
+				}
+				stats.EngineExecutionMs = time.Since(began).Milliseconds()
+				return qid, logsInsightsRows(res.Results), "", stats
+			case cloudwatchlogs.QueryStatusFailed, cloudwatchlogs.QueryStatusCancelled, cloudwatchlogs.QueryStatusTimeout:
+				errMsg := fmt.Sprintf("Logs Insights query did not complete successfully. Final state: %s", status)
+				slog.ErrorContext(ctx, "Logs Insights query did not complete", "query_id", qid, "state", status, "sql", body)
+				return qid, nil, errMsg, stats
+			}
+		}
+	}
+}
+
+// isLogsInsightsQuery reports whether a query is a Logs Insights query (has the header line)
+func isLogsInsightsQuery(query string) bool {
+	return logsInsightsHeaderPattern.MatchString(strings.TrimSpace(query) + "\n")
+}
+
+// parseLogsInsightsQuery splits the header from the query and resolves the target and window
+func parseLogsInsightsQuery(query string) (WAFTarget, int, string, string) {
+	query = strings.TrimSpace(query) + "\n"
+	m := logsInsightsHeaderPattern.FindStringSubmatch(query)
+	if m == nil {
+		return WAFTarget{}, 0, "", "Missing logs-insights header"
+	}
+
+	target, ok := findTarget(m[1])
+	if !ok || target.LogGroup == "" {
+		return WAFTarget{}, 0, "", fmt.Sprintf("Target %q has no CloudWatch log group", m[1])
+	}
+	hours, err := parseWindowHours(m[2])
+	if err != nil {
+		return WAFTarget{}, 0, "", err.Error()
+	}
+
+	body := strings.TrimSpace(query[len(m[0]):])
+	if body == "" {
+		return WAFTarget{}, 0, "", "Empty Logs Insights query"
+	}
+	return target, hours, body, ""
+}
+
+// logsInsightsRows converts Logs Insights results to Athena rows (header first), dropping @ptr
+func logsInsightsRows(results [][]*cloudwatchlogs.ResultField) []*athena.Row {
+	var fields []string
+	index := make(map[string]int)
+	for _, result := range results {
+		for _, f := range result {
+			name := aws.StringValue(f.Field)
+			if name == "@ptr" {
+				continue
+			}
+			if _, ok := index[name]; !ok {
+				index[name] = len(fields)
+				fields = append(fields, name)
+			}
+		}
+	}
+
+	header := &athena.Row{}
+	for _, name := range fields {
+		header.Data = append(header.Data, &athena.Datum{VarCharValue: aws.String(name)})
+	}
+	rows := []*athena.Row{header}
+
+	for _, result := range results {
+		row := &athena.Row{Data: make([]*athena.Datum, len(fields))}
+		for i := range row.Data {
+			row.Data[i] = &athena.Datum{}
+		}
+		for _, f := range result {
+			if i, ok := index[aws.StringValue(f.Field)]; ok {
+				row.Data[i].VarCharValue = f.Value
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// buildLogsInsightsPrompt asks Bedrock for a Logs Insights query over a WAF log group
+func buildLogsInsightsPrompt(userText string, target WAFTarget, loc *time.Location) string {
+	return `Generate a CloudWatch Logs Insights query based on the following user request.
+
+### Log Group:
+- ` + target.LogGroup + ` (` + target.Description + `, AWS WAF logs in JSON)
+
+### Main Fields:
+- @timestamp - Event time
+- action - WAF action (ALLOW, BLOCK, COUNT, CAPTCHA, CHALLENGE)
+- terminatingRuleId - Rule that terminated the request
+- httpRequest.clientIp - Source IP address
+- httpRequest.country - Source country
+- httpRequest.uri - Request path
+- httpRequest.httpMethod - HTTP method
+- webaclId - Web ACL ARN
+
+### Examples:
+
+# Top blocked source IPs
+filter action = "BLOCK"
+| stats count(*) as block_count by httpRequest.clientIp
+| sort block_count desc
+| limit 10
+
+# Requests by action per hour
+stats count(*) as request_count by action, bin(1h)
+
+` + timeContextPrompt(userText, loc, time.Now()) + `
+### User Request: ` + userText + `
+
+Respond with only a JSON object like {"query": "<Logs Insights query>", "window": "24h"}.
+The window is the time range to search (such as 1h, 24h, 3d, 1w); the query itself must not filter on time.`
+}
+
+// generateLogsInsightsQuery turns a question into a Logs Insights query with its header line
+func generateLogsInsightsQuery(ctx context.Context, userText string, target WAFTarget, loc *time.Location) (string, error) {
+	prompt := buildPromptSpan(ctx, "logs_insights", func() string { return buildLogsInsightsPrompt(userText, target, loc) })
+	response, err := callBedrock(ctx, "logs_insights", prompt)
+	if err != nil {
+		return "", err
+	}
+
+	var generated struct {
+		Query  string `json:"query"`
+		Window string `json:"window"`
+	}
+	start := strings.Index(response, "{")
+	end := strings.LastIndex(response, "}")
+	if start < 0 || end < start || json.Unmarshal([]byte(response[start:end+1]), &generated) != nil || generated.Query == "" {
+		slog.WarnContext(ctx, "Logs Insights response was not JSON, using it as the query")
+		generated.Query = strings.TrimSpace(response)
+	}
+
+	window := logsInsightsDefaultWindow
+	if hours, err := parseWindowHours(generated.Window); err == nil {
+		window = strconv.Itoa(hours) + "h"
+	}
+	return fmt.Sprintf("-- logs-insights target=%s window=%s\n%s", target.Name, window, strings.TrimSpace(generated.Query)), nil
+}
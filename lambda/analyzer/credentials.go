@@ -0,0 +1,77 @@
+package analyzer
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Sessions per region and assumed role. Assumed-role credentials are cached by the session
+// and refreshed shortly before they expire, so the role is not assumed for every query.
+var (
+	baseSession     = instrumentSession(session.Must(session.NewSession()))
+	targetSessions  = make(map[string]*session.Session)
+	targetSessionMu sync.Mutex
+)
+
+// resolveQueryTarget finds the region and target of an existing query from a target name or a region
+func resolveQueryTarget(targetName, region string) (string, WAFTarget, string) {
+	if targetName != "" {
+		target, ok := findTarget(targetName)
+		if !ok {
+			return "", WAFTarget{}, "unknown target"
+		}
+		return target.Region, target, ""
+	}
+
+	if region == "" {
+		region = "ap-northeast-1"
+	}
+	if !isTargetRegion(region) {
+		return "", WAFTarget{}, "region is not used by any registered target"
+	}
+	return region, WAFTarget{}, ""
+}
+
+// getTargetSession returns a session for the region, assuming the target's role when one is configured
+func getTargetSession(region string, target WAFTarget) *session.Session {
+	key := region + "|" + target.RoleARN + "|" + target.ExternalID
+
+	targetSessionMu.Lock()
+	defer targetSessionMu.Unlock()
+	if sess, ok := targetSessions[key]; ok {
+		return sess
+	}
+
+	config := &aws.Config{Region: aws.String(region)}
+	if target.RoleARN != "" {
+		slog.Info("Assuming role", "role_arn", target.RoleARN, "target", target.Name, "region", region)
+		config.Credentials = stscreds.NewCredentials(baseSession, target.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "waf-log-analyzer"
+			p.ExpiryWindow = 5 * time.Minute
+			if target.ExternalID != "" {
+				p.ExternalID = aws.String(target.ExternalID)
+			}
+		})
+	}
+
+	sess := baseSession.Copy(config)
+	targetSessions[key] = sess
+	return sess
+}
+
+// getGlueClient creates a Glue client for the region (with the target's role when configured)
+func getGlueClient(region string, target WAFTarget) *glue.Glue {
+	return glue.New(getTargetSession(region, target))
+}
+
+// getS3Client creates an S3 client for the region (with the target's role when configured)
+func getS3Client(region string, target WAFTarget) *s3.S3 {
+	return s3.New(getTargetSession(region, target))
+}
@@ -0,0 +1,60 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	lambdasvc "github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// DeferredAnswer is a Slack request (slash command, button) answered after Slack's 3-second acknowledgement window
+type DeferredAnswer struct {
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	Kind     string `json:"kind"`   // ask, sql or export
+	Source   string `json:"source"` // audit source: slash, button
+	Team     string `json:"team,omitempty"`
+	ThreadTS string `json:"thread_ts,omitempty"` // Thread the answer is posted in
+}
+
+// Answers running in goroutines (server mode), waited for by replays
+var deferredAnswers sync.WaitGroup
+
+// answerLater answers a request after the caller has acknowledged Slack. In Lambda the function invokes itself
+// asynchronously with {"task":"answer"} (the instance is frozen once the response is returned); elsewhere the
+// answer runs in a goroutine. When the invocation fails, the request is answered right away.
+func answerLater(ctx context.Context, answer DeferredAnswer) {
+	lc, ok := lambdacontext.FromContext(ctx)
+	if !ok {
+		deferredAnswers.Add(1)
+		go func() {
+			defer deferredAnswers.Done()
+			runDeferredAnswer(context.WithoutCancel(ctx), answer)
+		}()
+		return
+	}
+
+	payload, _ := json.Marshal(ScheduledEvent{Task: "answer", Answer: &answer})
+	_, err := lambdasvc.New(baseSession).InvokeWithContext(ctx, &lambdasvc.InvokeInput{
+		FunctionName:   aws.String(lc.InvokedFunctionArn),
+		InvocationType: aws.String(lambdasvc.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to invoke the handler asynchronously, answering now", "error", err)
+		runDeferredAnswer(ctx, answer)
+	}
+}
+
+// runDeferredAnswer answers a deferred request like the original Slack request would have
+func runDeferredAnswer(ctx context.Context, answer DeferredAnswer) {
+	ctx = withAuditSource(ctx, answer.Source, answer.Team)
+	ctx = withLogAttrs(ctx, "user", answer.User, "channel", answer.Channel)
+	ctx = withThread(ctx, answer.ThreadTS)
+	answerRequest(ctx, answer.Channel, answer.User, answer.Text, answer.Kind)
+}
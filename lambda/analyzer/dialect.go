@@ -0,0 +1,417 @@
+package analyzer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SchemaDialect describes the log schema of a WAF table.
+// Columns maps logical column names to SQL expressions; they are available as
+// {{time}}, {{source_ip}}, {{action}}, {{rule}}, {{host}}, {{path}} and {{country}}
+// in query templates, digest queries and anomaly dimensions.
+type SchemaDialect struct {
+	Name               string
+	Label              string // Shown next to the table in the prompt
+	ColumnsDescription string // Main columns listed in the prompt and describe_waf_tables
+	Examples           string // SQL examples for the prompt ({{table}} is replaced with the target table)
+	Columns            map[string]string
+	AccountColumn      string // Empty when the schema has no account column
+	// Column references that belong to other dialects, with the hint shown when a query uses them
+	ForeignColumns map[string]string
+}
+
+// ocsfDialect is the Security Lake OCSF schema (the default)
+var ocsfDialect = SchemaDialect{
+	Name:  "ocsf",
+	Label: "Security Lake OCSF",
+	ColumnsDescription: `- time_dt (timestamp) - Event timestamp
+- accountid (string) - AWS Account ID
+- metadata.product.feature.uid (string) - WAF identifier
+- http_request.url.hostname (string) - Request hostname
+- src_endpoint.ip (string) - Source IP address
+- unmapped['action'] - WAF action (ALLOW, BLOCK, COUNT)
+`,
+	Examples: `-- Example 1: Count requests by action type
+SELECT
+    unmapped['action'] AS action_type,
+    COUNT(*) AS request_count
+FROM {{table}}
+WHERE
+    accountid = 'xxxxxxxxxxxxxx'
+    AND time_dt >= current_date - INTERVAL '1' DAY
+    AND src_endpoint.ip NOT IN ('xx.xx.xx.xx', 'xx.xx.xx.xx')
+GROUP BY unmapped['action']
+ORDER BY request_count DESC
+LIMIT 5;
+
+-- Example 2: Top source IPs
+SELECT
+    src_endpoint.ip AS source_ip,
+    COUNT(*) AS request_count
+FROM {{table}}
+WHERE
+    accountid = 'xxxxxxxxxxxxxx'
+    AND time_dt >= current_date - INTERVAL '1' DAY
+    AND src_endpoint.ip NOT IN ('xx.xx.xx.xx', 'xx.xx.xx.xx')
+GROUP BY src_endpoint.ip
+ORDER BY request_count DESC
+LIMIT 5;
+
+-- Example 3: Blocked requests analysis
+SELECT
+    http_request.url.hostname AS hostname,
+    COUNT(*) AS block_count
+FROM {{table}}
+WHERE
+    accountid = 'xxxxxxxxxxxxxx'
+    AND unmapped['action'] = 'BLOCK'
+    AND time_dt >= current_date - INTERVAL '1' DAY
+    AND src_endpoint.ip NOT IN ('xx.xx.xx.xx', 'xx.xx.xx.xx')
+GROUP BY http_request.url.hostname
+ORDER BY block_count DESC
+LIMIT 5;
+`,
+	Columns: map[string]string{
+		"time":      "time_dt",
+		"source_ip": "src_endpoint.ip",
+		"action":    "unmapped['action']",
+		"rule":      "firewall_rule.uid",
+		"host":      "http_request.url.hostname",
+		"path":      "http_request.url.path",
+		"country":   "src_endpoint.location.country",
+	},
+	AccountColumn: "accountid",
+	ForeignColumns: map[string]string{
+		"httprequest.":      "use src_endpoint.ip, http_request.url.* instead of httprequest.*",
+		"terminatingruleid": "use firewall_rule.uid instead of terminatingruleid",
+	},
+}
+
+// wafLogDialect is the native AWS WAF log schema delivered to S3 (Glue table, usually with partition projection)
+var wafLogDialect = SchemaDialect{
+	Name:  "waf",
+	Label: "native AWS WAF logs",
+	ColumnsDescription: `- "timestamp" (bigint) - Event time in epoch milliseconds; filter with from_unixtime("timestamp" / 1000)
+- webaclid (string) - Web ACL ARN (contains the account ID)
+- action (string) - WAF action (ALLOW, BLOCK, COUNT, CAPTCHA, CHALLENGE)
+- terminatingruleid (string) - Rule that terminated the request
+- rulegrouplist (array) - Rule groups evaluated, with terminatingrule and excluded rules
+- httprequest.clientip (string) - Source IP address
+- httprequest.country (string) - Source country
+- httprequest.uri (string) - Request path
+- httprequest.httpmethod (string) - HTTP method
+- httprequest.headers (array of name/value) - Request headers; the host is element_at(filter(httprequest.headers, h -> lower(h.name) = 'host'), 1).value
+`,
+	Examples: `-- Example 1: Count requests by action type
+SELECT
+    action AS action_type,
+    COUNT(*) AS request_count
+FROM {{table}}
+WHERE
+    from_unixtime("timestamp" / 1000) >= current_date - INTERVAL '1' DAY
+GROUP BY action
+ORDER BY request_count DESC
+LIMIT 5;
+
+-- Example 2: Top blocked source IPs and the rule that blocked them
+SELECT
+    httprequest.clientip AS source_ip,
+    terminatingruleid AS rule_id,
+    COUNT(*) AS block_count
+FROM {{table}}
+WHERE
+    action = 'BLOCK'
+    AND from_unixtime("timestamp" / 1000) >= current_date - INTERVAL '1' DAY
+GROUP BY httprequest.clientip, terminatingruleid
+ORDER BY block_count DESC
+LIMIT 5;
+`,
+	Columns: map[string]string{
+		"time":      `from_unixtime("timestamp" / 1000)`,
+		"source_ip": "httprequest.clientip",
+		"action":    "action",
+		"rule":      "terminatingruleid",
+		"host":      "element_at(filter(httprequest.headers, h -> lower(h.name) = 'host'), 1).value",
+		"path":      "httprequest.uri",
+		"country":   "httprequest.country",
+	},
+	ForeignColumns: map[string]string{
+		"src_endpoint.":  "use httprequest.clientip / httprequest.country instead of src_endpoint.*",
+		"unmapped[":      "use action instead of unmapped['action']",
+		"http_request.":  "use httprequest.uri / httprequest.headers instead of http_request.*",
+		"firewall_rule.": "use terminatingruleid instead of firewall_rule.uid",
+		"time_dt":        `use from_unixtime("timestamp" / 1000) instead of time_dt`,
+	},
+}
+
+// schemaDialects are the supported dialects by name
+var schemaDialects = map[string]SchemaDialect{
+	ocsfDialect.Name:   ocsfDialect,
+	wafLogDialect.Name: wafLogDialect,
+}
+
+// Dialect returns the schema dialect of the target (OCSF unless "schema" is "waf")
+func (t WAFTarget) Dialect() SchemaDialect {
+	if d, ok := schemaDialects[strings.ToLower(t.Schema)]; ok {
+		return d
+	}
+	return ocsfDialect
+}
+
+// dialectPlaceholders returns the column placeholders and {{account_filter}} for a target
+func dialectPlaceholders(target WAFTarget) map[string]string {
+	d := target.Dialect()
+	values := make(map[string]string, len(d.Columns)+1)
+	for name, expr := range d.Columns {
+		values[name] = expr
+	}
+
+	values["account_filter"] = ""
+	if target.AccountID != "" && d.AccountColumn != "" {
+		values["account_filter"] = fmt.Sprintf("\n    AND %s = '%s'", d.AccountColumn, target.AccountID)
+	}
+	return values
+}
+
+// targetForQuery returns the first registered target whose table the query references
+func targetForQuery(query string) (WAFTarget, bool) {
+	targets, _ := queryTables(query)
+	if len(targets) == 0 {
+		return WAFTarget{}, false
+	}
+	return targets[0], true
+}
+
+// queryTables returns the registered targets whose tables a query reads and the table references that are not
+// registered targets. Targets sharing a table are narrowed by the account IDs the query filters on.
+func queryTables(query string) ([]WAFTarget, []string) {
+	var targets []WAFTarget
+	var unregistered []string
+	seen := map[string]bool{}
+	for _, ref := range tableReferences(query) {
+		matches := targetsForTable(ref)
+		if len(matches) == 0 {
+			if !seen[strings.ToLower(ref)] {
+				seen[strings.ToLower(ref)] = true
+				unregistered = append(unregistered, ref)
+			}
+			continue
+		}
+		if len(matches) > 1 {
+			var filtered []WAFTarget
+			for _, t := range matches {
+				if t.AccountID != "" && strings.Contains(query, "'"+t.AccountID+"'") {
+					filtered = append(filtered, t)
+				}
+			}
+			if len(filtered) > 0 {
+				matches = filtered
+			}
+		}
+		for _, t := range matches {
+			if !seen["target:"+t.Name] {
+				seen["target:"+t.Name] = true
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, unregistered
+}
+
+// targetsForTable returns the registered targets of a table reference (optionally qualified with the database)
+func targetsForTable(ref string) []WAFTarget {
+	parts := strings.Split(strings.ToLower(ref), ".")
+	table, database := parts[len(parts)-1], ""
+	if len(parts) > 1 {
+		database = parts[len(parts)-2]
+	}
+
+	var targets []WAFTarget
+	for _, t := range wafTargets {
+		if t.Table == "" || !strings.EqualFold(t.Table, table) {
+			continue
+		}
+		if database != "" && !strings.EqualFold(t.Database, database) {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// sqlToken is a word (keyword or identifier, quotes removed, qualified names joined) or a punctuation character
+type sqlToken struct {
+	text string
+	word bool
+}
+
+// SQL keywords that can precede "(" without making it a function call
+var sqlKeywords = map[string]bool{
+	"select": true, "from": true, "where": true, "join": true, "on": true, "in": true, "as": true, "and": true,
+	"or": true, "not": true, "exists": true, "union": true, "all": true, "with": true, "lateral": true,
+	"intersect": true, "except": true, "any": true, "some": true, "having": true, "when": true, "then": true,
+	"else": true, "inner": true, "left": true, "right": true, "full": true, "outer": true, "cross": true,
+	"group": true, "order": true, "by": true, "limit": true, "using": true, "natural": true, "distinct": true,
+	"case": true, "end": true, "is": true, "like": true, "between": true, "values": true, "offset": true,
+}
+
+// tokenizeSQL splits a query into words and punctuation, skipping string literals and comments
+func tokenizeSQL(query string) []sqlToken {
+	var tokens []sqlToken
+	isWordByte := func(c byte) bool {
+		return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(query)
+			}
+		case c == '\'':
+			// String literal ('' escapes a quote)
+			i++
+			for i < len(query) {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			i++
+		case c == '"' || c == '`' || isWordByte(c):
+			// Identifier, possibly quoted and qualified (db.table, "db"."table")
+			var word strings.Builder
+			for i < len(query) {
+				if q := query[i]; q == '"' || q == '`' {
+					end := strings.IndexByte(query[i+1:], q)
+					if end < 0 {
+						end = len(query) - i - 1
+					}
+					word.WriteString(query[i+1 : i+1+end])
+					i += end + 2
+				} else {
+					start := i
+					for i < len(query) && isWordByte(query[i]) {
+						i++
+					}
+					if i == start {
+						break
+					}
+					word.WriteString(query[start:i])
+				}
+				if i+1 < len(query) && query[i] == '.' && (query[i+1] == '"' || query[i+1] == '`' || isWordByte(query[i+1])) {
+					word.WriteByte('.')
+					i++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, sqlToken{text: word.String(), word: true})
+		default:
+			tokens = append(tokens, sqlToken{text: string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+// tableReferences returns the tables a query reads: names after FROM and JOIN (including comma separated
+// FROM lists), outside of function calls such as EXTRACT(... FROM ...) and excluding WITH query names
+func tableReferences(query string) []string {
+	tokens := tokenizeSQL(query)
+	isWord := func(i int, text string) bool {
+		return i >= 0 && i < len(tokens) && tokens[i].word && strings.EqualFold(tokens[i].text, text)
+	}
+
+	withNames := map[string]bool{}
+	var refs []string
+	var calls []bool // for each open parenthesis, whether it belongs to a function call
+	for i, tok := range tokens {
+		switch {
+		case tok.text == "(":
+			calls = append(calls, i > 0 && tokens[i-1].word && !sqlKeywords[strings.ToLower(tokens[i-1].text)])
+		case tok.text == ")":
+			if len(calls) > 0 {
+				calls = calls[:len(calls)-1]
+			}
+		case isWord(i, "as") && i > 0 && tokens[i-1].word && i+1 < len(tokens) && tokens[i+1].text == "(":
+			withNames[strings.ToLower(tokens[i-1].text)] = true
+		case (isWord(i, "from") || isWord(i, "join")) && (len(calls) == 0 || !calls[len(calls)-1]):
+			for j := i + 1; j < len(tokens); {
+				// Subqueries and table functions (UNNEST) are not tables
+				if !tokens[j].word || sqlKeywords[strings.ToLower(tokens[j].text)] ||
+					j+1 < len(tokens) && tokens[j+1].text == "(" {
+					break
+				}
+				refs = append(refs, tokens[j].text)
+				j++
+				if isWord(j, "as") {
+					j++
+				}
+				if j < len(tokens) && tokens[j].word && !sqlKeywords[strings.ToLower(tokens[j].text)] {
+					j++
+				}
+				if !isWord(i, "from") || j >= len(tokens) || tokens[j].text != "," {
+					break
+				}
+				j++
+			}
+		}
+	}
+
+	var tables []string
+	for _, ref := range refs {
+		if !strings.Contains(ref, ".") && withNames[strings.ToLower(ref)] {
+			continue
+		}
+		tables = append(tables, ref)
+	}
+	return tables
+}
+
+// validateDialect rejects queries that use columns of another schema than the referenced tables have
+func validateDialect(query string) string {
+	targets, _ := queryTables(query)
+	lower := strings.ToLower(query)
+	for _, target := range targets {
+		d := target.Dialect()
+		for column, hint := range d.ForeignColumns {
+			if strings.Contains(lower, column) {
+				return fmt.Sprintf("Table %s uses the %s schema: %s", target.FullTableName(), d.Label, hint)
+			}
+		}
+	}
+	return ""
+}
+
+// Epoch milliseconds as stored in the "timestamp" column of native WAF logs
+var epochMillisPattern = regexp.MustCompile(`^1\d{12}$`)
+
+// formatCellValue renders timestamps in the display timezone (UTC timestamps and epoch milliseconds of native WAF logs)
+func formatCellValue(column, value string, loc *time.Location) string {
+	if !strings.Contains(strings.ToLower(column), "timestamp") || !epochMillisPattern.MatchString(value) {
+		return toLocalTimestamp(value, loc)
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return value
+	}
+	return time.UnixMilli(ms).In(loc).Format("2006-01-02 15:04:05 MST")
+}
@@ -0,0 +1,384 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// DigestQuery is a named query run for every target in a digest report.
+// The SQL must return two columns (key, value) and may use the placeholders
+// {{table}}, {{start}}, {{end}}, {{account_filter}} and the column placeholders of the
+// target's schema dialect ({{time}}, {{source_ip}}, {{action}} ...).
+type DigestQuery struct {
+	Name  string `json:"name"`
+	Title string `json:"title"`
+	SQL   string `json:"sql"`
+	// NewKeys reports keys that appear in the current period but not in the previous one
+	NewKeys bool `json:"new_keys"`
+}
+
+// digestQueries are the available digest queries: the built-in ones and those of DIGEST_CUSTOM_QUERIES
+// (DIGEST_QUERIES selects a subset by name)
+var digestQueries = loadDigestQueries(defaultDigestQueries)
+
+// defaultDigestQueries are the built-in digest queries
+var defaultDigestQueries = []DigestQuery{
+	{
+		Name:  "top_blocked_ips",
+		Title: "Top blocked IPs",
+		SQL: `SELECT {{source_ip}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'
+    AND {{action}} = 'BLOCK'{{account_filter}}
+GROUP BY {{source_ip}}
+ORDER BY value DESC
+LIMIT 10`,
+	},
+	{
+		Name:  "top_rules",
+		Title: "Top triggered rules",
+		SQL: `SELECT {{rule}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'
+    AND {{action}} IN ('BLOCK', 'COUNT'){{account_filter}}
+GROUP BY {{rule}}
+ORDER BY value DESC
+LIMIT 10`,
+	},
+	{
+		Name:  "block_rate_by_host",
+		Title: "Block rate by host (%)",
+		SQL: `SELECT {{host}} AS key,
+    ROUND(100.0 * SUM(CASE WHEN {{action}} = 'BLOCK' THEN 1 ELSE 0 END) / COUNT(*), 2) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'{{account_filter}}
+GROUP BY {{host}}
+ORDER BY COUNT(*) DESC
+LIMIT 10`,
+	},
+	{
+		Name:    "new_countries",
+		Title:   "New source countries",
+		NewKeys: true,
+		SQL: `SELECT {{country}} AS key, COUNT(*) AS value
+FROM {{table}}
+WHERE {{time}} >= TIMESTAMP '{{start}}' AND {{time}} < TIMESTAMP '{{end}}'
+    AND {{country}} IS NOT NULL{{account_filter}}
+GROUP BY {{country}}
+ORDER BY value DESC
+LIMIT 19`,
+	},
+}
+
+// loadDigestQueries adds the queries of DIGEST_CUSTOM_QUERIES_FILE or DIGEST_CUSTOM_QUERIES (JSON array) to the
+// built-in ones; a custom query replaces a built-in query of the same name
+func loadDigestQueries(builtin []DigestQuery) []DigestQuery {
+	config := os.Getenv("DIGEST_CUSTOM_QUERIES")
+	if path := os.Getenv("DIGEST_CUSTOM_QUERIES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Failed to read DIGEST_CUSTOM_QUERIES_FILE, using built-in digest queries", "error", err)
+			return builtin
+		}
+		config = string(data)
+	}
+	if config == "" {
+		return builtin
+	}
+
+	var custom []DigestQuery
+	if err := json.Unmarshal([]byte(config), &custom); err != nil {
+		slog.Error("Failed to parse custom digest queries, using built-in digest queries", "error", err)
+		return builtin
+	}
+
+	queries := append([]DigestQuery(nil), builtin...)
+	for _, q := range custom {
+		if q.Name == "" || strings.TrimSpace(q.SQL) == "" {
+			slog.Warn("Skipping custom digest query without a name or SQL", "name", q.Name)
+			continue
+		}
+		if q.Title == "" {
+			q.Title = q.Name
+		}
+		replaced := false
+		for i := range queries {
+			if queries[i].Name == q.Name {
+				queries[i], replaced = q, true
+			}
+		}
+		if !replaced {
+			queries = append(queries, q)
+		}
+	}
+	slog.Info("Loaded custom digest queries", "queries", len(custom))
+	return queries
+}
+
+// digestChannels are the Slack channels receiving scheduled digests (comma separated)
+var digestChannels = splitList(os.Getenv("DIGEST_CHANNELS"))
+
+// keyValue is one row of a digest query result
+type keyValue struct {
+	Key   string
+	Value float64
+}
+
+// digestResult holds the current and previous period results of one query for one target
+type digestResult struct {
+	Target   WAFTarget
+	Query    DigestQuery
+	Current  []keyValue
+	Previous []keyValue
+	Err      string
+}
+
+// digestPeriod returns the length of a digest period ("daily" or "weekly")
+func digestPeriod(period string) time.Duration {
+	if period == "weekly" {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// selectedDigestQueries returns the digest queries enabled by DIGEST_QUERIES (all when unset)
+func selectedDigestQueries() []DigestQuery {
+	names := splitList(os.Getenv("DIGEST_QUERIES"))
+	if len(names) == 0 {
+		return digestQueries
+	}
+
+	var selected []DigestQuery
+	for _, q := range digestQueries {
+		for _, n := range names {
+			if q.Name == n {
+				selected = append(selected, q)
+			}
+		}
+	}
+	return selected
+}
+
+// renderDigestSQL fills the placeholders of a digest query for a target and time window
+func renderDigestSQL(q DigestQuery, target WAFTarget, start, end time.Time) string {
+	pairs := []string{
+		"{{table}}", target.FullTableName(),
+		"{{start}}", start.UTC().Format("2006-01-02 15:04:05"),
+		"{{end}}", end.UTC().Format("2006-01-02 15:04:05"),
+	}
+	for name, value := range dialectPlaceholders(target) {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(q.SQL)
+}
+
+// Trailing LIMIT of a digest query, dropped when it is run for given keys
+var digestLimitClause = regexp.MustCompile(`(?i)\s+LIMIT\s+\d+\s*;?\s*$`)
+
+// keyedDigestSQL restricts a rendered digest query to the given keys instead of its top rows
+func keyedDigestSQL(sql string, keys []string) string {
+	var values []string
+	hasNull := false
+	for _, k := range keys {
+		if k == "NULL" {
+			hasNull = true
+			continue
+		}
+		values = append(values, "'"+strings.ReplaceAll(k, "'", "''")+"'")
+	}
+	var conditions []string
+	if len(values) > 0 {
+		conditions = append(conditions, "CAST(key AS VARCHAR) IN ("+strings.Join(values, ", ")+")")
+	}
+	if hasNull {
+		conditions = append(conditions, "key IS NULL")
+	}
+	inner := digestLimitClause.ReplaceAllString(strings.TrimSpace(sql), "")
+	return "SELECT * FROM (\n" + inner + "\n) AS keyed\nWHERE " + strings.Join(conditions, " OR ")
+}
+
+// rowsToKeyValues converts (key, value) Athena rows, skipping the header row
+func rowsToKeyValues(rows []*athena.Row) []keyValue {
+	var result []keyValue
+	for i, row := range rows {
+		if i == 0 || len(row.Data) < 2 {
+			continue
+		}
+		key := "NULL"
+		if row.Data[0].VarCharValue != nil {
+			key = *row.Data[0].VarCharValue
+		}
+		var value float64
+		if row.Data[1].VarCharValue != nil {
+			value, _ = strconv.ParseFloat(*row.Data[1].VarCharValue, 64)
+		}
+		result = append(result, keyValue{Key: key, Value: value})
+	}
+	return result
+}
+
+// runDigest runs the digest queries for all targets and posts the report to the digest channels
+func runDigest(ctx context.Context, period string, channels []string) error {
+	if len(channels) == 0 {
+		channels = digestChannels
+	}
+	if len(channels) == 0 {
+		slog.WarnContext(ctx, "No digest channels configured (DIGEST_CHANNELS), skipping digest")
+		return nil
+	}
+
+	length := digestPeriod(period)
+	end := time.Now().UTC().Truncate(time.Hour)
+	start := end.Add(-length)
+	prevStart := start.Add(-length)
+
+	queries := selectedDigestQueries()
+	slog.InfoContext(ctx, "Running digest", "period", period, "targets", len(wafTargets), "queries", len(queries), "start", start, "end", end)
+
+	// Run every target/query combination concurrently to stay within the Lambda timeout
+	results := make([]*digestResult, 0, len(wafTargets)*len(queries))
+	var wg sync.WaitGroup
+	for _, target := range wafTargets {
+		// Digest queries are SQL; CloudWatch Logs targets are not included
+		if target.LogGroup != "" {
+			continue
+		}
+		for _, q := range queries {
+			result := &digestResult{Target: target, Query: q}
+			results = append(results, result)
+
+			wg.Add(1)
+			go func(r *digestResult) {
+				defer wg.Done()
+				rule := redactionFor([]string{r.Target.Name}, "")
+				_, rows, errMsg, _ := executeQuery(ctx, renderDigestSQL(r.Query, r.Target, start, end), r.Target.Region)
+				if errMsg != "" {
+					r.Err = errMsg
+					return
+				}
+				current := rowsToKeyValues(rows)
+				r.Current = rowsToKeyValues(redactRows(rows, rule))
+				if len(current) == 0 {
+					return
+				}
+
+				// The previous period is looked up for the current keys, so a key outside its top rows is not "new"
+				keys := make([]string, len(current))
+				for i, kv := range current {
+					keys[i] = kv.Key
+				}
+				prevSQL := keyedDigestSQL(renderDigestSQL(r.Query, r.Target, prevStart, start), keys)
+				_, rows, errMsg, _ = executeQuery(ctx, prevSQL, r.Target.Region)
+				if errMsg != "" {
+					r.Err = errMsg
+					return
+				}
+				r.Previous = rowsToKeyValues(redactRows(rows, rule))
+			}(result)
+		}
+	}
+	wg.Wait()
+
+	report := formatDigest(results)
+
+	// Ask Bedrock for a short narrative over the comparison
+	summary, err := callBedrock(ctx, "digest", buildDigestPrompt(period, report))
+	if err != nil {
+		slog.WarnContext(ctx, "Digest summary failed, posting the comparison only", "error", err)
+		summary = "_not available_"
+	}
+
+	title := "Daily"
+	if period == "weekly" {
+		title = "Weekly"
+	}
+	message := fmt.Sprintf("*WAF %s Digest* (%s - %s UTC)\n\n%s\n*Summary:*\n%s",
+		title, start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"), report, summary)
+
+	for _, channel := range channels {
+		if err := postToSlack(channel, message); err != nil {
+			slog.WarnContext(ctx, "Failed to post digest", "channel", channel, "error", err)
+		}
+	}
+	return nil
+}
+
+// formatDigest renders the digest results as Slack text with previous period comparison
+func formatDigest(results []*digestResult) string {
+	var sb strings.Builder
+	currentTarget := ""
+
+	for _, r := range results {
+		if r.Target.Name != currentTarget {
+			currentTarget = r.Target.Name
+			sb.WriteString(fmt.Sprintf("*%s* (%s, %s)\n", r.Target.Name, r.Target.Description, r.Target.Region))
+		}
+
+		sb.WriteString(fmt.Sprintf("_%s_\n", r.Query.Title))
+		if r.Err != "" {
+			sb.WriteString(fmt.Sprintf("> query failed: %s\n", r.Err))
+			continue
+		}
+
+		previous := make(map[string]float64)
+		for _, kv := range r.Previous {
+			previous[kv.Key] = kv.Value
+		}
+
+		var lines []string
+		for _, kv := range r.Current {
+			prev, seen := previous[kv.Key]
+			if !seen {
+				lines = append(lines, fmt.Sprintf("%s: %s (new)", kv.Key, formatNumber(kv.Value)))
+			} else if !r.Query.NewKeys {
+				lines = append(lines, fmt.Sprintf("%s: %s (prev %s, %s)", kv.Key, formatNumber(kv.Value), formatNumber(prev), describeChange(prev, kv.Value)))
+			}
+		}
+
+		if len(lines) == 0 {
+			sb.WriteString("> no data\n")
+			continue
+		}
+		sb.WriteString("```\n" + strings.Join(lines, "\n") + "\n```\n")
+	}
+
+	return sb.String()
+}
+
+// buildDigestPrompt constructs the prompt asking Bedrock to summarize a digest
+func buildDigestPrompt(period, report string) string {
+	return `You are a security analyst. Below is a ` + period + ` AWS WAF digest comparing the current period with the previous one.
+Write a short summary (at most 5 bullet points) highlighting notable changes, new sources and anything that needs attention.
+
+### Digest:
+` + report
+}
+
+// describeChange formats the relative change from prev to cur ("+25%"), or "new" when there was nothing before
+func describeChange(prev, cur float64) string {
+	switch {
+	case prev == 0 && cur == 0:
+		return "+0%"
+	case prev == 0:
+		return "new"
+	}
+	return fmt.Sprintf("%+.0f%%", (cur-prev)/prev*100)
+}
+
+// formatNumber formats a count without decimals and other values with up to 2 decimals
+func formatNumber(v float64) string {
+	if v == float64(int64(v)) {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
@@ -0,0 +1,388 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EvalCase is one question of the evaluation suite with what a correct answer looks like.
+// A case passes when every expectation it sets holds; cases without expectations only check that SQL is generated and runs.
+type EvalCase struct {
+	Name           string     `json:"name"`
+	Question       string     `json:"question"`
+	Timezone       string     `json:"timezone,omitempty"`        // IANA name (default USER_TIMEZONE)
+	ExpectSQL      []string   `json:"expect_sql,omitempty"`      // Regexps the generated SQL must match (case-insensitive)
+	RejectSQL      []string   `json:"reject_sql,omitempty"`      // Regexps the generated SQL must not match
+	ExpectTemplate string     `json:"expect_template,omitempty"` // Query template that should be chosen ("none" for free-form)
+	ExpectRows     [][]string `json:"expect_rows,omitempty"`     // Expected result rows (without header)
+	ReferenceSQL   string     `json:"reference_sql,omitempty"`   // SQL whose result set the answer must match
+	Ordered        bool       `json:"ordered,omitempty"`         // Compare rows in order
+	AllowExtraRows bool       `json:"allow_extra_rows,omitempty"`
+}
+
+// EvalResult is the outcome of one case
+type EvalResult struct {
+	Name            string   `json:"name"`
+	Question        string   `json:"question"`
+	SQL             string   `json:"sql"`
+	Template        string   `json:"template,omitempty"`
+	Passed          bool     `json:"passed"`
+	Failures        []string `json:"failures,omitempty"`
+	ValidationError string   `json:"validation_error,omitempty"`
+	QueryError      string   `json:"query_error,omitempty"`
+	Rows            int      `json:"rows"`
+	GenerationMs    int64    `json:"generation_ms"`
+	ExecutionMs     int64    `json:"execution_ms"`
+	LatencyMs       int64    `json:"latency_ms"`
+	InputTokens     int64    `json:"input_tokens"`
+	OutputTokens    int64    `json:"output_tokens"`
+	CostUSD         float64  `json:"cost_usd"`
+}
+
+// EvalSummary aggregates the results of a run
+type EvalSummary struct {
+	Cases              int     `json:"cases"`
+	Passed             int     `json:"passed"`
+	Accuracy           float64 `json:"accuracy"`
+	ValidationFailures int     `json:"validation_failures"`
+	QueryErrors        int     `json:"query_errors"`
+	LatencyP50Ms       int64   `json:"latency_p50_ms"`
+	LatencyP95Ms       int64   `json:"latency_p95_ms"`
+	InputTokens        int64   `json:"input_tokens"`
+	OutputTokens       int64   `json:"output_tokens"`
+	CostUSD            float64 `json:"cost_usd"`
+}
+
+// EvalReport is the JSON report of a run
+type EvalReport struct {
+	Started       time.Time    `json:"started"`
+	Model         string       `json:"model"`
+	PromptVersion string       `json:"prompt_version"`
+	Backend       string       `json:"backend"`
+	Suite         string       `json:"suite"`
+	Summary       EvalSummary  `json:"summary"`
+	Results       []EvalResult `json:"results"`
+}
+
+// Token prices in USD per 1,000 tokens for cost estimates (defaults: Claude 3 Sonnet on Bedrock)
+var (
+	evalInputTokenPrice  = envFloat("EVAL_INPUT_TOKEN_PRICE", 0.003)
+	evalOutputTokenPrice = envFloat("EVAL_OUTPUT_TOKEN_PRICE", 0.015)
+)
+
+// runEvalCommand runs an evaluation suite and writes the JSON report and markdown summary.
+// The exit code is 1 when a case fails, so the command can gate prompt or model changes in CI.
+func runEvalCommand(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	suite := fs.String("suite", "analyzer/testdata/eval/cases.json", "evaluation cases (JSON array)")
+	backend := fs.String("backend", queryBackend, "query backend: athena or offline")
+	dataDir := fs.String("data", os.Getenv("OFFLINE_DATA_DIR"), "log directory of the offline backend")
+	out := fs.String("out", "", "write the JSON report to this file (default stdout)")
+	summary := fs.String("summary", "", "write the markdown summary to this file (default stderr)")
+	run := fs.String("run", "", "only run cases whose name matches this regexp")
+	noExec := fs.Bool("no-exec", false, "only generate SQL; skip result expectations")
+	verbose := fs.Bool("verbose", false, "print logs to stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if !*verbose {
+		setLogOutput(io.Discard)
+	}
+
+	cases, err := loadEvalCases(*suite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", *suite, err)
+		return 2
+	}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -run pattern: %v\n", err)
+			return 2
+		}
+		var selected []EvalCase
+		for _, c := range cases {
+			if re.MatchString(c.Name) {
+				selected = append(selected, c)
+			}
+		}
+		cases = selected
+	}
+
+	if *backend == "offline" {
+		queryExecutor = newOfflineExecutor(*dataDir)
+	} else {
+		queryExecutor = newQueryExecutor(*backend)
+	}
+	// Each case must run its query rather than reuse a cached result
+	queryCacheTable = ""
+
+	report := EvalReport{Started: time.Now().UTC(), Model: bedrockModelID, PromptVersion: promptVersion, Backend: *backend, Suite: *suite}
+	for _, c := range cases {
+		result := runEvalCase(context.Background(), c, !*noExec)
+		fmt.Fprintf(os.Stderr, "%-4s %s (%d ms)\n", map[bool]string{true: "PASS", false: "FAIL"}[result.Passed], result.Name, result.LatencyMs)
+		report.Results = append(report.Results, result)
+	}
+	report.Summary = summarizeEval(report.Results)
+
+	reportJSON, _ := json.MarshalIndent(report, "", "  ")
+	if err := writeOutput(*out, append(reportJSON, '\n'), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write report: %v\n", err)
+		return 1
+	}
+	if err := writeOutput(*summary, []byte(formatEvalMarkdown(report)), os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write summary: %v\n", err)
+		return 1
+	}
+
+	if report.Summary.Passed < report.Summary.Cases {
+		return 1
+	}
+	return 0
+}
+
+// loadEvalCases reads the case list, naming unnamed cases by position
+func loadEvalCases(path string) ([]EvalCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []EvalCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, err
+	}
+	for i := range cases {
+		if cases[i].Name == "" {
+			cases[i].Name = fmt.Sprintf("case-%d", i+1)
+		}
+		if strings.TrimSpace(cases[i].Question) == "" {
+			return nil, fmt.Errorf("case %s has no question", cases[i].Name)
+		}
+	}
+	return cases, nil
+}
+
+// runEvalCase generates SQL for a case, runs it and checks the expectations
+func runEvalCase(ctx context.Context, c EvalCase, execute bool) EvalResult {
+	result := EvalResult{Name: c.Name, Question: c.Question}
+	loc := defaultLocation
+	if c.Timezone != "" {
+		loc = loadLocation(c.Timezone)
+	}
+	fail := func(format string, args ...interface{}) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+
+	inBefore, outBefore := bedrockInputTokensUsed.Load(), bedrockOutputTokensUsed.Load()
+	started := time.Now()
+	var err error
+	result.SQL, result.Template, err = generateSQL(ctx, c.Question, loc)
+	result.GenerationMs = time.Since(started).Milliseconds()
+	result.InputTokens = bedrockInputTokensUsed.Load() - inBefore
+	result.OutputTokens = bedrockOutputTokensUsed.Load() - outBefore
+	result.CostUSD = float64(result.InputTokens)/1000*evalInputTokenPrice + float64(result.OutputTokens)/1000*evalOutputTokenPrice
+	if err != nil {
+		fail("SQL generation failed: %v", err)
+		result.LatencyMs = result.GenerationMs
+		return result
+	}
+
+	for _, pattern := range c.ExpectSQL {
+		if re, err := regexp.Compile("(?is)" + pattern); err != nil {
+			fail("invalid expect_sql pattern %q: %v", pattern, err)
+		} else if !re.MatchString(result.SQL) {
+			fail("SQL does not match %q", pattern)
+		}
+	}
+	for _, pattern := range c.RejectSQL {
+		if re, err := regexp.Compile("(?is)" + pattern); err != nil {
+			fail("invalid reject_sql pattern %q: %v", pattern, err)
+		} else if re.MatchString(result.SQL) {
+			fail("SQL matches rejected pattern %q", pattern)
+		}
+	}
+	if c.ExpectTemplate != "" {
+		template := result.Template
+		if template == "" {
+			template = "none"
+		}
+		if !strings.EqualFold(template, c.ExpectTemplate) {
+			fail("template %s, expected %s", template, c.ExpectTemplate)
+		}
+	}
+
+	if errMsg := validateQuery(result.SQL); errMsg != "" && !isLogsInsightsQuery(result.SQL) {
+		result.ValidationError = errMsg
+		fail("validation: %s", errMsg)
+	}
+
+	if execute && result.ValidationError == "" {
+		started := time.Now()
+		_, rows, errMsg, _ := runAthenaQuery(ctx, result.SQL)
+		result.ExecutionMs = time.Since(started).Milliseconds()
+		if errMsg != "" {
+			result.QueryError = errMsg
+			fail("query: %s", errMsg)
+		} else {
+			result.Rows = max(len(rows)-1, 0)
+			_, values := rowValues(rows)
+
+			expected := c.ExpectRows
+			if c.ReferenceSQL != "" {
+				_, refRows, refErr, _ := runAthenaQuery(ctx, c.ReferenceSQL)
+				if refErr != "" {
+					fail("reference query: %s", refErr)
+				}
+				_, expected = rowValues(refRows)
+				if expected == nil {
+					expected = [][]string{}
+				}
+			}
+			if expected != nil {
+				for _, problem := range compareEvalRows(values, expected, c.Ordered, c.AllowExtraRows) {
+					fail("%s", problem)
+				}
+			}
+		}
+	}
+
+	result.LatencyMs = result.GenerationMs + result.ExecutionMs
+	result.Passed = len(result.Failures) == 0
+	return result
+}
+
+// compareEvalRows checks actual result rows against expected ones. An expected row matches a result row
+// that contains all its values in any column order, so generated queries may name, order or add columns freely.
+func compareEvalRows(actual, expected [][]string, ordered, allowExtra bool) []string {
+	var problems []string
+	if len(actual) < len(expected) || (!allowExtra && len(actual) != len(expected)) {
+		problems = append(problems, fmt.Sprintf("%d rows, expected %d", len(actual), len(expected)))
+	}
+
+	used := make([]bool, len(actual))
+	for i, want := range expected {
+		found := false
+		for j, got := range actual {
+			if used[j] || (ordered && j != i) {
+				continue
+			}
+			if evalRowContains(got, want) {
+				used[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("missing row %v", want))
+		}
+	}
+	return problems
+}
+
+// evalRowContains reports whether a result row contains every expected value (numbers compared numerically)
+func evalRowContains(row, want []string) bool {
+	used := make([]bool, len(row))
+	for _, w := range want {
+		found := false
+		for i, v := range row {
+			if !used[i] && evalValuesEqual(v, w) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// evalValuesEqual compares two cells, ignoring case, surrounding spaces and number formatting (2 = 2.0)
+func evalValuesEqual(a, b string) bool {
+	a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	x, err := strconv.ParseFloat(a, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseFloat(b, 64)
+	return err == nil && x == y
+}
+
+// summarizeEval computes accuracy, failure counts, latency percentiles and token cost
+func summarizeEval(results []EvalResult) EvalSummary {
+	s := EvalSummary{Cases: len(results)}
+	var latencies []int64
+	for _, r := range results {
+		if r.Passed {
+			s.Passed++
+		}
+		if r.ValidationError != "" {
+			s.ValidationFailures++
+		}
+		if r.QueryError != "" {
+			s.QueryErrors++
+		}
+		s.InputTokens += r.InputTokens
+		s.OutputTokens += r.OutputTokens
+		s.CostUSD += r.CostUSD
+		latencies = append(latencies, r.LatencyMs)
+	}
+	if s.Cases > 0 {
+		s.Accuracy = float64(s.Passed) / float64(s.Cases)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		// Nearest-rank percentiles
+		s.LatencyP50Ms = latencies[(len(latencies)*50+99)/100-1]
+		s.LatencyP95Ms = latencies[(len(latencies)*95+99)/100-1]
+	}
+	return s
+}
+
+// formatEvalMarkdown renders the report as a markdown summary (for PR comments and job summaries)
+func formatEvalMarkdown(report EvalReport) string {
+	s := report.Summary
+	var sb strings.Builder
+	sb.WriteString("## SQL Evaluation\n\n")
+	sb.WriteString(fmt.Sprintf("Model `%s`, prompt `%s`, backend `%s`, suite `%s`\n\n", report.Model, report.PromptVersion, report.Backend, report.Suite))
+	sb.WriteString(fmt.Sprintf("**Accuracy:** %d/%d (%.1f%%)  \n", s.Passed, s.Cases, s.Accuracy*100))
+	sb.WriteString(fmt.Sprintf("**Validation failures:** %d, **query errors:** %d  \n", s.ValidationFailures, s.QueryErrors))
+	sb.WriteString(fmt.Sprintf("**Latency:** p50 %d ms, p95 %d ms  \n", s.LatencyP50Ms, s.LatencyP95Ms))
+	sb.WriteString(fmt.Sprintf("**Tokens:** %d in, %d out (~$%.4f)\n\n", s.InputTokens, s.OutputTokens, s.CostUSD))
+
+	sb.WriteString("| Case | Result | Template | Rows | Latency (ms) | Tokens (in/out) | Cost ($) | Failures |\n")
+	sb.WriteString("| --- | --- | --- | --- | --- | --- | --- | --- |\n")
+	escape := func(s string) string { return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ") }
+	for _, r := range report.Results {
+		status := "pass"
+		if !r.Passed {
+			status = "**fail**"
+		}
+		template := r.Template
+		if template == "" {
+			template = "-"
+		}
+		sb.WriteString(fmt.Sprintf("| %s | %s | %s | %d | %d | %d/%d | %.4f | %s |\n",
+			escape(r.Name), status, escape(template), r.Rows, r.LatencyMs, r.InputTokens, r.OutputTokens, r.CostUSD,
+			escape(strings.Join(r.Failures, "; "))))
+	}
+	return sb.String()
+}
+
+// writeOutput writes data to a file, or to w when no path is given
+func writeOutput(path string, data []byte, w io.Writer) error {
+	if path == "" {
+		_, err := w.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
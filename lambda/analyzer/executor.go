@@ -0,0 +1,57 @@
+package analyzer
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// QueryExecutor runs an already validated and preprocessed SQL query.
+// Results use the Athena row format (first row is the header) so formatting and analysis work for every backend.
+type QueryExecutor interface {
+	Execute(ctx context.Context, query string, region string) (string, []*athena.Row, string, QueryStats)
+}
+
+// athenaExecutor runs queries in Amazon Athena
+type athenaExecutor struct{}
+
+// Execute runs the query in Athena in the given region
+func (athenaExecutor) Execute(ctx context.Context, query string, region string) (string, []*athena.Row, string, QueryStats) {
+	return runAthenaQueryInRegion(ctx, query, region)
+}
+
+// queryBackend selects the executor: "athena" (default) or "offline" (local log files, see offline.go)
+var queryBackend = envOrDefault("QUERY_BACKEND", "athena")
+
+// queryExecutor is the executor used by runAthenaQuery, digests and anomaly detection
+var queryExecutor = newQueryExecutor(queryBackend)
+
+// newQueryExecutor creates the executor for a backend name
+func newQueryExecutor(backend string) QueryExecutor {
+	switch backend {
+	case "offline":
+		slog.Info("Using offline query backend", "data_dir", os.Getenv("OFFLINE_DATA_DIR"))
+		return newOfflineExecutor(os.Getenv("OFFLINE_DATA_DIR"))
+	case "athena", "":
+		return athenaExecutor{}
+	default:
+		slog.Warn("Unknown QUERY_BACKEND, using athena", "backend", backend)
+		return athenaExecutor{}
+	}
+}
+
+// executeQuery runs a validated query with the configured executor (Logs Insights queries always run in CloudWatch)
+func executeQuery(ctx context.Context, query string, region string) (string, []*athena.Row, string, QueryStats) {
+	if isLogsInsightsQuery(query) {
+		return logsInsightsExecutor{}.Execute(ctx, query, region)
+	}
+	return queryExecutor.Execute(ctx, query, region)
+}
+
+// isAthenaBackend reports whether queries run in Athena (async polling and console links need it)
+func isAthenaBackend() bool {
+	_, ok := queryExecutor.(athenaExecutor)
+	return ok
+}
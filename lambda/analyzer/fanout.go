@@ -0,0 +1,371 @@
+package analyzer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// Phrases in a question that ask for all registered WAFs (comma separated, FANOUT_KEYWORDS overrides)
+var fanOutKeywords = splitList(envOrDefault("FANOUT_KEYWORDS",
+	"all wafs,all our wafs,all the wafs,every waf,all webacls,all web acls,across all,all targets,all accounts,all regions"))
+
+// Column names whose values cannot be summed when merging results (averages, rates, percentages)
+var nonAdditiveColumn = regexp.MustCompile(`(?i)avg|average|mean|rate|ratio|pct|percent|median|p\d\d`)
+
+// Numeric columns that are grouping keys rather than counts
+var keyLikeColumn = regexp.MustCompile(`(?i)^(hour|day|date|minute|month|year|week|port|status|status_code|code)$`)
+
+// FanOutResult is the outcome of the fan-out query on one target
+type FanOutResult struct {
+	Target  WAFTarget
+	QueryID string
+	Rows    []*athena.Row
+	Stats   QueryStats
+	Err     string
+}
+
+// isFanOutQuestion reports whether a question asks about all registered WAFs
+func isFanOutQuestion(text string) bool {
+	lower := strings.ToLower(text)
+	for _, k := range fanOutKeywords {
+		if strings.Contains(lower, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runQuestionQuery runs the SQL generated for a question, fanning out to all targets when the question asks for them.
+// allowed limits the fan-out targets (nil allows all).
+func runQuestionQuery(ctx context.Context, text, sql string, allowed func(WAFTarget) bool) (string, []*athena.Row, string, QueryStats, []FanOutResult) {
+	if isFanOutQuestion(text) && !isLogsInsightsQuery(sql) {
+		return runFanOutQuery(ctx, sql, allowed)
+	}
+	qid, rows, errMsg, stats := runAthenaQuery(ctx, sql)
+	return qid, rows, errMsg, stats, nil
+}
+
+// fanOutSource returns the target of a query that can fan out: it must read exactly one registered table
+// and no other table
+func fanOutSource(sql string) (WAFTarget, bool) {
+	targets, unregistered := queryTables(sql)
+	if len(targets) != 1 || len(unregistered) > 0 {
+		return WAFTarget{}, false
+	}
+	return targets[0], true
+}
+
+// fanOutSQL rewrites a query written for one target so it runs against another target of the same schema.
+// It fails when the rewritten query reads any table other than the target's, or filters on the source's account
+// and the target has no account to filter on instead.
+func fanOutSQL(sql string, source, target WAFTarget) (string, bool) {
+	sql = strings.ReplaceAll(sql, source.FullTableName(), target.FullTableName())
+	if source.Table != target.Table {
+		sql = strings.ReplaceAll(sql, source.Table, target.Table)
+	}
+	if source.AccountID != "" && source.AccountID != target.AccountID && strings.Contains(sql, "'"+source.AccountID+"'") {
+		if target.AccountID == "" {
+			return "", false
+		}
+		sql = strings.ReplaceAll(sql, "'"+source.AccountID+"'", "'"+target.AccountID+"'")
+	}
+	if t, ok := fanOutSource(sql); !ok || t.Name != target.Name {
+		return "", false
+	}
+	return sql, true
+}
+
+// runFanOutQuery runs a query on every Athena target with the same schema concurrently and merges the results.
+// Per-target failures are reported in the results; the query only fails when no target succeeds.
+// Targets rejected by allowed (when not nil) are skipped.
+func runFanOutQuery(ctx context.Context, sql string, allowed func(WAFTarget) bool) (string, []*athena.Row, string, QueryStats, []FanOutResult) {
+	source, ok := fanOutSource(sql)
+	if !ok {
+		slog.InfoContext(ctx, "Fan-out query does not read exactly one registered table, running it once")
+		qid, rows, errMsg, stats := runAthenaQuery(ctx, sql)
+		return qid, rows, errMsg, stats, nil
+	}
+
+	results := make([]FanOutResult, 0, len(wafTargets))
+	for _, t := range wafTargets {
+		result := FanOutResult{Target: t}
+		switch {
+		case allowed != nil && !allowed(t):
+			result.Err = "skipped (no access)"
+		case t.LogGroup != "":
+			result.Err = "skipped (CloudWatch Logs target)"
+		case t.Dialect().Name != source.Dialect().Name:
+			result.Err = fmt.Sprintf("skipped (%s schema)", t.Dialect().Label)
+		}
+		results = append(results, result)
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		if results[i].Err != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(r *FanOutResult) {
+			defer wg.Done()
+			query, ok := fanOutSQL(sql, source, r.Target)
+			if !ok {
+				r.Err = "skipped (the query could not be rewritten for this target)"
+				return
+			}
+			slog.InfoContext(ctx, "Fan-out query", "target", r.Target.Name, "region", r.Target.Region)
+			r.QueryID, r.Rows, r.Err, r.Stats = runAthenaQuery(ctx, query)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	var qids, regions, names []string
+	var succeeded [][]*athena.Row
+	var stats QueryStats
+	for _, r := range results {
+		if r.Err != "" {
+			slog.WarnContext(ctx, "Fan-out target failed", "target", r.Target.Name, "error", r.Err)
+			continue
+		}
+		qids = append(qids, r.QueryID)
+		regions = append(regions, r.Target.Region)
+		names = append(names, r.Target.Name)
+		// The merged result is cached only when every target's result was
+		stats.Cached = r.Stats.Cached && (len(succeeded) == 0 || stats.Cached)
+		succeeded = append(succeeded, r.Rows)
+		stats.DataScannedBytes += r.Stats.DataScannedBytes
+		stats.EngineExecutionMs = max(stats.EngineExecutionMs, r.Stats.EngineExecutionMs)
+		if r.Stats.CachedAt.After(stats.CachedAt) {
+			stats.CachedAt = r.Stats.CachedAt
+		}
+	}
+	stats.Region = strings.Join(uniqueStrings(regions), ",")
+
+	if len(succeeded) == 0 {
+		return "", nil, "Query failed on every target:\n" + formatFanOutSummary(results), stats, results
+	}
+	return strings.Join(qids, ","), mergeFanOutRows(succeeded, names, queryLimit(sql)), "", stats, results
+}
+
+// mergeFanOutRows merges per-target results.
+// Counts are re-aggregated by the non-numeric columns (with the contributing targets) and the top limit rows kept;
+// results with non-additive columns are concatenated with a target column instead.
+func mergeFanOutRows(results [][]*athena.Row, names []string, limit int) []*athena.Row {
+	headers, _ := rowValues(results[0])
+	if len(headers) == 0 {
+		return results[0]
+	}
+
+	type targetRow struct {
+		target string
+		values []string
+	}
+	var all []targetRow
+	for i, rows := range results {
+		h, values := rowValues(rows)
+		if strings.Join(h, ",") != strings.Join(headers, ",") {
+			slog.Warn("Fan-out result columns differ, skipping target", "target", names[i])
+			continue
+		}
+		for _, v := range values {
+			all = append(all, targetRow{names[i], v})
+		}
+	}
+
+	// A column is numeric when every non-null value parses as a number
+	numeric := make([]bool, len(headers))
+	additive := true
+	hasNumeric := false
+	for c := range headers {
+		numeric[c] = len(all) > 0
+		for _, r := range all {
+			if _, err := strconv.ParseFloat(r.values[c], 64); err != nil && r.values[c] != "NULL" {
+				numeric[c] = false
+				break
+			}
+		}
+		if numeric[c] && keyLikeColumn.MatchString(headers[c]) {
+			numeric[c] = false
+		}
+		if numeric[c] {
+			hasNumeric = true
+			if nonAdditiveColumn.MatchString(headers[c]) {
+				additive = false
+			}
+		}
+	}
+
+	var merged [][]string
+	var outHeaders []string
+	sortCol := -1
+	if hasNumeric && additive {
+		// Re-aggregate: group by the key columns, sum the numeric ones
+		outHeaders = append(append(outHeaders, headers...), "targets")
+		groups := make(map[string]int)
+		sums := [][]float64{}
+		targets := []map[string]bool{}
+		for _, r := range all {
+			var keyParts []string
+			for c, v := range r.values {
+				if !numeric[c] {
+					keyParts = append(keyParts, v)
+				}
+			}
+			key := strings.Join(keyParts, "\x00")
+			g, ok := groups[key]
+			if !ok {
+				g = len(merged)
+				groups[key] = g
+				merged = append(merged, append([]string(nil), r.values...))
+				sums = append(sums, make([]float64, len(headers)))
+				targets = append(targets, make(map[string]bool))
+			}
+			for c, v := range r.values {
+				if numeric[c] {
+					f, _ := strconv.ParseFloat(v, 64)
+					sums[g][c] += f
+				}
+			}
+			targets[g][r.target] = true
+		}
+		for g := range merged {
+			for c := range headers {
+				if numeric[c] {
+					merged[g][c] = strconv.FormatFloat(sums[g][c], 'f', -1, 64)
+				}
+			}
+			merged[g] = append(merged[g], strings.Join(sortedKeys(targets[g]), ","))
+		}
+		for c := range headers {
+			if numeric[c] {
+				sortCol = c
+				break
+			}
+		}
+	} else {
+		outHeaders = append([]string{"target"}, headers...)
+		for _, r := range all {
+			merged = append(merged, append([]string{r.target}, r.values...))
+		}
+	}
+
+	if sortCol >= 0 {
+		sort.SliceStable(merged, func(i, j int) bool {
+			a, _ := strconv.ParseFloat(merged[i][sortCol], 64)
+			b, _ := strconv.ParseFloat(merged[j][sortCol], 64)
+			return a > b
+		})
+	}
+
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+
+	rows := []*athena.Row{stringsToRow(outHeaders)}
+	for _, v := range merged {
+		rows = append(rows, stringsToRow(v))
+	}
+	return rows
+}
+
+// queryLimit returns the row limit of a query's outermost LIMIT clause, or the rows of a single Athena result page
+// when it has none
+func queryLimit(sql string) int {
+	tokens := tokenizeSQL(sql)
+	limit, depth := 19, 0
+	for i, tok := range tokens {
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			depth--
+		case depth == 0 && tok.word && strings.EqualFold(tok.text, "limit") && i+1 < len(tokens):
+			if n, err := strconv.Atoi(tokens[i+1].text); err == nil && n > 0 {
+				limit = n
+			}
+		}
+	}
+	return limit
+}
+
+// formatFanOutSummary lists the per-target outcome of a fan-out query
+func formatFanOutSummary(results []FanOutResult) string {
+	var sb strings.Builder
+	for _, r := range results {
+		if r.Err != "" {
+			sb.WriteString(fmt.Sprintf("• %s (%s): %s\n", r.Target.Name, r.Target.Region, r.Err))
+		} else {
+			sb.WriteString(fmt.Sprintf("• %s (%s): %d rows\n", r.Target.Name, r.Target.Region, max(len(r.Rows)-1, 0)))
+		}
+	}
+	return sb.String()
+}
+
+// resultTargetNames returns the names of the targets a query result came from
+func resultTargetNames(sql string, stats QueryStats, fanOut []FanOutResult) []string {
+	if fanOut != nil {
+		var names []string
+		for _, r := range fanOut {
+			if r.Err == "" {
+				names = append(names, r.Target.Name)
+			}
+		}
+		return names
+	}
+	if stats.Target != "" {
+		return []string{stats.Target}
+	}
+	if isLogsInsightsQuery(sql) {
+		if t, _, _, errMsg := parseLogsInsightsQuery(sql); errMsg == "" {
+			return []string{t.Name}
+		}
+	}
+	if t, ok := targetForQuery(sql); ok {
+		return []string{t.Name}
+	}
+	return nil
+}
+
+// stringsToRow builds an Athena row from string values ("NULL" becomes a null datum)
+func stringsToRow(values []string) *athena.Row {
+	row := &athena.Row{}
+	for _, v := range values {
+		datum := &athena.Datum{}
+		if v != "NULL" {
+			datum.VarCharValue = awsString(v)
+		}
+		row.Data = append(row.Data, datum)
+	}
+	return row
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uniqueStrings returns the values without duplicates, keeping their order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,161 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// withTargets replaces the registered WAF targets for the duration of a test
+func withTargets(t *testing.T, targets []WAFTarget) {
+	t.Helper()
+	saved := wafTargets
+	wafTargets = targets
+	t.Cleanup(func() { wafTargets = saved })
+}
+
+// testRows builds an Athena result (header row first) from string values
+func testRows(values ...[]string) []*athena.Row {
+	rows := make([]*athena.Row, 0, len(values))
+	for _, v := range values {
+		rows = append(rows, stringsToRow(v))
+	}
+	return rows
+}
+
+// Test targets of the same schema in different databases and accounts
+var (
+	testTargetAPI      = WAFTarget{Name: "api", Region: "ap-northeast-1", Database: "db1", Table: "waf_api", AccountID: "111111111111"}
+	testTargetFrontend = WAFTarget{Name: "frontend", Region: "us-east-1", Database: "db2", Table: "waf_frontend", AccountID: "222222222222"}
+	testTargetShared   = WAFTarget{Name: "shared", Region: "ap-northeast-1", Database: "db3", Table: "waf_shared"}
+)
+
+func TestFanOutSQL(t *testing.T) {
+	withTargets(t, []WAFTarget{testTargetAPI, testTargetFrontend, testTargetShared})
+
+	tests := []struct {
+		name   string
+		sql    string
+		target WAFTarget
+		want   string
+		ok     bool
+	}{
+		{
+			name:   "table and account replaced",
+			sql:    "SELECT COUNT(*) FROM db1.waf_api WHERE accountid = '111111111111'",
+			target: testTargetFrontend,
+			want:   "SELECT COUNT(*) FROM db2.waf_frontend WHERE accountid = '222222222222'",
+			ok:     true,
+		},
+		{
+			name:   "no account filter",
+			sql:    "SELECT COUNT(*) FROM db1.waf_api",
+			target: testTargetShared,
+			want:   "SELECT COUNT(*) FROM db3.waf_shared",
+			ok:     true,
+		},
+		{
+			name:   "target without account cannot replace the filter",
+			sql:    "SELECT COUNT(*) FROM db1.waf_api WHERE accountid = '111111111111'",
+			target: testTargetShared,
+			ok:     false,
+		},
+		{
+			name:   "join with another table",
+			sql:    "SELECT COUNT(*) FROM db1.waf_api a JOIN db2.waf_frontend f ON a.ip = f.ip",
+			target: testTargetShared,
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := fanOutSQL(tt.sql, testTargetAPI, tt.target)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("fanOutSQL() = %q, %v; want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestQueryLimit(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want int
+	}{
+		{"SELECT ip, COUNT(*) c FROM t GROUP BY 1 ORDER BY c DESC LIMIT 5", 5},
+		{"SELECT ip FROM t", 19},
+		{"SELECT ip FROM (SELECT ip FROM t LIMIT 100) s", 19},
+		{"SELECT ip FROM (SELECT ip FROM t LIMIT 100) s LIMIT 3", 3},
+		{"SELECT 'LIMIT 2' AS x FROM t", 19},
+	}
+	for _, tt := range tests {
+		if got := queryLimit(tt.sql); got != tt.want {
+			t.Errorf("queryLimit(%q) = %d, want %d", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestMergeFanOutRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		results [][]*athena.Row
+		limit   int
+		want    [][]string
+	}{
+		{
+			name: "counts summed per key",
+			results: [][]*athena.Row{
+				testRows([]string{"ip", "c"}, []string{"192.0.2.1", "5"}, []string{"192.0.2.2", "3"}),
+				testRows([]string{"ip", "c"}, []string{"192.0.2.2", "4"}, []string{"192.0.2.3", "1"}),
+			},
+			limit: 19,
+			want: [][]string{
+				{"ip", "c", "targets"},
+				{"192.0.2.2", "7", "api,frontend"},
+				{"192.0.2.1", "5", "api"},
+				{"192.0.2.3", "1", "frontend"},
+			},
+		},
+		{
+			name: "truncated to the limit",
+			results: [][]*athena.Row{
+				testRows([]string{"ip", "c"}, []string{"192.0.2.1", "5"}, []string{"192.0.2.2", "3"}),
+				testRows([]string{"ip", "c"}, []string{"192.0.2.2", "4"}, []string{"192.0.2.3", "1"}),
+			},
+			limit: 1,
+			want:  [][]string{{"ip", "c", "targets"}, {"192.0.2.2", "7", "api,frontend"}},
+		},
+		{
+			name: "rates listed per target",
+			results: [][]*athena.Row{
+				testRows([]string{"rule", "block_rate"}, []string{"r1", "0.5"}),
+				testRows([]string{"rule", "block_rate"}, []string{"r1", "0.25"}),
+			},
+			limit: 19,
+			want: [][]string{
+				{"target", "rule", "block_rate"},
+				{"api", "r1", "0.5"},
+				{"frontend", "r1", "0.25"},
+			},
+		},
+		{
+			name: "key-like numeric columns are grouped on",
+			results: [][]*athena.Row{
+				testRows([]string{"hour", "c"}, []string{"1", "2"}),
+				testRows([]string{"hour", "c"}, []string{"1", "3"}, []string{"2", "1"}),
+			},
+			limit: 19,
+			want:  [][]string{{"hour", "c", "targets"}, {"1", "5", "api,frontend"}, {"2", "1", "frontend"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers, values := rowValues(mergeFanOutRows(tt.results, []string{"api", "frontend"}, tt.limit))
+			got := append([][]string{headers}, values...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeFanOutRows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
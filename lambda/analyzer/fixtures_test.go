@@ -0,0 +1,74 @@
+package analyzer
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// replayTestFixture replays testdata/fixtures/<name> through the handler and fails the test when a request has no
+// recorded response or what was sent to Slack differs from the recording
+func replayTestFixture(t *testing.T, name string) ReplayResult {
+	t.Helper()
+	fixture, err := loadFixture(filepath.Join("testdata", "fixtures", name))
+	if err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+
+	// The Lambda configuration the fixtures were recorded with
+	savedDB, savedOutput := athenaDB, athenaOutput
+	athenaDB, athenaOutput = "amazon_security_lake_glue_db_ap_northeast_1", "s3://waf-analyzer-athena-results/"
+	t.Cleanup(func() { athenaDB, athenaOutput = savedDB, savedOutput })
+
+	result := replayFixture(context.Background(), fixture)
+	if result.Err != nil {
+		t.Errorf("%s: handler error: %v", name, result.Err)
+	}
+	for _, u := range result.Unmatched {
+		t.Errorf("%s: no recorded response for %s", name, u)
+	}
+	for _, d := range result.Differences {
+		t.Errorf("%s: %s", name, d)
+	}
+	return result
+}
+
+func TestReplayFixtures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "fixtures", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no fixtures in testdata/fixtures")
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		t.Run(strings.TrimSuffix(name, ".json"), func(t *testing.T) {
+			result := replayTestFixture(t, name)
+			if result.Unused > 0 {
+				t.Errorf("%d recorded exchanges were not used", result.Unused)
+			}
+		})
+	}
+}
+
+func TestReplayMentionPostsAnswer(t *testing.T) {
+	result := replayTestFixture(t, "mention-top-source-ips.json")
+
+	resp, ok := result.Response.(events.APIGatewayProxyResponse)
+	if !ok || resp.StatusCode != 200 {
+		t.Fatalf("handler response = %#v, want status 200", result.Response)
+	}
+	if len(result.SlackRequests) != 1 {
+		t.Fatalf("got %d Slack requests, want 1", len(result.SlackRequests))
+	}
+	posted := result.SlackRequests[0].RequestBody
+	for _, want := range []string{"203.0.113.10", "5f1c2a9e-0d4b-4c1a-9a53-2b7e0c3d9f10", "INTERVAL '3' DAY", `"thread_ts":"1792330990.000100"`} {
+		if !strings.Contains(posted, want) {
+			t.Errorf("Slack message does not contain %q:\n%s", want, posted)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package analyzer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// rowValues converts Athena rows (header first) into header names and string values ("NULL" for nulls)
+func rowValues(rows []*athena.Row) ([]string, [][]string) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	var headers []string
+	for _, d := range rows[0].Data {
+		if d.VarCharValue != nil {
+			headers = append(headers, *d.VarCharValue)
+		} else {
+			headers = append(headers, "")
+		}
+	}
+
+	var values [][]string
+	for _, row := range rows[1:] {
+		v := make([]string, len(headers))
+		for i := range headers {
+			if i < len(row.Data) && row.Data[i].VarCharValue != nil {
+				v[i] = *row.Data[i].VarCharValue
+			} else {
+				v[i] = "NULL"
+			}
+		}
+		values = append(values, v)
+	}
+	return headers, values
+}
+
+// localizeRows returns a copy of rows with timestamp cells converted to loc, as in result tables
+func localizeRows(rows []*athena.Row, loc *time.Location) []*athena.Row {
+	if len(rows) == 0 {
+		return rows
+	}
+	headers, values := rowValues(rows)
+	result := []*athena.Row{rows[0]}
+	for _, v := range values {
+		out := make([]string, len(v))
+		for i, value := range v {
+			if value == "NULL" {
+				out[i] = value
+			} else {
+				out[i] = formatCellValue(headers[i], value, loc)
+			}
+		}
+		result = append(result, stringsToRow(out))
+	}
+	return result
+}
+
+// formatRowsCSV formats Athena rows as CSV
+func formatRowsCSV(rows []*athena.Row) string {
+	headers, values := rowValues(rows)
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(headers)
+	w.WriteAll(values)
+	return buf.String()
+}
+
+// formatRowsJSON formats Athena rows as a JSON array of objects keyed by column name
+func formatRowsJSON(rows []*athena.Row) string {
+	headers, values := rowValues(rows)
+	objects := make([]map[string]string, 0, len(values))
+	for _, v := range values {
+		obj := make(map[string]string, len(headers))
+		for i, h := range headers {
+			obj[h] = v[i]
+		}
+		objects = append(objects, obj)
+	}
+	b, _ := json.MarshalIndent(objects, "", "  ")
+	return string(b) + "\n"
+}
+
+// formatRowsMarkdown formats Athena rows as a Markdown table
+func formatRowsMarkdown(rows []*athena.Row) string {
+	headers, values := rowValues(rows)
+	if len(headers) == 0 {
+		return "No results found\n"
+	}
+
+	escape := func(s string) string { return strings.ReplaceAll(s, "|", "\\|") }
+
+	var sb strings.Builder
+	sb.WriteString("|")
+	for _, h := range headers {
+		sb.WriteString(" " + escape(h) + " |")
+	}
+	sb.WriteString("\n|")
+	for range headers {
+		sb.WriteString(" --- |")
+	}
+	sb.WriteString("\n")
+	for _, v := range values {
+		sb.WriteString("|")
+		for i, cell := range v {
+			sb.WriteString(" " + escape(formatCellValue(headers[i], cell, defaultLocation)) + " |")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// formatRowsText formats Athena rows as a plain text table (formatAthenaResults without Slack code fences)
+func formatRowsText(rows []*athena.Row) string {
+	text := formatAthenaResults(rows)
+	text = strings.TrimPrefix(text, "```\n")
+	return strings.TrimSuffix(text, "```\n")
+}
@@ -0,0 +1,463 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	bedrockClient = bedrockruntime.New(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("ap-northeast-1"),
+	})))
+	secretsClient = secretsmanager.New(session.Must(session.NewSession()))
+
+	slackToken         string
+	slackSigningSecret = os.Getenv("SLACK_SIGNING_SECRET")
+	athenaDB           = os.Getenv("ATHENA_DATABASE")
+	athenaOutput       = os.Getenv("ATHENA_OUTPUT_BUCKET")
+	athenaWorkgroup    = os.Getenv("ATHENA_WORKGROUP")
+	// Display control by environment variable
+	showSqlInSlack     = os.Getenv("SHOW_SQL_IN_SLACK") != "false"      // Display by default
+	showQueryIdInSlack = os.Getenv("SHOW_QUERY_ID_IN_SLACK") != "false" // Display by default
+)
+
+func init() {
+	secretID := os.Getenv("SLACK_BOT_TOKEN_SECRET_NAME")
+	if secretID == "" {
+		slog.Warn("SLACK_BOT_TOKEN_SECRET_NAME environment variable is not set")
+		return
+	}
+
+	slog.Debug("Getting Slack token secret", "secret_id", secretID)
+
+	result, err := secretsClient.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		slog.Error("Failed to get secret value", "error", err)
+		return
+	}
+
+	if result.SecretString == nil {
+		slog.Error("Secret value is nil")
+		return
+	}
+
+	// Get secret string
+	secretString := *result.SecretString
+	slog.Debug("Retrieved secret string", "length", len(secretString))
+
+	// Use as is if plain text
+	if !strings.HasPrefix(secretString, "{") {
+		slackToken = secretString
+		slog.Debug("Using plain text secret as token")
+		return
+	}
+
+	// Parse as JSON
+	var secretMap map[string]interface{}
+	if err := json.Unmarshal([]byte(secretString), &secretMap); err != nil {
+		// If not JSON, use entire string as token
+		slog.Debug("Secret is not in JSON format, using as plain token")
+		slackToken = secretString
+		return
+	}
+
+	// If parsed as JSON, look for token
+	if token, ok := secretMap["token"].(string); ok && token != "" {
+		slackToken = token
+	} else if token, ok := secretMap["slack_token"].(string); ok && token != "" {
+		slackToken = token
+	} else if token, ok := secretMap["SLACK_TOKEN"].(string); ok && token != "" {
+		slackToken = token
+	} else {
+		// If key not found or value is empty
+		slog.Warn("Token not found in secret JSON, using entire secret as token")
+		slackToken = secretString
+	}
+
+	if slackToken == "DUMMY" || slackToken == "" {
+		slog.Warn("Retrieved token is empty or DUMMY value")
+		return
+	}
+
+	slog.Info("Retrieved Slack token", "length", len(slackToken))
+}
+
+func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	ctx, span := startRequestSpan(ctx, "handler", attribute.String("http.path", req.Path))
+	defer span.End()
+	slog.DebugContext(ctx, "Received request", "path", req.Path, "body", req.Body)
+
+	// JSON API for programmatic access (not Slack)
+	if isAPIRequest(req) {
+		return handleAPIRequest(ctx, req)
+	}
+
+	if retryNum := req.Headers["X-Slack-Retry-Num"]; retryNum != "" {
+		slog.InfoContext(ctx, "Slack retry ignored", "retry_num", retryNum, "reason", req.Headers["X-Slack-Retry-Reason"])
+		putCount(ctx, "DedupeHits", map[string]string{"Kind": "slack_retry"})
+		return response(200, "retry ignored"), nil
+	}
+
+	// Log environment variable settings
+	slog.DebugContext(ctx, "Env config", "show_sql_in_slack", showSqlInSlack, "show_query_id_in_slack", showQueryIdInSlack)
+
+	body := requestBody(req)
+
+	// Button clicks arrive as form-encoded interactivity payloads
+	if isInteractionRequest(body) {
+		return handleInteraction(ctx, req, body)
+	}
+
+	// Slash commands (/waf) are form-encoded as well
+	if isSlashCommandRequest(req.Headers, body) {
+		return handleSlashCommand(ctx, req, body)
+	}
+
+	// Parse and respond to challenge request
+	_, parseSpan := startSpan(ctx, "slack.parse")
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		endSpan(parseSpan, err.Error())
+		slog.WarnContext(ctx, "Failed to parse payload", "error", err)
+		return response(400, "invalid request"), nil
+	}
+
+	// Respond to Slack URL verification challenge
+	if challenge, ok := payload["challenge"].(string); ok {
+		parseSpan.End()
+		slog.InfoContext(ctx, "Responding to Slack URL verification challenge")
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       challenge,
+		}, nil
+	}
+
+	// Parse event details
+	var wrapper SlackEventWrapper
+	if err := json.Unmarshal([]byte(body), &wrapper); err != nil {
+		endSpan(parseSpan, err.Error())
+		slog.WarnContext(ctx, "Failed to parse SlackEventWrapper", "error", err)
+		return response(400, "invalid event format"), nil
+	}
+	parseSpan.SetAttributes(attribute.String("slack.event_id", wrapper.EventID), attribute.String("slack.event_type", wrapper.Event.Type))
+	parseSpan.End()
+	ctx = withLogAttrs(ctx, "event_id", wrapper.EventID, "user", wrapper.Event.User, "channel", wrapper.Event.Channel)
+
+	// Check request type - only event_callback is supported
+	if wrapper.Type != "event_callback" {
+		slog.DebugContext(ctx, "Ignoring non-event callback request", "type", wrapper.Type)
+		return response(200, "ignored"), nil
+	}
+
+	// Check event type - ignore non-message events
+	if wrapper.Event.Type != "message" && wrapper.Event.Type != "app_mention" {
+		slog.DebugContext(ctx, "Ignoring non-message event", "event_type", wrapper.Event.Type)
+		return response(200, "ignored non-message event"), nil
+	}
+
+	// Ignore bot's own messages (prevent reply loop)
+	if wrapper.Event.User == "U08N7NYBPAL" {
+		slog.DebugContext(ctx, "Ignoring bot's own message")
+		return response(200, "ignored bot message"), nil
+	}
+
+	// Check for duplicate events
+	if wrapper.EventID != "" {
+		// Stricter check: combine event ID and request body hash
+		eventKey := wrapper.EventID + "_" + wrapper.Event.Text + "_" + wrapper.Event.Channel
+
+		if !markEventProcessed(eventKey) {
+			slog.InfoContext(ctx, "Ignoring duplicate event", "text", wrapper.Event.Text)
+			putCount(ctx, "DedupeHits", map[string]string{"Kind": "event"})
+			return response(200, "duplicate event"), nil
+		}
+		slog.DebugContext(ctx, "Marking event as processed")
+	}
+
+	// Output additional event info to log (for debugging)
+	slog.InfoContext(ctx, "Processing event", "event_type", wrapper.Event.Type, "text", wrapper.Event.Text)
+
+	// Get text and remove bot mention
+	text := strings.TrimSpace(wrapper.Event.Text)
+	text = strings.ReplaceAll(text, "<@U08N7NYBPAL>", "")
+	text = strings.TrimSpace(text)
+
+	// Ignore empty or too short messages
+	if text == "" || len(text) < 3 {
+		slog.DebugContext(ctx, "Ignoring empty or too short message")
+		return response(200, "ignored empty message"), nil
+	}
+
+	// Check for duplicate query execution in short time (within 5 seconds)
+	queryKey := wrapper.Event.Channel + ":" + text
+	if timeSince, duplicate := markQueryRecent(queryKey, 5*time.Second); duplicate {
+		slog.InfoContext(ctx, "Ignoring duplicate query", "text", text, "seconds_ago", timeSince.Seconds())
+		putCount(ctx, "DedupeHits", map[string]string{"Kind": "query"})
+		return response(200, "duplicate query ignored"), nil
+	}
+
+	slog.InfoContext(ctx, "Processing query", "text", text)
+
+	ctx = withAuditSource(ctx, "mention", wrapper.TeamID)
+
+	// The answer (or a clarifying question) is posted in the thread of the mention
+	threadTS := wrapper.Event.ThreadTS
+	if threadTS == "" {
+		threadTS = wrapper.Event.TS
+	}
+	ctx = withThread(ctx, threadTS)
+
+	answerQuestion(ctx, wrapper.Event.Channel, wrapper.Event.User, text)
+	return response(200, "ok"), nil
+}
+
+// answerQuestion runs the question pipeline (prompt, SQL generation, Athena, analysis) and posts the answer to Slack
+func answerQuestion(ctx context.Context, channel, user, text string) {
+	answerRequest(ctx, channel, user, text, accessAsk)
+}
+
+// answerRequest answers a question (ask, export) or runs raw SQL (sql) for a Slack user after checking the access policy
+func answerRequest(ctx context.Context, channel, user, text, kind string) {
+	// Every request leaves an audit record, whatever its outcome
+	audit := newAuditRecord(ctx, channel, user, kind, text)
+	audit.PromptVersion, audit.ModelID = promptVersion, bedrockModelID
+	started := time.Now()
+	ctx, span := startSpan(ctx, "answer", attribute.String("kind", kind))
+	defer func() {
+		span.SetAttributes(attribute.String("outcome", audit.Outcome), attribute.String("athena.query_id", audit.QueryID))
+		if audit.Outcome == "error" {
+			endSpan(span, audit.Error)
+		} else {
+			span.End()
+		}
+		writeAudit(audit)
+		putMetrics(ctx, map[string]string{"Kind": kind, "Outcome": audit.Outcome},
+			metric{Name: "EndToEndLatency", Unit: unitMilliseconds, Value: milliseconds(time.Since(started))})
+	}()
+
+	grant := authorize(user, channel)
+	if !grant.allowsKind(kind) {
+		denyAccess(&audit, fmt.Sprintf("%s requests are not enabled for you in this channel", kind))
+		return
+	}
+
+	// Refuse questions about targets the user cannot query before calling Bedrock
+	fanOutQuestion := kind != accessSQL && isFanOutQuestion(text)
+	if kind != accessSQL && !fanOutQuestion {
+		if target, ok := targetForQuestion(text); ok && !grant.allowsTarget(target) {
+			denyAccess(&audit, fmt.Sprintf("the `%s` WAF is not available to you here", target.Name))
+			return
+		}
+	}
+
+	// Ambiguous mentions get a clarifying reply in thread; only the answer that follows the user's choices is rate limited and counted
+	tokensBefore := bedrockTokensUsed.Load()
+	if kind == accessAsk && audit.Source == "mention" && requestClarification(ctx, grant, channel, user, text) {
+		audit.Outcome = "clarify"
+		// Bedrock tokens spent deciding what is missing still count towards the daily quota
+		recordUsage(user, channel, usage{BedrockTokens: bedrockTokensUsed.Load() - tokensBefore})
+		return
+	}
+
+	// Rate limits and daily quotas (questions, Bedrock tokens, Athena bytes scanned)
+	if msg := checkRateLimits(user, channel); msg != "" {
+		audit.Outcome, audit.Error = "limited", msg
+		postEphemeral(channel, user, "Sorry, "+msg)
+		return
+	}
+	defer func() {
+		recordUsage(user, channel, usage{Questions: 1, BedrockTokens: bedrockTokensUsed.Load() - tokensBefore, ScannedBytes: audit.DataScannedBytes})
+	}()
+
+	// Dates in the question and in the answer use the user's timezone
+	loc := userLocation(user)
+
+	// Generate SQL (vetted template when one fits, free-form otherwise)
+	sql, templateName, question := text, "", text
+	if kind == accessSQL {
+		question = ""
+	} else {
+		var err error
+		if sql, templateName, err = generateSQL(ctx, text, loc); err != nil {
+			slog.ErrorContext(ctx, "SQL generation failed", "error", err)
+			putCount(ctx, "SQLGenerationFailures", map[string]string{"Class": "bedrock"})
+			audit.Outcome, audit.Error = "error", err.Error()
+			audit.MessageTS, _ = postToSlackWithTS(ctx, channel, "Sorry, the question could not be turned into SQL right now. Please try again later.")
+			return
+		}
+	}
+	slog.InfoContext(ctx, "Generated SQL", "sql", sql, "template", templateName)
+	audit.Template, audit.GeneratedSQL = templateName, sql
+	audit.PreprocessedSQL = preprocessSqlQuery(sql)
+
+	// Fan-out queries are checked per target when the generated query reads a single registered table;
+	// queries that cannot fan out run once and need access to every table they read
+	reason := grant.checkQueryAccess(sql)
+	if _, ok := fanOutSource(sql); ok && fanOutQuestion && !isLogsInsightsQuery(sql) {
+		reason = ""
+	}
+	if reason != "" {
+		denyAccess(&audit, reason)
+		return
+	}
+
+	// Detect region from query
+	queryRegion := getQueryRegion(sql)
+
+	// Execute Athena query (on every permitted target when the question asks for all WAFs)
+	qid, rows, errMsg, stats, fanOut := runQuestionQuery(ctx, question, sql, grant.allowsTarget)
+	targetNames := resultTargetNames(sql, stats, fanOut)
+	audit.QueryID, audit.Region, audit.Target = qid, stats.Region, strings.Join(targetNames, ",")
+	audit.DataScannedBytes, audit.Rows = stats.DataScannedBytes, max(len(rows)-1, 0)
+
+	// Generate console URL
+	consoleUrl := fmt.Sprintf("https://ap-northeast-1.console.aws.amazon.com/athena/home?region=ap-northeast-1#/query-editor/history/%s", qid)
+	// Change URL for US-EAST region
+	if queryRegion == "us-east-1" {
+		consoleUrl = fmt.Sprintf("https://us-east-1.console.aws.amazon.com/athena/home?region=us-east-1#/query-editor/history/%s", qid)
+		slog.DebugContext(ctx, "Adjusted console URL for us-east-1 region", "url", consoleUrl)
+	}
+	// Only Athena queries have a console page
+	hasConsoleUrl := isAthenaBackend() && !isLogsInsightsQuery(sql) && fanOut == nil
+
+	// Results, the question and the SQL are shown redacted by the rules of the targets and the channel
+	redaction := redactionFor(targetNames, channel)
+
+	// Error handling
+	if errMsg != "" {
+		detailedError := fmt.Sprintf("Query failed (region: %s): %s\n\n", queryRegion, errMsg)
+
+		// Always show SQL for debugging on error
+		detailedError += fmt.Sprintf("Executed SQL:\n```\n%s\n```\n\n", redaction.redactValue(sql))
+		if hasConsoleUrl {
+			detailedError += fmt.Sprintf("Athena Console: %s", consoleUrl)
+		}
+
+		slog.WarnContext(ctx, "Query failed", "query_id", qid, "region", queryRegion, "error", errMsg)
+		if kind != accessSQL {
+			putCount(ctx, "SQLGenerationFailures", map[string]string{"Class": classifyQueryError(errMsg)})
+		}
+		audit.Outcome, audit.Error = "error", errMsg
+		audit.MessageTS, _ = postToSlackWithTS(ctx, channel, detailedError)
+		return
+	}
+
+	// Row and scanned bytes limits of the access policy
+	rows, reason = grant.applyResultLimits(rows, stats)
+	if reason != "" {
+		denyAccess(&audit, reason)
+		return
+	}
+
+	// Redact IPs, query strings and sensitive columns before anything is displayed, exported or analyzed
+	// (block proposals keep the raw source IPs)
+	rawRows := rows
+	rows = redactRows(rows, redaction)
+
+	// Output on success
+	audit.Outcome, audit.Rows = "success", max(len(rows)-1, 0)
+	var resultMessage strings.Builder
+	resultMessage.WriteString(fmt.Sprintf("*WAF Log Search Result*\n\n"))
+
+	// Decide whether to show SQL based on environment variable
+	if showSqlInSlack {
+		// Shorten prompt if too long
+		displayText := truncateText(redaction.redactValue(text), 100)
+		resultMessage.WriteString(fmt.Sprintf("*Input Prompt:*\n```\n%s\n```\n\n", displayText))
+		if templateName != "" {
+			resultMessage.WriteString(fmt.Sprintf("*Query Template:* `%s`\n", templateName))
+		}
+		resultMessage.WriteString(fmt.Sprintf("*Executed Query:*\n```\n%s\n```\n\n", redaction.redactValue(sql)))
+	}
+
+	// Row count info
+	resultMessage.WriteString(fmt.Sprintf("*Result:* %d rows", len(rows)-1)) // Exclude header row
+	if cacheStatus := describeCacheStatus(stats); cacheStatus != "" {
+		resultMessage.WriteString(fmt.Sprintf(" (%s)", cacheStatus))
+	}
+	resultMessage.WriteString("\n")
+	if fanOut != nil {
+		resultMessage.WriteString("*Targets:*\n" + formatFanOutSummary(fanOut))
+	}
+	if showQueryIdInSlack {
+		resultMessage.WriteString(fmt.Sprintf("*Athena QueryID:* `%s`\n", qid))
+		if hasConsoleUrl {
+			resultMessage.WriteString(fmt.Sprintf("*Console URL:* %s\n\n", consoleUrl))
+		}
+	}
+
+	// Exports are uploaded as a CSV file instead of a table and analysis
+	if kind == accessExport {
+		// The file holds the whole result, read from the query's output location with the target's role
+		exportRows := rows
+		if hasConsoleUrl {
+			target, _ := findTarget(stats.Target)
+			if full, err := fetchQueryResultCSV(ctx, stats.Region, qid, target); err != nil {
+				slog.WarnContext(ctx, "Failed to read the full result, exporting the first page", "error", err)
+			} else if full, reason := grant.applyResultLimits(full, stats); reason == "" {
+				exportRows = redactRows(full, redaction)
+				audit.Rows = max(len(exportRows)-1, 0)
+			}
+		}
+		if err := uploadFileToSlack(channel, "waf-export.csv", "WAF log export", []byte(formatRowsCSV(localizeRows(exportRows, loc)))); err != nil {
+			slog.ErrorContext(ctx, "Failed to upload export", "error", err)
+			resultMessage.WriteString(fmt.Sprintf("Failed to upload the export: %v", err))
+		} else {
+			resultMessage.WriteString("*Export:* uploaded as `waf-export.csv`")
+		}
+		ts, err := postToSlackWithTS(ctx, channel, resultMessage.String())
+		if err != nil {
+			slog.ErrorContext(ctx, "Slack send error", "error", err)
+		}
+		audit.MessageTS = ts
+		return
+	}
+
+	// Add result table (using formatAthenaResults)
+	if len(rows) > 1 { // At least one row (header exists)
+		resultMessage.WriteString("*Result Data:*\n")
+		resultMessage.WriteString(formatAthenaResultsIn(rows, loc))
+	} else {
+		resultMessage.WriteString("*Result Data:* No data available")
+	}
+
+	// Add analysis result
+	analysisResult := analyzeResults(ctx, sql, rows, text)
+	resultMessage.WriteString(fmt.Sprintf("\n*Analysis Result:*\n%s", analysisResult))
+
+	// Log region info
+	slog.DebugContext(ctx, "Sending answer to Slack", "region", queryRegion, "size", resultMessage.Len())
+
+	// Send to Slack
+	ts, err := postToSlackWithTS(ctx, channel, resultMessage.String())
+	audit.MessageTS = ts
+	if err != nil {
+		slog.ErrorContext(ctx, "Slack send error", "error", err)
+	} else {
+		slog.InfoContext(ctx, "Answer sent to Slack", "query_id", qid, "region", queryRegion, "rows", max(len(rows)-1, 0))
+	}
+
+	// Offer approval-gated blocking of source IPs found in the result
+	if ipSetConfigured() && grant.allowsKind(accessBlock) {
+		if ips := extractSourceIPs(rawRows); len(ips) > 0 {
+			if err := postBlockProposal(channel, ips, redaction); err != nil {
+				slog.ErrorContext(ctx, "Failed to post block proposal", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SlackInteraction is the payload Slack sends when a user clicks a Block Kit element
+type SlackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Team struct {
+		ID string `json:"id"`
+	} `json:"team"`
+	Message struct {
+		TS string `json:"ts"`
+	} `json:"message"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		BlockID  string `json:"block_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	// Current values of the message's inputs, by block ID and action ID
+	State struct {
+		Values map[string]map[string]struct {
+			SelectedOption *struct {
+				Value string `json:"value"`
+			} `json:"selected_option"`
+		} `json:"values"`
+	} `json:"state"`
+}
+
+// selectedOptions returns the selected values of the select menus in a block, by action ID
+func (i SlackInteraction) selectedOptions(blockID string) map[string]string {
+	selected := make(map[string]string)
+	for actionID, v := range i.State.Values[blockID] {
+		if v.SelectedOption != nil {
+			selected[actionID] = v.SelectedOption.Value
+		}
+	}
+	return selected
+}
+
+// requestBody returns the request body, decoding it when API Gateway delivered it base64-encoded
+func requestBody(req events.APIGatewayProxyRequest) string {
+	if !req.IsBase64Encoded {
+		return req.Body
+	}
+	decoded, err := base64.StdEncoding.DecodeString(req.Body)
+	if err != nil {
+		slog.Warn("Failed to decode base64 body", "error", err)
+		return req.Body
+	}
+	return string(decoded)
+}
+
+// isInteractionRequest determines whether the request is a Slack interactivity payload (form-encoded)
+func isInteractionRequest(body string) bool {
+	return strings.HasPrefix(body, "payload=")
+}
+
+// handleInteraction processes button clicks from Slack Block Kit messages
+func handleInteraction(ctx context.Context, req events.APIGatewayProxyRequest, body string) (events.APIGatewayProxyResponse, error) {
+	// Interactions can change WAF configuration, so the request must be signed by Slack
+	if !verifySlackSignature(req.Headers, body) {
+		slog.WarnContext(ctx, "Rejecting interaction with invalid Slack signature")
+		return response(401, "invalid signature"), nil
+	}
+
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse interaction form", "error", err)
+		return response(400, "invalid request"), nil
+	}
+
+	var interaction SlackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &interaction); err != nil {
+		slog.WarnContext(ctx, "Failed to parse interaction payload", "error", err)
+		return response(400, "invalid payload"), nil
+	}
+
+	if interaction.Type != "block_actions" || len(interaction.Actions) == 0 {
+		slog.InfoContext(ctx, "Ignoring interaction", "type", interaction.Type)
+		return response(200, "ignored"), nil
+	}
+
+	ctx = withAuditSource(ctx, "button", interaction.Team.ID)
+	ctx = withLogAttrs(ctx, "user", interaction.User.ID, "channel", interaction.Channel.ID)
+	action := interaction.Actions[0]
+	slog.InfoContext(ctx, "Received interaction", "action", action.ActionID, "user", interaction.User.ID, "channel", interaction.Channel.ID)
+
+	switch {
+	case strings.HasPrefix(action.ActionID, "block_"):
+		handleBlockAction(interaction, action.ActionID, action.Value)
+	case action.ActionID == "clarify_submit" || action.ActionID == "clarify_skip":
+		handleClarifyAction(ctx, interaction, action.ActionID, action.Value)
+	case strings.HasPrefix(action.ActionID, "clarify_"):
+		// Choices in the clarification selects are read from the message state when the user submits
+	case action.ActionID == "investigate":
+		// The button carries a pre-filled question (or a reference to it when it names a redacted IP),
+		// answered like a normal mention
+		question, err := resolveButtonValue(action.Value)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to resolve investigate button", "error", err)
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             fmt.Sprintf("Sorry, the question of this button is not available (%v).", err),
+			})
+			break
+		}
+		slog.InfoContext(ctx, "Investigation requested", "user", interaction.User.ID, "question", question)
+		var targets []string
+		if t, ok := targetForQuestion(question); ok {
+			targets = []string{t.Name}
+		}
+		shown := redactionFor(targets, interaction.Channel.ID).redactValue(question)
+		postToSlack(interaction.Channel.ID, fmt.Sprintf("<@%s> is investigating: _%s_", interaction.User.ID, shown))
+		answerLater(ctx, DeferredAnswer{Channel: interaction.Channel.ID, User: interaction.User.ID, Text: question,
+			Kind: accessAsk, Source: "button", Team: interaction.Team.ID})
+	default:
+		slog.WarnContext(ctx, "Unknown action", "action", action.ActionID)
+	}
+
+	return response(200, ""), nil
+}
+
+// handleBlockAction handles the propose / approve / reject buttons of the IP set blocking flow
+func handleBlockAction(interaction SlackInteraction, actionID, value string) {
+	if !ipSetConfigured() {
+		postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          "IP set blocking is not configured.",
+		})
+		return
+	}
+
+	// Requests whose CIDR is redacted in the channel are kept server-side
+	value, err := resolveButtonValue(value)
+	if err != nil {
+		slog.Warn("Failed to resolve block button", "error", err)
+		postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+			"response_type":    "ephemeral",
+			"replace_original": false,
+			"text":             fmt.Sprintf("Sorry, this block request is not available (%v).", err),
+		})
+		return
+	}
+	var req BlockRequest
+	if err := json.Unmarshal([]byte(value), &req); err != nil {
+		slog.Warn("Invalid block request value", "error", err)
+		return
+	}
+
+	userID := interaction.User.ID
+	channel := interaction.Channel.ID
+
+	switch {
+	case strings.HasPrefix(actionID, "block_propose_"):
+		// Users with block access may propose, the approval message is posted to the channel
+		if !authorize(userID, channel).allowsKind(accessBlock) {
+			writeAudit(AuditRecord{Source: "button", Team: interaction.Team.ID, User: userID, Channel: channel, Kind: accessBlock,
+				Question: "propose block " + req.CIDR, Outcome: "denied", Error: "block proposals are not enabled"})
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             "Sorry, proposing blocks is not enabled for you in this channel. Please ask a WAF admin if you need access.",
+			})
+			return
+		}
+		req.RequestedBy = userID
+		blocks, err := approvalRequestBlocks(req)
+		if err == nil {
+			err = postBlocksToSlack(channel, fmt.Sprintf("Block proposal for %s", req.display()), blocks)
+		}
+		if err != nil {
+			slog.Warn("Failed to post approval request", "error", err)
+		}
+
+	case strings.HasPrefix(actionID, "block_approve_"):
+		if !isBlockApprover(userID) {
+			slog.Warn("User is not allowed to approve blocks", "user", userID)
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             "You are not a member of the approver group for WAF blocks.",
+			})
+			return
+		}
+		if userID == req.RequestedBy {
+			slog.Warn("Requester tried to approve their own block", "user", userID, "cidr", req.CIDR)
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"response_type":    "ephemeral",
+				"replace_original": false,
+				"text":             "A block must be approved by someone other than the requester.",
+			})
+			return
+		}
+
+		record, err := approveBlock(req, userID, channel)
+		if err != nil {
+			slog.Error("Block failed", "error", err)
+			writeAudit(AuditRecord{Source: "button", Team: interaction.Team.ID, User: userID, Channel: channel, Kind: accessBlock,
+				Question: "approve block " + req.CIDR, Outcome: "error", Error: err.Error()})
+			postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+				"replace_original": false,
+				"text":             fmt.Sprintf("Failed to block `%s`: %v", req.display(), err),
+			})
+			return
+		}
+
+		writeAudit(AuditRecord{Source: "button", Team: interaction.Team.ID, User: userID, Channel: channel, Kind: accessBlock,
+			Question: "approve block " + req.CIDR, Target: record.IPSetName, Outcome: "success"})
+
+		expiry := "permanent"
+		if record.ExpiresAt > 0 {
+			expiry = fmt.Sprintf("expires <!date^%d^{date_short_pretty} {time}|%s>", record.ExpiresAt, time.Unix(record.ExpiresAt, 0).UTC().Format(time.RFC3339))
+		}
+		postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+			"replace_original": true,
+			"text": fmt.Sprintf(":no_entry: `%s` added to WAF IP set `%s` (%s).\nRequested by <@%s>, approved by <@%s>.",
+				req.display(), record.IPSetName, expiry, record.RequestedBy, record.ApprovedBy),
+		})
+
+	case actionID == "block_reject":
+		if !isBlockApprover(userID) && userID != req.RequestedBy {
+			slog.Warn("User is not allowed to reject block", "user", userID, "cidr", req.CIDR)
+			writeAudit(AuditRecord{Source: "button", Team: interaction.Team.ID, User: userID, Channel: channel, Kind: accessBlock,
+				Question: "reject block " + req.CIDR, Outcome: "denied", Error: "not an approver or the requester"})
+			return
+		}
+		slog.Info("Block rejected", "cidr", req.CIDR, "rejected_by", userID)
+		writeAudit(AuditRecord{Source: "button", Team: interaction.Team.ID, User: userID, Channel: channel, Kind: accessBlock,
+			Question: "reject block " + req.CIDR, Outcome: "success"})
+		postToResponseURL(interaction.ResponseURL, map[string]interface{}{
+			"replace_original": true,
+			"text":             fmt.Sprintf("Block proposal for `%s` was rejected by <@%s>.", req.display(), userID),
+		})
+	}
+}
@@ -0,0 +1,526 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+)
+
+// IP set blocking configuration (feature is disabled unless WAF_IPSET_ID is set)
+var (
+	ipSetID    = os.Getenv("WAF_IPSET_ID")
+	ipSetName  = os.Getenv("WAF_IPSET_NAME")
+	ipSetScope = envOrDefault("WAF_IPSET_SCOPE", "REGIONAL") // REGIONAL or CLOUDFRONT
+	// CLOUDFRONT scope IP sets can only be managed from us-east-1
+	ipSetRegion = envOrDefault("WAF_IPSET_REGION", "ap-northeast-1")
+	// Slack user group (ID like S0123ABCD) whose members may approve blocks
+	blockApproverGroup = os.Getenv("BLOCK_APPROVER_USERGROUP")
+	// DynamoDB table recording approved blocks (partition key: cidr), required for timed expiry
+	blockRecordTable = os.Getenv("BLOCK_RECORD_TABLE")
+	// Maximum number of IPs offered for blocking per result
+	maxBlockCandidates = 3
+)
+
+// Retry count for UpdateIPSet when another writer changed the IP set (lock token mismatch)
+const ipSetUpdateRetries = 3
+
+// BlockRequest is the value carried by the block proposal / approval buttons
+type BlockRequest struct {
+	CIDR        string `json:"cidr"`
+	Label       string `json:"label,omitempty"` // The CIDR as shown in the channel when its redaction rule masks IPs
+	RequestedBy string `json:"requested_by,omitempty"`
+	TTLHours    int    `json:"ttl_hours,omitempty"` // 0 means permanent
+}
+
+// BlockRecord is the DynamoDB item stored for an approved block
+type BlockRecord struct {
+	CIDR        string `json:"cidr" dynamodbav:"cidr"`
+	IPSetID     string `json:"ipset_id" dynamodbav:"ipset_id"`
+	IPSetName   string `json:"ipset_name" dynamodbav:"ipset_name"`
+	Scope       string `json:"scope" dynamodbav:"scope"`
+	RequestedBy string `json:"requested_by" dynamodbav:"requested_by"`
+	ApprovedBy  string `json:"approved_by" dynamodbav:"approved_by"`
+	ApprovedAt  string `json:"approved_at" dynamodbav:"approved_at"`
+	Channel     string `json:"channel" dynamodbav:"channel"`
+	Label       string `json:"label,omitempty" dynamodbav:"label,omitempty"` // The CIDR as shown in the channel
+	ExpiresAt   int64  `json:"expires_at" dynamodbav:"expires_at"`           // Unix seconds, 0 means permanent
+	// The CIDR was in the IP set before the first approval, so expiry leaves it there
+	PreExisting bool `json:"pre_existing,omitempty" dynamodbav:"pre_existing,omitempty"`
+}
+
+// ipSetConfigured reports whether IP set blocking is enabled
+func ipSetConfigured() bool {
+	return ipSetID != "" && ipSetName != ""
+}
+
+// getWAFClient creates a WAFv2 client for the IP set region
+func getWAFClient() *wafv2.WAFV2 {
+	return wafv2.New(instrumentSession(session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(ipSetRegion),
+	}))))
+}
+
+// getDynamoClient creates a DynamoDB client in the Lambda's region
+func getDynamoClient() *dynamodb.DynamoDB {
+	return dynamodb.New(instrumentSession(session.Must(session.NewSession())))
+}
+
+// extractSourceIPs picks distinct IP addresses from the first IP-like column of the results
+func extractSourceIPs(rows []*athena.Row) []string {
+	if len(rows) < 2 {
+		return nil
+	}
+
+	// Find a column whose name mentions "ip" (source_ip, client_ip, ip ...)
+	ipCol := -1
+	for i, data := range rows[0].Data {
+		if data.VarCharValue != nil && strings.Contains(strings.ToLower(*data.VarCharValue), "ip") {
+			ipCol = i
+			break
+		}
+	}
+	if ipCol < 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var ips []string
+	for _, row := range rows[1:] {
+		if ipCol >= len(row.Data) || row.Data[ipCol].VarCharValue == nil {
+			continue
+		}
+		value := strings.TrimSpace(*row.Data[ipCol].VarCharValue)
+		if net.ParseIP(value) == nil || seen[value] {
+			continue
+		}
+		seen[value] = true
+		ips = append(ips, value)
+		if len(ips) >= maxBlockCandidates {
+			break
+		}
+	}
+	return ips
+}
+
+// hostCIDR returns the single-address CIDR for an IP (/32 or /128)
+func hostCIDR(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// networkCIDR returns the enclosing network of an IP (/24 for IPv4, /64 for IPv6)
+func networkCIDR(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// display returns the CIDR as it may be shown in the channel of the request
+func (r BlockRequest) display() string {
+	if r.Label != "" {
+		return r.Label
+	}
+	return r.CIDR
+}
+
+// buttonValue encodes a block request as a button value. Requests whose CIDR is redacted in the channel
+// are kept server-side and the button carries a reference.
+func buttonValue(req BlockRequest) (string, error) {
+	b, _ := json.Marshal(req)
+	if req.Label == "" {
+		return string(b), nil
+	}
+	return storeButtonValue(string(b))
+}
+
+// blockRequestFor builds the request for a CIDR as displayed under a redaction rule
+func blockRequestFor(cidr string, rule RedactionRule) BlockRequest {
+	req := BlockRequest{CIDR: cidr}
+	if label := rule.displayCIDR(cidr); label != cidr {
+		req.Label = label
+	}
+	return req
+}
+
+// postBlockProposal offers "Block this IP" buttons for the source IPs found in a result.
+// Buttons show the IPs redacted by rule, the redaction rule of the channel.
+func postBlockProposal(channel string, ips []string, rule RedactionRule) error {
+	blocks := []map[string]interface{}{
+		{
+			"type": "section",
+			"text": map[string]interface{}{
+				"type": "mrkdwn",
+				"text": fmt.Sprintf("*Response:* the result contains source IPs. Propose adding one to WAF IP set `%s`? (approval required)", ipSetName),
+			},
+		},
+	}
+
+	for i, ip := range ips {
+		var buttons []map[string]interface{}
+		for _, b := range []struct{ actionID, cidr string }{
+			{"block_propose_host", hostCIDR(ip)},
+			{"block_propose_network", networkCIDR(ip)},
+		} {
+			req := blockRequestFor(b.cidr, rule)
+			value, err := buttonValue(req)
+			if err != nil {
+				return err
+			}
+			buttons = append(buttons, slackButton("Block "+req.display(), b.actionID, value, ""))
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "actions",
+			"block_id": fmt.Sprintf("block_ip_%d", i),
+			"elements": buttons,
+		})
+	}
+
+	return postBlocksToSlack(channel, "Source IPs can be blocked from this result", blocks)
+}
+
+// slackButton builds a Block Kit button element (style may be "", "primary" or "danger")
+func slackButton(text, actionID, value, style string) map[string]interface{} {
+	button := map[string]interface{}{
+		"type":      "button",
+		"text":      map[string]interface{}{"type": "plain_text", "text": text},
+		"action_id": actionID,
+		"value":     value,
+	}
+	if style != "" {
+		button["style"] = style
+	}
+	return button
+}
+
+// approvalRequestBlocks builds the approval message shown after a block is proposed
+func approvalRequestBlocks(req BlockRequest) ([]map[string]interface{}, error) {
+	approvers := "authorized approvers"
+	if blockApproverGroup != "" {
+		approvers = fmt.Sprintf("<!subteam^%s>", blockApproverGroup)
+	}
+
+	// Timed blocks are only offered when expiry can be tracked
+	var buttons []map[string]interface{}
+	if blockRecordTable != "" {
+		for _, ttl := range []int{1, 24, 24 * 7} {
+			r := req
+			r.TTLHours = ttl
+			value, err := buttonValue(r)
+			if err != nil {
+				return nil, err
+			}
+			buttons = append(buttons, slackButton("Approve ("+formatTTL(ttl)+")", fmt.Sprintf("block_approve_%d", ttl), value, "primary"))
+		}
+	}
+	r := req
+	r.TTLHours = 0
+	approveValue, err := buttonValue(r)
+	if err != nil {
+		return nil, err
+	}
+	rejectValue, err := buttonValue(req)
+	if err != nil {
+		return nil, err
+	}
+	buttons = append(buttons, slackButton("Approve (permanent)", "block_approve_0", approveValue, "primary"))
+	buttons = append(buttons, slackButton("Reject", "block_reject", rejectValue, "danger"))
+
+	return []map[string]interface{}{
+		{
+			"type": "section",
+			"text": map[string]interface{}{
+				"type": "mrkdwn",
+				"text": fmt.Sprintf("<@%s> proposes blocking `%s` via WAF IP set `%s` (%s).\nApproval required from %s.",
+					req.RequestedBy, req.display(), ipSetName, ipSetScope, approvers),
+			},
+		},
+		{
+			"type":     "actions",
+			"block_id": "block_approval",
+			"elements": buttons,
+		},
+	}, nil
+}
+
+// formatTTL formats a block duration in hours for display
+func formatTTL(hours int) string {
+	if hours == 0 {
+		return "permanent"
+	}
+	if hours%24 == 0 {
+		return fmt.Sprintf("%dd", hours/24)
+	}
+	return fmt.Sprintf("%dh", hours)
+}
+
+// isBlockApprover checks whether a Slack user belongs to the approver user group
+func isBlockApprover(userID string) bool {
+	if blockApproverGroup == "" {
+		slog.Warn("BLOCK_APPROVER_USERGROUP is not set, nobody can approve blocks")
+		return false
+	}
+
+	members, err := getUserGroupMembers(blockApproverGroup)
+	if err != nil {
+		slog.Warn("Failed to get approver group members", "error", err)
+		return false
+	}
+	for _, m := range members {
+		if m == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyIPSet adds and removes addresses in the configured IP set, retrying on lock token conflicts.
+// It returns the addresses of add that were already in the IP set.
+func modifyIPSet(add, remove []string) ([]string, error) {
+	client := getWAFClient()
+
+	for attempt := 1; attempt <= ipSetUpdateRetries; attempt++ {
+		current, err := client.GetIPSet(&wafv2.GetIPSetInput{
+			Id:    aws.String(ipSetID),
+			Name:  aws.String(ipSetName),
+			Scope: aws.String(ipSetScope),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get IP set: %v", err)
+		}
+
+		// Build the new address list (IP set addresses are a full replacement)
+		removeSet := make(map[string]bool)
+		for _, r := range remove {
+			removeSet[r] = true
+		}
+		existing := make(map[string]bool)
+		var addresses []*string
+		for _, a := range current.IPSet.Addresses {
+			if a == nil || removeSet[*a] {
+				continue
+			}
+			existing[*a] = true
+			addresses = append(addresses, a)
+		}
+		var present []string
+		for _, a := range add {
+			if existing[a] {
+				present = append(present, a)
+			} else {
+				addresses = append(addresses, aws.String(a))
+			}
+		}
+
+		_, err = client.UpdateIPSet(&wafv2.UpdateIPSetInput{
+			Id:          aws.String(ipSetID),
+			Name:        aws.String(ipSetName),
+			Scope:       aws.String(ipSetScope),
+			Addresses:   addresses,
+			LockToken:   current.LockToken,
+			Description: current.IPSet.Description,
+		})
+		if err == nil {
+			slog.Info("Updated IP set", "ip_set", ipSetName, "added", add, "removed", remove, "already_present", present, "attempt", attempt)
+			return present, nil
+		}
+
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == wafv2.ErrCodeWAFOptimisticLockException {
+			slog.Info("IP set lock token was stale, retrying", "attempt", attempt)
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+			continue
+		}
+		return nil, fmt.Errorf("failed to update IP set: %v", err)
+	}
+
+	return nil, fmt.Errorf("failed to update IP set: lock conflict persisted after %d attempts", ipSetUpdateRetries)
+}
+
+// approveBlock adds the CIDR to the IP set and records who approved it
+func approveBlock(req BlockRequest, approver, channel string) (BlockRecord, error) {
+	record := BlockRecord{
+		CIDR:        req.CIDR,
+		IPSetID:     ipSetID,
+		IPSetName:   ipSetName,
+		Scope:       ipSetScope,
+		RequestedBy: req.RequestedBy,
+		ApprovedBy:  approver,
+		ApprovedAt:  time.Now().UTC().Format(time.RFC3339),
+		Channel:     channel,
+		Label:       req.Label,
+	}
+	if req.TTLHours > 0 {
+		if blockRecordTable == "" {
+			return record, fmt.Errorf("timed blocks require BLOCK_RECORD_TABLE")
+		}
+		record.ExpiresAt = time.Now().Add(time.Duration(req.TTLHours) * time.Hour).Unix()
+	}
+
+	if _, _, err := net.ParseCIDR(req.CIDR); err != nil {
+		return record, fmt.Errorf("invalid CIDR %q", req.CIDR)
+	}
+
+	// A CIDR blocked by an earlier approval keeps its origin; one added outside this bot is never removed on expiry
+	previous, found, err := getBlockRecord(req.CIDR)
+	if err != nil {
+		return record, err
+	}
+	present, err := modifyIPSet([]string{req.CIDR}, nil)
+	if err != nil {
+		return record, err
+	}
+	if found {
+		record.PreExisting = previous.PreExisting
+		// Re-approving never shortens a block: a permanent one stays permanent and a later expiry wins
+		if previous.ExpiresAt == 0 || (record.ExpiresAt != 0 && previous.ExpiresAt > record.ExpiresAt) {
+			record.ExpiresAt = previous.ExpiresAt
+		}
+	} else {
+		record.PreExisting = len(present) > 0
+	}
+
+	slog.Info("Block approved", "cidr", record.CIDR, "requested_by", record.RequestedBy, "approved_by", record.ApprovedBy,
+		"expires_at", record.ExpiresAt, "pre_existing", record.PreExisting)
+
+	if blockRecordTable != "" {
+		item, err := dynamodbattribute.MarshalMap(record)
+		if err != nil {
+			return record, err
+		}
+		if _, err := getDynamoClient().PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(blockRecordTable),
+			Item:      item,
+		}); err != nil {
+			if record.ExpiresAt == 0 {
+				// A permanent block needs no record to stay correct, so only log the failure
+				slog.Error("Failed to record block approval", "error", err)
+			} else {
+				// Without its record a timed block would never expire, so undo it
+				if !record.PreExisting && !found {
+					if _, rerr := modifyIPSet(nil, []string{req.CIDR}); rerr != nil {
+						slog.Error("Failed to roll back unrecorded block", "cidr", req.CIDR, "error", rerr)
+					}
+				}
+				return record, fmt.Errorf("failed to record timed block: %v", err)
+			}
+		}
+	}
+
+	return record, nil
+}
+
+// getBlockRecord returns the recorded block of a CIDR, if any
+func getBlockRecord(cidr string) (BlockRecord, bool, error) {
+	if blockRecordTable == "" {
+		return BlockRecord{}, false, nil
+	}
+	out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(blockRecordTable),
+		Key:            map[string]*dynamodb.AttributeValue{"cidr": {S: aws.String(cidr)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return BlockRecord{}, false, fmt.Errorf("failed to read block record: %v", err)
+	}
+	var record BlockRecord
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &record); err != nil {
+		return BlockRecord{}, false, err
+	}
+	return record, record.CIDR != "", nil
+}
+
+// expireBlocks removes IP set entries whose timed block has expired
+func expireBlocks() error {
+	if !ipSetConfigured() || blockRecordTable == "" {
+		return nil
+	}
+
+	db := getDynamoClient()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var records []BlockRecord
+	var unmarshalErr error
+	err := db.ScanPages(&dynamodb.ScanInput{
+		TableName:        aws.String(blockRecordTable),
+		FilterExpression: aws.String("expires_at > :zero AND expires_at <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":zero": {N: aws.String("0")},
+			":now":  {N: aws.String(now)},
+		},
+	}, func(page *dynamodb.ScanOutput, last bool) bool {
+		var items []BlockRecord
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		records = append(records, items...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan block records: %v", err)
+	}
+	if unmarshalErr != nil {
+		return unmarshalErr
+	}
+	if len(records) == 0 {
+		slog.Info("No expired blocks found")
+		return nil
+	}
+
+	// CIDRs that were in the IP set before they were approved stay there
+	var cidrs []string
+	for _, r := range records {
+		if !r.PreExisting {
+			cidrs = append(cidrs, r.CIDR)
+		}
+	}
+	if len(cidrs) > 0 {
+		if _, err := modifyIPSet(nil, cidrs); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range records {
+		if _, err := db.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(blockRecordTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"cidr": {S: aws.String(r.CIDR)},
+			},
+		}); err != nil {
+			slog.Warn("Failed to delete block record", "cidr", r.CIDR, "error", err)
+		}
+		if r.Channel != "" {
+			label := r.CIDR
+			if r.Label != "" {
+				label = r.Label
+			}
+			if r.PreExisting {
+				postToSlack(r.Channel, fmt.Sprintf("Block for `%s` expired; it stays in IP set `%s` because it was there before it was approved (approved by <@%s>).",
+					label, r.IPSetName, r.ApprovedBy))
+			} else {
+				postToSlack(r.Channel, fmt.Sprintf("Block for `%s` expired and was removed from IP set `%s` (approved by <@%s>).",
+					label, r.IPSetName, r.ApprovedBy))
+			}
+		}
+	}
+
+	slog.Info("Expired blocks", "count", len(records), "cidrs", cidrs)
+	return nil
+}
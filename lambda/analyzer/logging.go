@@ -0,0 +1,163 @@
+package analyzer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Logging configuration
+var (
+	// Minimum level: debug, info (default), warn or error
+	logLevel = parseLogLevel(os.Getenv("LOG_LEVEL"))
+	// How user text (questions, SQL, message bodies) appears in logs: truncate (default), hash, full or none
+	logUserText = strings.ToLower(envOrDefault("LOG_USER_TEXT", "truncate"))
+
+	// Attributes of the request in flight, added to records logged without a request context
+	// (slog calls without ctx, and log output of libraries). Lambda runs one request per instance; server mode turns this off.
+	requestLogAttrs   atomic.Pointer[[]slog.Attr]
+	requestLogAttrsOn atomic.Bool
+
+	// Logger for audit records, which are written whatever the log level
+	auditLogger *slog.Logger
+)
+
+// Attribute keys that carry user text
+var userTextLogKeys = map[string]bool{"text": true, "question": true, "sql": true, "body": true, "message": true, "params": true}
+
+// Secrets that must never reach the logs (Slack tokens, bearer tokens, keys in JSON or query strings)
+var logSecretPattern = regexp.MustCompile(`xox[abposr]-[A-Za-z0-9-]+|(?i)bearer\s+[A-Za-z0-9._~+/=-]+|(?i)("(?:token|secret|api_key|password)"\s*:\s*")[^"]*|(?i)((?:token|secret|api_key|password)=)[^&\s]+`)
+
+func init() {
+	requestLogAttrsOn.Store(true)
+	setLogOutput(os.Stderr)
+}
+
+// setLogOutput installs the JSON logger writing to w; log.Printf output goes through it as well
+func setLogOutput(w io.Writer) {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: logLevel, ReplaceAttr: redactLogAttr})
+	slog.SetDefault(slog.New(contextLogHandler{handler}))
+	log.SetFlags(0)
+
+	metricsOutputMu.Lock()
+	metricsOutput = w
+	metricsOutputMu.Unlock()
+
+	auditLogger = slog.New(contextLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{ReplaceAttr: redactLogAttr})})
+}
+
+// parseLogLevel parses LOG_LEVEL, defaulting to info
+func parseLogLevel(s string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log records carry the given attributes (key, value pairs),
+// and makes them the attributes of the request in flight
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	var attrs []slog.Attr
+	if existing, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		attrs = append(attrs, existing...)
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		key, _ := args[i].(string)
+		if key == "" || args[i+1] == "" {
+			continue
+		}
+		attrs = append(attrs, slog.Any(key, args[i+1]))
+	}
+
+	if requestLogAttrsOn.Load() {
+		requestLogAttrs.Store(&attrs)
+	}
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// beginRequestLog clears the attributes (and span) of the previous request
+func beginRequestLog() {
+	requestLogAttrs.Store(nil)
+	requestSpan.Store(nil)
+}
+
+// contextLogHandler adds the request attributes of the context (or of the request in flight) to each record
+type contextLogHandler struct {
+	slog.Handler
+}
+
+// Handle adds the request attributes, scrubs secrets from the message and passes the record on
+func (h contextLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	if !ok {
+		if p := requestLogAttrs.Load(); p != nil {
+			attrs = *p
+		}
+	}
+
+	out := slog.NewRecord(r.Time, r.Level, logSecretPattern.ReplaceAllString(r.Message, "$1$2[redacted]"), r.PC)
+	out.AddAttrs(attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(a)
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+// WithAttrs and WithGroup keep the wrapper around derived handlers
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// redactLogAttr applies the user text policy and removes secrets from string attributes
+func redactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if err, ok := a.Value.Any().(error); ok && a.Value.Kind() == slog.KindAny {
+		a.Value = slog.StringValue(err.Error())
+	}
+	if userTextLogKeys[a.Key] && a.Value.Kind() == slog.KindAny {
+		// Values built from user text (template parameters) follow the same policy as the text itself
+		a.Value = slog.StringValue(fmt.Sprint(a.Value.Any()))
+	}
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	v := logSecretPattern.ReplaceAllString(a.Value.String(), "$1$2[redacted]")
+	if userTextLogKeys[a.Key] {
+		v = redactUserText(v)
+	}
+	return slog.String(a.Key, v)
+}
+
+// redactUserText reduces user text according to LOG_USER_TEXT
+func redactUserText(s string) string {
+	switch logUserText {
+	case "full":
+		return s
+	case "none":
+		return fmt.Sprintf("[redacted %d chars]", utf8.RuneCountInString(s))
+	case "hash":
+		sum := sha256.Sum256([]byte(s))
+		return fmt.Sprintf("sha256:%s (%d chars)", hex.EncodeToString(sum[:])[:16], utf8.RuneCountInString(s))
+	default:
+		if utf8.RuneCountInString(s) <= 40 {
+			return s
+		}
+		return fmt.Sprintf("%s... (%d chars)", string([]rune(s)[:40]), utf8.RuneCountInString(s))
+	}
+}
@@ -0,0 +1,555 @@
+package analyzer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+// MCP protocol version implemented by this server
+const mcpProtocolVersion = "2025-03-26"
+
+// mcpRequest is a JSON-RPC 2.0 request or notification (notifications have no id)
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// mcpResponse is a JSON-RPC 2.0 response
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+// mcpError is a JSON-RPC 2.0 error object
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// mcpTool describes a tool in tools/list
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+// mcpToolResult is the result of tools/call
+type mcpToolResult struct {
+	Content []mcpContent `json:"content"`
+	IsError bool         `json:"isError,omitempty"`
+}
+
+// mcpContent is a text content block
+type mcpContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// mcpTools are the tools exposed by the server
+var mcpTools = []mcpTool{
+	{
+		Name:        "generate_waf_sql",
+		Description: "Generate an Athena SQL query over the AWS WAF logs for a natural-language question. Does not run the query.",
+		InputSchema: objectSchema(map[string]string{"question": "Question about WAF traffic"}, "question"),
+	},
+	{
+		Name:        "run_waf_query",
+		Description: "Run a read-only Athena SQL query over the AWS WAF logs and return the result table (max 20 rows).",
+		InputSchema: objectSchema(map[string]string{
+			"sql":    "Read-only SQL query",
+			"format": "Table format: markdown (default), csv, json or text",
+		}, "sql"),
+	},
+	{
+		Name:        "describe_waf_tables",
+		Description: "Describe the registered WAF targets, their Athena tables and main columns.",
+		InputSchema: objectSchema(map[string]string{}),
+	},
+	{
+		Name:        "summarize_results",
+		Description: "Summarize query results for a question. Pass either query_id and region of a finished query, or sql to run.",
+		InputSchema: objectSchema(map[string]string{
+			"question": "The question the results should answer",
+			"query_id": "Athena query ID returned by run_waf_query",
+			"region":   "Region of the query ID",
+			"target":   "Target of the query ID (required for targets with a role_arn)",
+			"sql":      "Read-only SQL query to run instead of query_id",
+		}, "question"),
+	},
+}
+
+// objectSchema builds a JSON schema for an object with string properties
+func objectSchema(properties map[string]string, required ...string) map[string]interface{} {
+	props := make(map[string]interface{}, len(properties))
+	for name, desc := range properties {
+		props[name] = map[string]interface{}{"type": "string", "description": desc}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// runMCPCommand runs the MCP server over stdio or streamable HTTP
+func runMCPCommand(args []string) int {
+	fs := flag.NewFlagSet("mcp", flag.ContinueOnError)
+	transport := fs.String("transport", "stdio", "transport: stdio or http")
+	addr := fs.String("addr", envOrDefault("MCP_LISTEN_ADDR", "127.0.0.1:8808"), "listen address for the http transport")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	switch *transport {
+	case "stdio":
+		// stdout carries protocol messages, so logs must go to stderr
+		setLogOutput(os.Stderr)
+		if err := serveMCPStdio(context.Background(), os.Stdin, os.Stdout); err != nil {
+			slog.Error("MCP stdio server error", "error", err)
+			return 1
+		}
+		return 0
+	case "http":
+		return serveMCPHTTP(*addr)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown transport %q\n", *transport)
+		return 2
+	}
+}
+
+// serveMCPStdio reads newline-delimited JSON-RPC messages from r and writes responses to w
+func serveMCPStdio(ctx context.Context, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	enc := json.NewEncoder(w)
+
+	ctx = withMCPCaller(withAuditSource(ctx, "mcp", ""), localAuditUser())
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if resp := handleMCPMessage(ctx, []byte(line)); resp != nil {
+			if err := enc.Encode(resp); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Browser origins allowed to call the HTTP transport besides loopback ones (requests without Origin are not from browsers)
+var mcpAllowedOrigins = splitList(os.Getenv("MCP_ALLOWED_ORIGINS"))
+
+// serveMCPHTTP serves the streamable HTTP transport on /mcp (JSON responses, no server-initiated streams)
+func serveMCPHTTP(addr string) int {
+	// Without API keys anyone who can reach the port can run queries, so only local clients may
+	if len(apiKeys) == 0 && !isLoopbackAddr(addr) {
+		fmt.Fprintf(os.Stderr, "refusing to listen on %s without API_KEYS; use a loopback address or configure API_KEYS\n", addr)
+		return 2
+	}
+	requestLogAttrsOn.Store(false)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp", handleMCPHTTP)
+	mux.HandleFunc("/healthz", handleHealthz)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("MCP server listening", "url", "http://"+addr+"/mcp")
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("MCP server error", "error", err)
+			return 1
+		}
+		return 0
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("MCP server shutdown error", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// handleMCPHTTP handles one streamable HTTP POST (a single message or a batch)
+func handleMCPHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		// Server-initiated SSE streams are not supported
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A page on another site must not reach a local server through DNS rebinding
+	if !allowedMCPOrigin(r.Header.Get("Origin")) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	caller, ok := authorizeMCPHTTP(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10*1024*1024))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	ctx := withMCPCaller(withAuditSource(r.Context(), "mcp", ""), caller)
+	trimmed := strings.TrimSpace(string(body))
+	batch := []json.RawMessage{body}
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeMCPJSON(w, mcpErrorResponse(nil, -32700, "parse error"))
+			return
+		}
+	}
+	var responses []*mcpResponse
+	initialize := false
+	for _, msg := range batch {
+		var req mcpRequest
+		if json.Unmarshal(msg, &req) == nil && req.Method == "initialize" {
+			initialize = true
+		}
+		if resp := handleMCPMessage(ctx, msg); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+
+	// Notifications and responses only: nothing to return
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if initialize {
+		w.Header().Set("Mcp-Session-Id", newMCPSessionID())
+	}
+	if strings.HasPrefix(trimmed, "[") {
+		writeMCPJSON(w, responses)
+		return
+	}
+	writeMCPJSON(w, responses[0])
+}
+
+// authorizeMCPHTTP checks the bearer token / API key when API_KEYS is configured and returns the caller
+// recorded in audit records (the local user when no keys are configured, since the server then only listens on loopback)
+func authorizeMCPHTTP(r *http.Request) (string, bool) {
+	if len(apiKeys) == 0 {
+		return localAuditUser(), true
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = r.Header.Get("X-Api-Key")
+	}
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return "api-key:" + key[:min(4, len(key))] + "...", true
+		}
+	}
+	return "", false
+}
+
+type mcpCallerKey struct{}
+
+// withMCPCaller attaches the MCP client's identity to a context for the audit record
+func withMCPCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, mcpCallerKey{}, caller)
+}
+
+// mcpAuditRecord starts the audit record of a tool call
+func mcpAuditRecord(ctx context.Context, kind, question string) AuditRecord {
+	caller, _ := ctx.Value(mcpCallerKey{}).(string)
+	record := newAuditRecord(ctx, "", caller, kind, question)
+	record.PromptVersion, record.ModelID = promptVersion, bedrockModelID
+	return record
+}
+
+// allowedMCPOrigin reports whether a request's Origin header is absent, a loopback origin or listed in MCP_ALLOWED_ORIGINS
+func allowedMCPOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, o := range mcpAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && isLoopbackHost(u.Hostname())
+}
+
+// isLoopbackAddr reports whether a listen address only accepts local connections
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && isLoopbackHost(host)
+}
+
+// isLoopbackHost reports whether a host name or IP is the local machine
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newMCPSessionID generates a random session ID
+func newMCPSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeMCPJSON writes a JSON body
+func writeMCPJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// mcpErrorResponse builds a JSON-RPC error response
+func mcpErrorResponse(id json.RawMessage, code int, msg string) *mcpResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &mcpResponse{JSONRPC: "2.0", ID: id, Error: &mcpError{Code: code, Message: msg}}
+}
+
+// handleMCPMessage processes one JSON-RPC message and returns the response (nil for notifications)
+func handleMCPMessage(ctx context.Context, raw []byte) *mcpResponse {
+	var req mcpRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return mcpErrorResponse(nil, -32700, "parse error")
+	}
+	if req.Method == "" {
+		// A response from the client (we never send requests), ignore
+		return nil
+	}
+	if req.ID == nil {
+		slog.DebugContext(ctx, "MCP notification", "method", req.Method)
+		return nil
+	}
+
+	slog.InfoContext(ctx, "MCP request", "method", req.Method)
+	result, rpcErr := dispatchMCPMethod(ctx, req)
+	if rpcErr != nil {
+		return &mcpResponse{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	}
+	return &mcpResponse{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
+
+// dispatchMCPMethod handles the supported MCP methods
+func dispatchMCPMethod(ctx context.Context, req mcpRequest) (interface{}, *mcpError) {
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]interface{}{"name": "waf-bedrock-analyzer", "version": "1.0.0"},
+			"instructions":    "Query AWS WAF logs in Athena. Call describe_waf_tables first, then generate_waf_sql and run_waf_query.",
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": mcpTools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &mcpError{Code: -32602, Message: "invalid params"}
+		}
+		return callMCPTool(ctx, params.Name, params.Arguments), nil
+	default:
+		return nil, &mcpError{Code: -32601, Message: "method not found: " + req.Method}
+	}
+}
+
+// callMCPTool runs a tool; tool failures are reported in the result, not as protocol errors
+func callMCPTool(ctx context.Context, name string, args map[string]string) mcpToolResult {
+	text := func(s string) mcpToolResult { return mcpToolResult{Content: []mcpContent{{Type: "text", Text: s}}} }
+	fail := func(s string) mcpToolResult {
+		return mcpToolResult{Content: []mcpContent{{Type: "text", Text: s}}, IsError: true}
+	}
+
+	switch name {
+	case "generate_waf_sql":
+		question := strings.TrimSpace(args["question"])
+		if question == "" {
+			return fail("question is required")
+		}
+		audit := mcpAuditRecord(ctx, accessAsk, question)
+		defer func() { writeAudit(audit) }()
+		sql, templateName, err := generateSQL(ctx, question, defaultLocation)
+		if err != nil {
+			audit.Outcome, audit.Error = "error", err.Error()
+			return fail("SQL generation failed: " + err.Error())
+		}
+		audit.Outcome, audit.Template, audit.GeneratedSQL = "success", templateName, sql
+		audit.PreprocessedSQL = preprocessSqlQuery(sql)
+		if templateName != "" {
+			return text(fmt.Sprintf("-- template: %s\n%s", templateName, strings.TrimSpace(sql)))
+		}
+		return text(strings.TrimSpace(sql))
+
+	case "run_waf_query":
+		sql := strings.TrimSpace(args["sql"])
+		if sql == "" {
+			return fail("sql is required")
+		}
+		audit := mcpAuditRecord(ctx, accessSQL, "")
+		defer func() { writeAudit(audit) }()
+		qid, rows, errMsg, stats := runAthenaQuery(ctx, sql)
+		audit.setQueryResult(sql, qid, rows, errMsg, stats, nil)
+		if errMsg != "" {
+			return fail(fmt.Sprintf("Query failed (region: %s, query ID: %s): %s", stats.Region, qid, errMsg))
+		}
+		rows = redactRows(rows, redactionFor(resultTargetNames(sql, stats, nil), ""))
+
+		var table string
+		switch args["format"] {
+		case "csv":
+			table = formatRowsCSV(rows)
+		case "json":
+			table = formatRowsJSON(rows)
+		case "text":
+			table = formatRowsText(rows)
+		default:
+			table = formatRowsMarkdown(rows)
+		}
+		header := fmt.Sprintf("query_id: %s\nregion: %s\nrows: %d\ndata_scanned_bytes: %d", qid, stats.Region, max(len(rows)-1, 0), stats.DataScannedBytes)
+		if stats.Target != "" {
+			header += "\ntarget: " + stats.Target
+		}
+		if cacheStatus := describeCacheStatus(stats); cacheStatus != "" {
+			header += "\ncache: " + cacheStatus
+		}
+		return text(header + "\n\n" + table)
+
+	case "describe_waf_tables":
+		var sb strings.Builder
+		sb.WriteString("WAF targets:\n")
+		described := make(map[string]bool)
+		for _, t := range wafTargets {
+			sb.WriteString(fmt.Sprintf("- %s: %s (table %s, region %s, schema %s)\n", t.Name, t.Description, t.FullTableName(), t.Region, t.Dialect().Name))
+		}
+		for _, t := range wafTargets {
+			d := t.Dialect()
+			if described[d.Name] {
+				continue
+			}
+			described[d.Name] = true
+			sb.WriteString(fmt.Sprintf("\nMain columns (%s schema):\n", d.Name))
+			sb.WriteString(d.ColumnsDescription)
+		}
+		for _, t := range wafTargets {
+			if t.LogGroup != "" {
+				continue
+			}
+			if columns, err := describeGlueTable(t); err != nil {
+				slog.Warn("Failed to describe table", "target", t.Name, "error", err)
+			} else {
+				sb.WriteString(fmt.Sprintf("\nAll columns of %s:\n%s\n", t.FullTableName(), columns))
+			}
+		}
+		return text(sb.String())
+
+	case "summarize_results":
+		question := strings.TrimSpace(args["question"])
+		if question == "" {
+			return fail("question is required")
+		}
+
+		sql := strings.TrimSpace(args["sql"])
+		if qid := args["query_id"]; qid != "" {
+			region, target, errMsg := resolveQueryTarget(args["target"], args["region"])
+			if !queryIDPattern.MatchString(qid) || errMsg != "" {
+				return fail("invalid query_id, target or region")
+			}
+			audit := mcpAuditRecord(ctx, accessAsk, question)
+			audit.QueryID, audit.Region, audit.Target = qid, region, target.Name
+			defer func() { writeAudit(audit) }()
+			state, rows, _, errMsg := getAthenaQueryStatus(region, qid, target)
+			if errMsg != "" || state != "SUCCEEDED" {
+				audit.Outcome, audit.Error = "error", fmt.Sprintf("query is not available (state: %s) %s", state, errMsg)
+				return fail(fmt.Sprintf("Query %s is not available (state: %s) %s", qid, state, errMsg))
+			}
+			audit.Outcome, audit.Rows = "success", max(len(rows)-1, 0)
+			var targetNames []string
+			if target.Name != "" {
+				targetNames = []string{target.Name}
+			}
+			return text(analyzeResults(ctx, sql, redactRows(rows, redactionFor(targetNames, "")), question))
+		}
+
+		if sql == "" {
+			return fail("either query_id or sql is required")
+		}
+		audit := mcpAuditRecord(ctx, accessSQL, question)
+		defer func() { writeAudit(audit) }()
+		qid, rows, errMsg, stats := runAthenaQuery(ctx, sql)
+		audit.setQueryResult(sql, qid, rows, errMsg, stats, nil)
+		if errMsg != "" {
+			return fail("Query failed: " + errMsg)
+		}
+		return text(analyzeResults(ctx, sql, redactRows(rows, redactionFor(resultTargetNames(sql, stats, nil), "")), question))
+
+	default:
+		return fail("unknown tool: " + name)
+	}
+}
+
+// describeGlueTable lists the top-level columns of a target's table from the Glue catalog, with the target's role
+func describeGlueTable(t WAFTarget) (string, error) {
+	out, err := getGlueClient(t.Region, t).GetTable(&glue.GetTableInput{
+		DatabaseName: aws.String(t.Database),
+		Name:         aws.String(t.Table),
+	})
+	if err != nil {
+		return "", err
+	}
+	var columns []string
+	if out.Table != nil && out.Table.StorageDescriptor != nil {
+		for _, c := range append(out.Table.StorageDescriptor.Columns, out.Table.PartitionKeys...) {
+			columns = append(columns, aws.StringValue(c.Name)+" "+aws.StringValue(c.Type))
+		}
+	}
+	return strings.Join(columns, ", "), nil
+}
@@ -0,0 +1,132 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics configuration
+var (
+	// CloudWatch namespace of the EMF metrics (METRICS_NAMESPACE)
+	metricsNamespace = envOrDefault("METRICS_NAMESPACE", "WAFAnalyzer")
+	// Set METRICS_ENABLED=false to stop emitting metrics
+	metricsEnabled = strings.ToLower(envOrDefault("METRICS_ENABLED", "true")) != "false"
+)
+
+// Metrics are written to the log output as Embedded Metric Format lines, which CloudWatch Logs
+// turns into metrics without API calls
+var (
+	metricsOutput   io.Writer = os.Stderr
+	metricsOutputMu sync.Mutex
+)
+
+// EMF units used by the pipeline metrics
+const (
+	unitMilliseconds = "Milliseconds"
+	unitCount        = "Count"
+	unitBytes        = "Bytes"
+)
+
+// metric is one value of an EMF record
+type metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// putMetrics writes an EMF record with the given dimensions and values. Request attributes of the context
+// (request ID, event ID, query ID) are added as properties so a data point can be traced back to its logs.
+func putMetrics(ctx context.Context, dimensions map[string]string, metrics ...metric) {
+	if !metricsEnabled || len(metrics) == 0 {
+		return
+	}
+
+	record := make(map[string]interface{})
+	attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	if !ok {
+		if p := requestLogAttrs.Load(); p != nil {
+			attrs = *p
+		}
+	}
+	for _, a := range attrs {
+		// User and channel IDs stay out of the metrics
+		if a.Key != "user" && a.Key != "channel" {
+			record[a.Key] = a.Value.String()
+		}
+	}
+
+	dimensionNames := make([]string, 0, len(dimensions))
+	for name, value := range dimensions {
+		if value == "" {
+			value = "none"
+		}
+		dimensionNames = append(dimensionNames, name)
+		record[name] = value
+	}
+	sort.Strings(dimensionNames)
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		record[m.Name] = m.Value
+	}
+
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Failed to encode metrics", "error", err)
+		return
+	}
+	metricsOutputMu.Lock()
+	defer metricsOutputMu.Unlock()
+	metricsOutput.Write(append(line, '\n'))
+}
+
+// putCount records a single occurrence of an event
+func putCount(ctx context.Context, name string, dimensions map[string]string) {
+	putMetrics(ctx, dimensions, metric{Name: name, Unit: unitCount, Value: 1})
+}
+
+// milliseconds converts a duration to a metric value
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// classifyQueryError groups query errors of generated SQL into a small set of failure classes for metrics
+func classifyQueryError(errMsg string) string {
+	lower := strings.ToLower(errMsg)
+	switch {
+	case errMsg == "":
+		return ""
+	case strings.HasPrefix(errMsg, "Invalid SQL command"):
+		return "rejected"
+	case strings.Contains(errMsg, " schema: "):
+		return "wrong_schema"
+	case strings.Contains(lower, "timed out"):
+		return "timeout"
+	case strings.Contains(lower, "syntax_error"), strings.Contains(lower, "mismatched input"),
+		strings.Contains(lower, "column_not_found"), strings.Contains(lower, "cannot be resolved"),
+		strings.Contains(lower, "table_not_found"), strings.Contains(lower, "does not exist"),
+		strings.Contains(lower, "malformedquery"):
+		return "syntax"
+	case strings.Contains(lower, "access"):
+		return "access"
+	default:
+		return "execution"
+	}
+}
@@ -0,0 +1,502 @@
+package analyzer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+	"modernc.org/sqlite"
+)
+
+// offlineColumns are the OCSF column paths available in the offline tables.
+// Map access such as unmapped['action'] is stored as "unmapped.action".
+var offlineColumns = []string{
+	"time_dt",
+	"accountid",
+	"region",
+	"metadata.product.feature.uid",
+	"http_request.url.hostname",
+	"http_request.url.path",
+	"http_request.url.query_string",
+	"http_request.http_method",
+	"http_request.user_agent",
+	"src_endpoint.ip",
+	"src_endpoint.location.country",
+	"firewall_rule.uid",
+	"unmapped.action",
+}
+
+// Timestamps are stored as text in this layout so string comparison matches time order
+const offlineTimeLayout = "2006-01-02 15:04:05"
+
+// offlineNow is the time relative ranges (INTERVAL, current_date, now()) are evaluated against
+var offlineNow = time.Now
+
+// offlineExecutor runs queries against local WAF log files loaded into an in-memory SQLite database.
+// Each registered target reads OFFLINE_DATA_DIR/<target name>/ when it exists, otherwise the files directly in OFFLINE_DATA_DIR.
+// Supported files: AWS WAF JSON logs and OCSF (Security Lake) JSON records, newline-delimited or arrays, optionally gzipped.
+// Parquet is not supported; a .parquet file in a data directory fails the load instead of being skipped.
+type offlineExecutor struct {
+	dataDir string
+	once    sync.Once
+	db      *sql.DB
+	tables  map[string]string // Athena table name (qualified or bare) -> SQLite table
+	loadErr error
+	seq     int64
+}
+
+// newOfflineExecutor creates an executor reading logs from dataDir (loaded on first query)
+func newOfflineExecutor(dataDir string) *offlineExecutor {
+	return &offlineExecutor{dataDir: dataDir}
+}
+
+// Execute translates the Presto query to SQLite and runs it against the loaded logs
+func (e *offlineExecutor) Execute(ctx context.Context, query string, region string) (string, []*athena.Row, string, QueryStats) {
+	stats := QueryStats{Region: region}
+	e.once.Do(e.load)
+	if e.loadErr != nil {
+		return "", nil, fmt.Sprintf("Offline backend failed to load logs: %v", e.loadErr), stats
+	}
+
+	qid := fmt.Sprintf("offline-%d", atomic.AddInt64(&e.seq, 1))
+	translated := translateToSQLite(query, e.tables)
+	slog.InfoContext(ctx, "Offline query", "query_id", qid, "sql", translated)
+
+	start := time.Now()
+	rows, err := e.db.QueryContext(ctx, translated)
+	if err != nil {
+		return qid, nil, fmt.Sprintf("Offline query failed: %v", err), stats
+	}
+	defer rows.Close()
+
+	result, err := sqlRowsToAthena(rows, 20)
+	if err != nil {
+		return qid, nil, fmt.Sprintf("Offline query failed: %v", err), stats
+	}
+	stats.EngineExecutionMs = time.Since(start).Milliseconds()
+	return qid, result, "", stats
+}
+
+// load opens the database and loads every target's log files
+func (e *offlineExecutor) load() {
+	if e.dataDir == "" {
+		e.loadErr = fmt.Errorf("OFFLINE_DATA_DIR is not set")
+		return
+	}
+
+	registerOfflineFunctions()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		e.loadErr = err
+		return
+	}
+	// Each connection of ":memory:" is a separate database, so keep a single one
+	db.SetMaxOpenConns(1)
+	e.db = db
+	e.tables = make(map[string]string)
+
+	for _, target := range wafTargets {
+		if target.LogGroup != "" {
+			continue
+		}
+		table := "waf_" + regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(target.Name, "_")
+		dir := filepath.Join(e.dataDir, target.Name)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			dir = e.dataDir
+		}
+
+		count, err := loadOfflineTable(db, table, dir)
+		if err != nil {
+			e.loadErr = fmt.Errorf("target %s: %v", target.Name, err)
+			return
+		}
+		slog.Info("Offline backend loaded records", "records", count, "target", target.Name, "dir", dir)
+
+		e.tables[target.FullTableName()] = table
+		e.tables[target.Table] = table
+	}
+}
+
+// loadOfflineTable creates a table and inserts the records of every log file in dir
+func loadOfflineTable(db *sql.DB, table, dir string) (int, error) {
+	var cols []string
+	for _, c := range offlineColumns {
+		cols = append(cols, strconv.Quote(c)+" TEXT")
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(cols, ", "))); err != nil {
+		return 0, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(offlineColumns)), ", ")
+	stmt, err := db.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", table, placeholders))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	count := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		base := strings.TrimSuffix(name, ".gz")
+		if !entry.IsDir() && strings.HasSuffix(base, ".parquet") {
+			return count, fmt.Errorf("%s: Parquet files are not supported, convert them to JSON lines first", name)
+		}
+		if entry.IsDir() || !(strings.HasSuffix(base, ".json") || strings.HasSuffix(base, ".jsonl") || strings.HasSuffix(base, ".ndjson")) {
+			continue
+		}
+
+		err := readOfflineRecords(filepath.Join(dir, name), func(record map[string]interface{}) error {
+			values := offlineRecordValues(record)
+			args := make([]interface{}, len(offlineColumns))
+			for i, c := range offlineColumns {
+				if v, ok := values[c]; ok {
+					args[i] = v
+				}
+			}
+			_, err := stmt.Exec(args...)
+			count++
+			return err
+		})
+		if err != nil {
+			return count, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return count, nil
+}
+
+// readOfflineRecords decodes JSON objects from a file (newline-delimited, concatenated or a JSON array)
+func readOfflineRecords(path string, fn func(map[string]interface{}) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+
+	// A JSON array of records
+	if first, err := br.Peek(1); err == nil && first[0] == '[' {
+		var records []map[string]interface{}
+		if err := dec.Decode(&records); err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// offlineRecordValues maps a native WAF log or OCSF record to the offline column values
+func offlineRecordValues(record map[string]interface{}) map[string]string {
+	if _, ok := record["httpRequest"]; ok {
+		return nativeWAFRecordValues(record)
+	}
+
+	// OCSF: flatten nested objects into dotted paths
+	values := make(map[string]string)
+	flattenRecord("", record, values)
+	if ts, ok := values["time_dt"]; ok {
+		values["time_dt"] = normalizeOfflineTime(ts)
+	} else if ts, ok := values["time"]; ok {
+		values["time_dt"] = normalizeOfflineTime(ts)
+	}
+	return values
+}
+
+// nativeWAFRecordValues maps an AWS WAF log record (httpRequest, action, terminatingRuleId) to OCSF columns
+func nativeWAFRecordValues(record map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	str := func(v interface{}) string {
+		if v == nil {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+
+	values["time_dt"] = normalizeOfflineTime(str(record["timestamp"]))
+	values["unmapped.action"] = str(record["action"])
+	values["firewall_rule.uid"] = str(record["terminatingRuleId"])
+
+	// arn:aws:wafv2:<region>:<account>:<scope>/webacl/<name>/<id>
+	webACL := str(record["webaclId"])
+	values["metadata.product.feature.uid"] = webACL
+	if parts := strings.Split(webACL, ":"); len(parts) >= 6 {
+		values["region"] = parts[3]
+		values["accountid"] = parts[4]
+	}
+
+	if req, ok := record["httpRequest"].(map[string]interface{}); ok {
+		values["src_endpoint.ip"] = str(req["clientIp"])
+		values["src_endpoint.location.country"] = str(req["country"])
+		values["http_request.url.path"] = str(req["uri"])
+		values["http_request.url.query_string"] = str(req["args"])
+		values["http_request.http_method"] = str(req["httpMethod"])
+		if headers, ok := req["headers"].([]interface{}); ok {
+			for _, h := range headers {
+				header, ok := h.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				switch strings.ToLower(str(header["name"])) {
+				case "host":
+					values["http_request.url.hostname"] = str(header["value"])
+				case "user-agent":
+					values["http_request.user_agent"] = str(header["value"])
+				}
+			}
+		}
+	}
+	return values
+}
+
+// flattenRecord flattens nested JSON objects into dotted keys
+func flattenRecord(prefix string, v interface{}, out map[string]string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenRecord(key, child, out)
+		}
+	case nil:
+	default:
+		out[prefix] = fmt.Sprint(val)
+	}
+}
+
+// normalizeOfflineTime converts epoch milliseconds/seconds or a timestamp string to offlineTimeLayout (UTC)
+func normalizeOfflineTime(value string) string {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n).UTC().Format(offlineTimeLayout)
+		}
+		return time.Unix(n, 0).UTC().Format(offlineTimeLayout)
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.000", offlineTimeLayout, "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Format(offlineTimeLayout)
+		}
+	}
+	return value
+}
+
+var registerOfflineFunctionsOnce sync.Once
+
+// registerOfflineFunctions adds the Presto functions used in our queries to SQLite
+func registerOfflineFunctions() {
+	registerOfflineFunctionsOnce.Do(func() {
+		sqlite.MustRegisterDeterministicScalarFunction("date_trunc", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			unit, _ := args[0].(string)
+			ts, ok := args[1].(string)
+			if !ok || len(ts) < len(offlineTimeLayout) {
+				return nil, nil
+			}
+			switch strings.ToLower(unit) {
+			case "minute":
+				return ts[:16] + ":00", nil
+			case "hour":
+				return ts[:13] + ":00:00", nil
+			case "day":
+				return ts[:10] + " 00:00:00", nil
+			case "month":
+				return ts[:7] + "-01 00:00:00", nil
+			}
+			return ts, nil
+		})
+		sqlite.MustRegisterDeterministicScalarFunction("hour", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			ts, ok := args[0].(string)
+			if !ok || len(ts) < 13 {
+				return nil, nil
+			}
+			h, _ := strconv.Atoi(ts[11:13])
+			return int64(h), nil
+		})
+	})
+}
+
+// Presto-isms rewritten by translateToSQLite
+var (
+	offlineIntervalRe   = regexp.MustCompile(`(?i)\b(current_date|current_timestamp|now\(\))\s*-\s*INTERVAL\s*'(\d+)'\s*(MINUTE|HOUR|DAY|WEEK|MONTH)S?\b`)
+	offlineCurrentRe    = regexp.MustCompile(`(?i)\b(current_date|current_timestamp)\b|\bnow\(\)`)
+	offlineTimestampRe  = regexp.MustCompile(`(?i)\bTIMESTAMP\s*'([^']*)'`)
+	offlineMapAccessRe  = regexp.MustCompile(`\b([A-Za-z_][A-Za-z0-9_]*)\['([^']+)'\]`)
+	offlineApproxRe     = regexp.MustCompile(`(?i)\bapprox_distinct\s*\(`)
+	offlineDottedPathRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)+`)
+)
+
+// translateToSQLite rewrites an Athena (Presto) query for the offline SQLite tables
+func translateToSQLite(query string, tables map[string]string) string {
+	// Relative time ranges
+	now := "'" + offlineNow().UTC().Format(offlineTimeLayout) + "'"
+	query = offlineIntervalRe.ReplaceAllStringFunc(query, func(m string) string {
+		sub := offlineIntervalRe.FindStringSubmatch(m)
+		n, _ := strconv.Atoi(sub[2])
+		unit := strings.ToLower(sub[3])
+		if unit == "week" {
+			n, unit = n*7, "day"
+		}
+		start := now
+		if strings.EqualFold(sub[1], "current_date") {
+			start = now + ", 'start of day'"
+		}
+		return fmt.Sprintf("datetime(%s, '-%d %ss')", start, n, unit)
+	})
+	query = offlineCurrentRe.ReplaceAllStringFunc(query, func(m string) string {
+		if strings.EqualFold(m, "current_date") {
+			return fmt.Sprintf("datetime(%s, 'start of day')", now)
+		}
+		return fmt.Sprintf("datetime(%s)", now)
+	})
+
+	// TIMESTAMP '...' literals are plain strings in the offline tables
+	query = offlineTimestampRe.ReplaceAllString(query, "'$1'")
+	// unmapped['action'] -> "unmapped.action"
+	query = offlineMapAccessRe.ReplaceAllString(query, `"$1.$2"`)
+	query = offlineApproxRe.ReplaceAllString(query, "count(DISTINCT ")
+
+	// Table names (qualified names first) and dotted column paths, outside literals and quoted identifiers
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	known := make(map[string]bool, len(offlineColumns))
+	for _, c := range offlineColumns {
+		known[c] = true
+	}
+
+	return mapUnquoted(query, func(segment string) string {
+		for _, name := range names {
+			segment = strings.ReplaceAll(segment, name, tables[name])
+		}
+		return offlineDottedPathRe.ReplaceAllStringFunc(segment, func(path string) string {
+			if known[path] {
+				return strconv.Quote(path)
+			}
+			return path
+		})
+	})
+}
+
+// mapUnquoted applies fn to the parts of a query outside '...' literals and "..." identifiers
+func mapUnquoted(query string, fn func(string) string) string {
+	var sb strings.Builder
+	var segment strings.Builder
+	var quote rune
+
+	for _, r := range query {
+		if quote != 0 {
+			sb.WriteRune(r)
+			if r == quote {
+				quote = 0
+			}
+			continue
+		}
+		if r == '\'' || r == '"' {
+			sb.WriteString(fn(segment.String()))
+			segment.Reset()
+			sb.WriteRune(r)
+			quote = r
+			continue
+		}
+		segment.WriteRune(r)
+	}
+	sb.WriteString(fn(segment.String()))
+	return sb.String()
+}
+
+// sqlRowsToAthena converts SQL rows to Athena rows (header first), keeping at most maxRows rows including the header
+func sqlRowsToAthena(rows *sql.Rows, maxRows int) ([]*athena.Row, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	header := &athena.Row{}
+	for _, c := range cols {
+		header.Data = append(header.Data, &athena.Datum{VarCharValue: awsString(c)})
+	}
+	result := []*athena.Row{header}
+
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		if len(result) >= maxRows {
+			continue
+		}
+
+		row := &athena.Row{}
+		for _, v := range values {
+			datum := &athena.Datum{}
+			switch val := v.(type) {
+			case nil:
+			case []byte:
+				datum.VarCharValue = awsString(string(val))
+			case float64:
+				datum.VarCharValue = awsString(strconv.FormatFloat(val, 'f', -1, 64))
+			default:
+				datum.VarCharValue = awsString(fmt.Sprint(val))
+			}
+			row.Data = append(row.Data, datum)
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,93 @@
+package analyzer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withOfflineNow pins the clock of the offline backend for the duration of a test
+func withOfflineNow(t *testing.T, now time.Time) {
+	t.Helper()
+	saved := offlineNow
+	offlineNow = func() time.Time { return now }
+	t.Cleanup(func() { offlineNow = saved })
+}
+
+func TestOfflineExecutorSample(t *testing.T) {
+	// The sample has four records at 2026-10-18 12:51:56 UTC and one three days earlier
+	withOfflineNow(t, time.Date(2026, 10, 18, 13, 30, 0, 0, time.UTC))
+	executor := newOfflineExecutor(filepath.Join("testdata", "offline"))
+	table := defaultTargets[0].FullTableName()
+
+	tests := []struct {
+		name  string
+		query string
+		want  [][]string
+	}{
+		{
+			name:  "interval day",
+			query: "SELECT COUNT(*) AS c FROM " + table + " WHERE time_dt > now() - INTERVAL '1' DAY",
+			want:  [][]string{{"c"}, {"4"}},
+		},
+		{
+			name:  "interval week",
+			query: "SELECT COUNT(*) AS c FROM " + table + " WHERE time_dt > current_timestamp - INTERVAL '7' DAY",
+			want:  [][]string{{"c"}, {"5"}},
+		},
+		{
+			name:  "interval hour",
+			query: "SELECT COUNT(*) AS c FROM " + table + " WHERE time_dt > now() - INTERVAL '1' HOUR",
+			want:  [][]string{{"c"}, {"4"}},
+		},
+		{
+			name: "unmapped action",
+			query: "SELECT src_endpoint.ip AS ip, COUNT(*) AS c FROM " + table +
+				" WHERE unmapped['action'] = 'BLOCK' AND time_dt > now() - INTERVAL '7' DAY GROUP BY 1 ORDER BY c DESC, 1",
+			want: [][]string{{"ip", "c"}, {"203.0.113.10", "3"}, {"192.0.2.55", "1"}},
+		},
+		{
+			name:  "current date",
+			query: "SELECT COUNT(*) AS c FROM " + table + " WHERE time_dt >= current_date",
+			want:  [][]string{{"c"}, {"4"}},
+		},
+		{
+			name:  "timestamp literal",
+			query: "SELECT COUNT(*) AS c FROM " + table + " WHERE time_dt < TIMESTAMP '2026-10-16 00:00:00'",
+			want:  [][]string{{"c"}, {"1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rows, errMsg, _ := executor.Execute(context.Background(), tt.query, defaultTargets[0].Region)
+			if errMsg != "" {
+				t.Fatalf("Execute(%q) failed: %s", tt.query, errMsg)
+			}
+			headers, values := rowValues(rows)
+			got := append([][]string{headers}, values...)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Execute(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+			for i := range got {
+				if strings.Join(got[i], ",") != strings.Join(tt.want[i], ",") {
+					t.Errorf("row %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOfflineExecutorRejectsParquet(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "part-0000.parquet"), []byte("PAR1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, errMsg, _ := newOfflineExecutor(dir).Execute(context.Background(), "SELECT 1", "")
+	if !strings.Contains(errMsg, "Parquet files are not supported") {
+		t.Errorf("Execute error = %q, want a Parquet error", errMsg)
+	}
+}
@@ -0,0 +1,425 @@
+package analyzer
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Rate limit and quota configuration. A limit of 0 disables it; nothing is limited unless configured.
+var (
+	// DynamoDB table shared by all instances (partition key "id", TTL attribute "expires_at").
+	// Without it limits are tracked per instance.
+	rateLimitTable = os.Getenv("RATE_LIMIT_TABLE")
+
+	userRateLimit    = bucketLimit{Burst: envFloat("RATE_LIMIT_USER_BURST", 0), PerHour: envFloat("RATE_LIMIT_USER_PER_HOUR", 0)}
+	channelRateLimit = bucketLimit{Burst: envFloat("RATE_LIMIT_CHANNEL_BURST", 0), PerHour: envFloat("RATE_LIMIT_CHANNEL_PER_HOUR", 0)}
+
+	userDailyQuota = usage{
+		Questions:     int64(envInt("QUOTA_USER_QUESTIONS", 0)),
+		BedrockTokens: int64(envInt("QUOTA_USER_BEDROCK_TOKENS", 0)),
+		ScannedBytes:  envInt64("QUOTA_USER_SCANNED_BYTES", 0),
+	}
+	channelDailyQuota = usage{
+		Questions:     int64(envInt("QUOTA_CHANNEL_QUESTIONS", 0)),
+		BedrockTokens: int64(envInt("QUOTA_CHANNEL_BEDROCK_TOKENS", 0)),
+		ScannedBytes:  envInt64("QUOTA_CHANNEL_SCANNED_BYTES", 0),
+	}
+
+	limitStore = newLimitStore()
+)
+
+// bucketLimit is a token bucket: Burst questions at once, refilled at PerHour
+type bucketLimit struct {
+	Burst   float64
+	PerHour float64
+}
+
+// usage is what a user or channel consumed in a day (or a daily quota)
+type usage struct {
+	Questions     int64
+	BedrockTokens int64
+	ScannedBytes  int64
+}
+
+// limitStoreBackend keeps token buckets and daily usage
+type limitStoreBackend interface {
+	// takeToken removes one token from a bucket, or reports how long until one is available
+	takeToken(key string, limit bucketLimit, now time.Time) (bool, time.Duration, error)
+	// peekTokens returns the tokens currently in a bucket without taking one
+	peekTokens(key string, limit bucketLimit, now time.Time) (float64, error)
+	// refundToken puts back a token taken for a question that another bucket then refused
+	refundToken(key string, limit bucketLimit) error
+	getUsage(key string) (usage, error)
+	addUsage(key string, u usage, expires time.Time) error
+}
+
+// newLimitStore returns the DynamoDB store when RATE_LIMIT_TABLE is set, otherwise the in-memory store
+func newLimitStore() limitStoreBackend {
+	if rateLimitTable != "" {
+		return dynamoLimitStore{}
+	}
+	return &memoryLimitStore{buckets: make(map[string]bucketState), usage: make(map[string]usage)}
+}
+
+// checkRateLimits checks the user's and the channel's daily quotas and takes a token from both of their buckets,
+// or from neither when one of them is empty. It returns a message for the user when a limit is exceeded.
+// Store errors do not block questions.
+func checkRateLimits(user, channel string) string {
+	now := time.Now()
+	day := now.In(defaultLocation).Format("2006-01-02")
+
+	for _, q := range []struct {
+		scope, id string
+		quota     usage
+	}{{"user", user, userDailyQuota}, {"channel", channel, channelDailyQuota}} {
+		if q.id == "" || q.quota == (usage{}) {
+			continue
+		}
+		used, err := limitStore.getUsage(quotaKey(q.scope, q.id, day))
+		if err != nil {
+			slog.Warn("Failed to read quota", "scope", q.scope, "id", q.id, "error", err)
+			continue
+		}
+		if what := exceededQuota(used, q.quota); what != "" {
+			return fmt.Sprintf("the daily %s for this %s is used up (%s). It resets at midnight (%s).", what, q.scope, describeUsage(used, q.quota), defaultLocation)
+		}
+	}
+
+	type bucket struct {
+		scope, id string
+		limit     bucketLimit
+	}
+	refused := func(b bucket, retryAfter time.Duration) string {
+		return fmt.Sprintf("too many questions from this %s right now. Please try again in %s.", b.scope, formatDuration(retryAfter))
+	}
+
+	// Look at every bucket first, so a question refused by one does not use up a token of another
+	var buckets []bucket
+	for _, b := range []bucket{{"user", user, userRateLimit}, {"channel", channel, channelRateLimit}} {
+		if b.id == "" || b.limit.Burst <= 0 || b.limit.PerHour <= 0 {
+			continue
+		}
+		tokens, err := limitStore.peekTokens(bucketKey(b.scope, b.id), b.limit, now)
+		if err != nil {
+			slog.Warn("Failed to read rate limit", "scope", b.scope, "id", b.id, "error", err)
+			continue
+		}
+		if tokens < 1 {
+			return refused(b, waitForToken(tokens, b.limit))
+		}
+		buckets = append(buckets, b)
+	}
+
+	// A bucket emptied by a concurrent question in between gives back the tokens already taken
+	var taken []bucket
+	for _, b := range buckets {
+		ok, retryAfter, err := limitStore.takeToken(bucketKey(b.scope, b.id), b.limit, now)
+		if err != nil {
+			slog.Warn("Failed to update rate limit", "scope", b.scope, "id", b.id, "error", err)
+			continue
+		}
+		if !ok {
+			for _, t := range taken {
+				if err := limitStore.refundToken(bucketKey(t.scope, t.id), t.limit); err != nil {
+					slog.Warn("Failed to refund rate limit token", "scope", t.scope, "id", t.id, "error", err)
+				}
+			}
+			return refused(b, retryAfter)
+		}
+		taken = append(taken, b)
+	}
+	return ""
+}
+
+// recordUsage adds a request's consumption to the user's and the channel's daily usage
+func recordUsage(user, channel string, u usage) {
+	now := time.Now().In(defaultLocation)
+	day := now.Format("2006-01-02")
+	expires := now.AddDate(0, 0, 2)
+	for _, q := range []struct{ scope, id string }{{"user", user}, {"channel", channel}} {
+		if q.id == "" {
+			continue
+		}
+		if err := limitStore.addUsage(quotaKey(q.scope, q.id, day), u, expires); err != nil {
+			slog.Warn("Failed to record usage", "scope", q.scope, "id", q.id, "error", err)
+		}
+	}
+}
+
+// describeQuota summarizes the remaining rate limit and daily quota of a user in a channel for /waf help
+func describeQuota(user, channel string) string {
+	now := time.Now()
+	day := now.In(defaultLocation).Format("2006-01-02")
+
+	var lines []string
+	for _, q := range []struct {
+		label, scope, id string
+		limit            bucketLimit
+		quota            usage
+	}{{"You", "user", user, userRateLimit, userDailyQuota}, {"This channel", "channel", channel, channelRateLimit, channelDailyQuota}} {
+		var parts []string
+		if q.limit.Burst > 0 && q.limit.PerHour > 0 {
+			if tokens, err := limitStore.peekTokens(bucketKey(q.scope, q.id), q.limit, now); err == nil {
+				parts = append(parts, fmt.Sprintf("%d of %g questions available now (+%g/hour)", int(tokens), q.limit.Burst, q.limit.PerHour))
+			}
+		}
+		if q.quota != (usage{}) {
+			if used, err := limitStore.getUsage(quotaKey(q.scope, q.id, day)); err == nil {
+				parts = append(parts, "today "+describeUsage(used, q.quota))
+			}
+		}
+		if len(parts) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", q.label, strings.Join(parts, "; ")))
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "*Quota:*\n" + strings.Join(lines, "\n")
+}
+
+// exceededQuota names the first quota that is used up
+func exceededQuota(used, quota usage) string {
+	switch {
+	case quota.Questions > 0 && used.Questions >= quota.Questions:
+		return "question limit"
+	case quota.BedrockTokens > 0 && used.BedrockTokens >= quota.BedrockTokens:
+		return "Bedrock token budget"
+	case quota.ScannedBytes > 0 && used.ScannedBytes >= quota.ScannedBytes:
+		return "Athena scan budget"
+	}
+	return ""
+}
+
+// describeUsage renders usage against the configured quotas, e.g. "12/50 questions, 1.2 GB/10.0 GB scanned"
+func describeUsage(used, quota usage) string {
+	var parts []string
+	if quota.Questions > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d questions", used.Questions, quota.Questions))
+	}
+	if quota.BedrockTokens > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d Bedrock tokens", used.BedrockTokens, quota.BedrockTokens))
+	}
+	if quota.ScannedBytes > 0 {
+		parts = append(parts, fmt.Sprintf("%s/%s scanned", formatBytes(used.ScannedBytes), formatBytes(quota.ScannedBytes)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatDuration renders a wait time rounded up to seconds or minutes
+func formatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%d seconds", int(math.Ceil(d.Seconds())))
+	}
+	return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+}
+
+// bucketKey and quotaKey are the store keys of a token bucket and a day's usage
+func bucketKey(scope, id string) string {
+	return "bucket#" + scope + "#" + id
+}
+
+func quotaKey(scope, id, day string) string {
+	return "quota#" + scope + "#" + id + "#" + day
+}
+
+// refill returns the tokens in a bucket after refilling it since the last update
+func refill(tokens float64, updated time.Time, limit bucketLimit, now time.Time) float64 {
+	if updated.IsZero() {
+		return limit.Burst
+	}
+	return math.Min(limit.Burst, tokens+now.Sub(updated).Hours()*limit.PerHour)
+}
+
+// waitForToken is how long until a bucket holds one token
+func waitForToken(tokens float64, limit bucketLimit) time.Duration {
+	return time.Duration((1 - tokens) / limit.PerHour * float64(time.Hour))
+}
+
+// memoryLimitStore keeps limits in this instance only (no RATE_LIMIT_TABLE)
+type memoryLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]bucketState
+	usage   map[string]usage
+}
+
+type bucketState struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (m *memoryLimitStore) takeToken(key string, limit bucketLimit, now time.Time) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[key]
+	tokens := refill(b.tokens, b.updated, limit, now)
+	if tokens < 1 {
+		return false, waitForToken(tokens, limit), nil
+	}
+	m.buckets[key] = bucketState{tokens: tokens - 1, updated: now}
+	return true, 0, nil
+}
+
+func (m *memoryLimitStore) peekTokens(key string, limit bucketLimit, now time.Time) (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[key]
+	return refill(b.tokens, b.updated, limit, now), nil
+}
+
+func (m *memoryLimitStore) refundToken(key string, limit bucketLimit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.buckets[key]; ok {
+		b.tokens = math.Min(limit.Burst, b.tokens+1)
+		m.buckets[key] = b
+	}
+	return nil
+}
+
+func (m *memoryLimitStore) getUsage(key string) (usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage[key], nil
+}
+
+func (m *memoryLimitStore) addUsage(key string, u usage, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.usage[key]
+	cur.Questions += u.Questions
+	cur.BedrockTokens += u.BedrockTokens
+	cur.ScannedBytes += u.ScannedBytes
+	m.usage[key] = cur
+	return nil
+}
+
+// dynamoLimitStore keeps limits in RATE_LIMIT_TABLE so they are shared across Lambda instances.
+// Buckets are updated with a conditional write on the previous update time; usage with atomic ADD.
+type dynamoLimitStore struct{}
+
+// getBucket reads a bucket; updated is 0 when it does not exist yet
+func (dynamoLimitStore) getBucket(key string) (float64, int64, error) {
+	out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(rateLimitTable),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || out.Item == nil {
+		return 0, 0, err
+	}
+	tokens, _ := strconv.ParseFloat(aws.StringValue(out.Item["tokens"].N), 64)
+	updated, _ := strconv.ParseInt(aws.StringValue(out.Item["updated_ms"].N), 10, 64)
+	return tokens, updated, nil
+}
+
+func (s dynamoLimitStore) takeToken(key string, limit bucketLimit, now time.Time) (bool, time.Duration, error) {
+	// Retry when another instance updated the bucket in between
+	for attempt := 1; attempt <= 3; attempt++ {
+		tokens, updatedMs, err := s.getBucket(key)
+		if err != nil {
+			return false, 0, err
+		}
+		var updated time.Time
+		if updatedMs > 0 {
+			updated = time.UnixMilli(updatedMs)
+		}
+		tokens = refill(tokens, updated, limit, now)
+		if tokens < 1 {
+			return false, waitForToken(tokens, limit), nil
+		}
+
+		input := &dynamodb.PutItemInput{
+			TableName: aws.String(rateLimitTable),
+			Item: map[string]*dynamodb.AttributeValue{
+				"id":         {S: aws.String(key)},
+				"tokens":     {N: aws.String(strconv.FormatFloat(tokens-1, 'f', 4, 64))},
+				"updated_ms": {N: aws.String(strconv.FormatInt(now.UnixMilli(), 10))},
+				"expires_at": {N: aws.String(strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10))},
+			},
+		}
+		if updatedMs == 0 {
+			input.ConditionExpression = aws.String("attribute_not_exists(id)")
+		} else {
+			input.ConditionExpression = aws.String("updated_ms = :prev")
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":prev": {N: aws.String(strconv.FormatInt(updatedMs, 10))},
+			}
+		}
+
+		_, err = getDynamoClient().PutItem(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			slog.Debug("Rate limit bucket changed concurrently, retrying", "key", key, "attempt", attempt)
+			continue
+		}
+		return err == nil, 0, err
+	}
+	return false, 0, fmt.Errorf("rate limit bucket %s is contended", key)
+}
+
+func (s dynamoLimitStore) peekTokens(key string, limit bucketLimit, now time.Time) (float64, error) {
+	tokens, updatedMs, err := s.getBucket(key)
+	if err != nil {
+		return 0, err
+	}
+	var updated time.Time
+	if updatedMs > 0 {
+		updated = time.UnixMilli(updatedMs)
+	}
+	return refill(tokens, updated, limit, now), nil
+}
+
+func (dynamoLimitStore) refundToken(key string, limit bucketLimit) error {
+	// The next refill caps the bucket at its burst again
+	_, err := getDynamoClient().UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(rateLimitTable),
+		Key:                       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}},
+		UpdateExpression:          aws.String("ADD tokens :one"),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+	})
+	return err
+}
+
+func (dynamoLimitStore) getUsage(key string) (usage, error) {
+	out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(rateLimitTable),
+		Key:       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}},
+	})
+	if err != nil || out.Item == nil {
+		return usage{}, err
+	}
+	number := func(name string) int64 {
+		if v, ok := out.Item[name]; ok {
+			n, _ := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+			return n
+		}
+		return 0
+	}
+	return usage{Questions: number("questions"), BedrockTokens: number("bedrock_tokens"), ScannedBytes: number("scanned_bytes")}, nil
+}
+
+func (dynamoLimitStore) addUsage(key string, u usage, expires time.Time) error {
+	_, err := getDynamoClient().UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(rateLimitTable),
+		Key:              map[string]*dynamodb.AttributeValue{"id": {S: aws.String(key)}},
+		UpdateExpression: aws.String("ADD questions :q, bedrock_tokens :t, scanned_bytes :b SET expires_at = :e"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":q": {N: aws.String(strconv.FormatInt(u.Questions, 10))},
+			":t": {N: aws.String(strconv.FormatInt(u.BedrockTokens, 10))},
+			":b": {N: aws.String(strconv.FormatInt(u.ScannedBytes, 10))},
+			":e": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		},
+	})
+	return err
+}
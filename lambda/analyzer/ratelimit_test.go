@@ -0,0 +1,112 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRateLimits replaces the bucket limits and daily quotas with an in-memory store for the duration of a test
+func withRateLimits(t *testing.T, user, channel bucketLimit, userQuota usage) {
+	t.Helper()
+	savedStore, savedUser, savedChannel := limitStore, userRateLimit, channelRateLimit
+	savedUserQuota, savedChannelQuota := userDailyQuota, channelDailyQuota
+	limitStore = &memoryLimitStore{buckets: make(map[string]bucketState), usage: make(map[string]usage)}
+	userRateLimit, channelRateLimit = user, channel
+	userDailyQuota, channelDailyQuota = userQuota, usage{}
+	t.Cleanup(func() {
+		limitStore, userRateLimit, channelRateLimit = savedStore, savedUser, savedChannel
+		userDailyQuota, channelDailyQuota = savedUserQuota, savedChannelQuota
+	})
+}
+
+func TestRefill(t *testing.T) {
+	limit := bucketLimit{Burst: 5, PerHour: 2}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		tokens  float64
+		updated time.Time
+		want    float64
+	}{
+		{"new bucket is full", 0, time.Time{}, 5},
+		{"no time passed", 1, now, 1},
+		{"half an hour", 1, now.Add(-30 * time.Minute), 2},
+		{"capped at burst", 4, now.Add(-10 * time.Hour), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refill(tt.tokens, tt.updated, limit, now); got != tt.want {
+				t.Errorf("refill() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := waitForToken(0.5, limit); got != 15*time.Minute {
+		t.Errorf("waitForToken(0.5) = %v, want 15m", got)
+	}
+}
+
+func TestMemoryLimitStoreTakeToken(t *testing.T) {
+	store := &memoryLimitStore{buckets: make(map[string]bucketState), usage: make(map[string]usage)}
+	limit := bucketLimit{Burst: 2, PerHour: 1}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := store.takeToken("k", limit, now); !ok {
+			t.Fatalf("take %d denied, want allowed within the burst", i+1)
+		}
+	}
+	ok, retryAfter, _ := store.takeToken("k", limit, now)
+	if ok || retryAfter != time.Hour {
+		t.Errorf("take beyond the burst = %v, retry after %v; want denied, retry after 1h", ok, retryAfter)
+	}
+	if ok, _, _ := store.takeToken("k", limit, now.Add(time.Hour)); !ok {
+		t.Errorf("take after an hour denied, want a refilled token")
+	}
+
+	store.refundToken("k", limit)
+	if tokens, _ := store.peekTokens("k", limit, now.Add(time.Hour)); tokens != 1 {
+		t.Errorf("tokens after refund = %v, want 1", tokens)
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	withRateLimits(t, bucketLimit{Burst: 2, PerHour: 1}, bucketLimit{Burst: 1, PerHour: 1}, usage{})
+
+	if msg := checkRateLimits("U1", "C1"); msg != "" {
+		t.Fatalf("first question limited: %s", msg)
+	}
+	// The channel bucket is empty now; the user's must not lose a token to the refused question
+	msg := checkRateLimits("U1", "C1")
+	if !strings.Contains(msg, "this channel") {
+		t.Errorf("second question = %q, want the channel limit", msg)
+	}
+	if tokens, _ := limitStore.peekTokens(bucketKey("user", "U1"), userRateLimit, time.Now()); tokens < 0.99 {
+		t.Errorf("user tokens after a channel denial = %v, want 1", tokens)
+	}
+	if msg := checkRateLimits("U1", "C2"); msg != "" {
+		t.Errorf("question in another channel limited: %s", msg)
+	}
+	if msg := checkRateLimits("U1", "C3"); !strings.Contains(msg, "this user") {
+		t.Errorf("question beyond the user burst = %q, want the user limit", msg)
+	}
+}
+
+func TestCheckRateLimitsQuota(t *testing.T) {
+	withRateLimits(t, bucketLimit{}, bucketLimit{}, usage{Questions: 2})
+
+	for i := 0; i < 2; i++ {
+		if msg := checkRateLimits("U1", "C1"); msg != "" {
+			t.Fatalf("question %d limited: %s", i+1, msg)
+		}
+		recordUsage("U1", "C1", usage{Questions: 1})
+	}
+	if msg := checkRateLimits("U1", "C1"); !strings.Contains(msg, "question limit") {
+		t.Errorf("question beyond the quota = %q, want the question limit", msg)
+	}
+	if msg := checkRateLimits("U2", "C1"); msg != "" {
+		t.Errorf("another user limited: %s", msg)
+	}
+}
@@ -0,0 +1,240 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+)
+
+// Query kinds that can be granted in the access policy
+const (
+	accessAsk    = "ask"    // Natural language questions
+	accessSQL    = "sql"    // Raw SQL (/waf sql ...)
+	accessExport = "export" // CSV export of results (/waf export ...)
+	accessBlock  = "block"  // Proposing IP set blocks
+	accessAudit  = "audit"  // Listing recent activity (/waf audit)
+)
+
+// AccessRule grants targets, query kinds and limits to the users, user groups and channels it matches.
+// Empty selector lists match anyone; a rule with no selectors at all only applies as the default.
+type AccessRule struct {
+	Users           []string `json:"users"`             // Slack user IDs
+	Groups          []string `json:"groups"`            // Slack user group IDs
+	Channels        []string `json:"channels"`          // Slack channel IDs
+	Targets         []string `json:"targets"`           // Target names, "*" for all targets
+	Kinds           []string `json:"kinds"`             // ask, sql, export, block, audit ("*" for all)
+	MaxRows         int      `json:"max_rows"`          // Result rows shown (0 = no limit)
+	MaxScannedBytes int64    `json:"max_scanned_bytes"` // Results of queries that scanned more are withheld (0 = no limit)
+}
+
+// AccessPolicy is the RBAC configuration (ACCESS_POLICY JSON or ACCESS_POLICY_FILE)
+type AccessPolicy struct {
+	Default *AccessRule  `json:"default"` // Applies when no rule matches (nothing is allowed when unset)
+	Rules   []AccessRule `json:"rules"`
+}
+
+// AccessGrant is what a user may do in a channel (the union of the matching rules)
+type AccessGrant struct {
+	AllTargets      bool
+	Targets         map[string]bool
+	Kinds           map[string]bool
+	MaxRows         int
+	MaxScannedBytes int64
+}
+
+// accessPolicy is nil when no policy is configured, in which case everyone may do everything
+var accessPolicy = loadAccessPolicy(os.Getenv("ACCESS_POLICY"), os.Getenv("ACCESS_POLICY_FILE"))
+
+// User group memberships are cached to avoid a usergroups.users.list call per question
+var (
+	groupMembersCache   = make(map[string]groupMembers)
+	groupMembersCacheMu sync.Mutex
+)
+
+type groupMembers struct {
+	members   map[string]bool
+	fetchedAt time.Time
+}
+
+// loadAccessPolicy parses the access policy from JSON or a file. An invalid policy denies everything
+// rather than silently opening access.
+func loadAccessPolicy(config, file string) *AccessPolicy {
+	if config == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			slog.Error("Failed to read ACCESS_POLICY_FILE, denying all queries", "error", err)
+			return &AccessPolicy{}
+		}
+		config = string(data)
+	}
+	if config == "" {
+		return nil
+	}
+
+	var policy AccessPolicy
+	if err := json.Unmarshal([]byte(config), &policy); err != nil {
+		slog.Error("Failed to parse access policy, denying all queries", "error", err)
+		return &AccessPolicy{}
+	}
+	slog.Info("Loaded access policy", "rules", len(policy.Rules))
+	return &policy
+}
+
+// authorize returns what a Slack user may do in a channel
+func authorize(user, channel string) AccessGrant {
+	if accessPolicy == nil {
+		return AccessGrant{AllTargets: true, Kinds: map[string]bool{"*": true}}
+	}
+
+	grant := AccessGrant{Targets: make(map[string]bool), Kinds: make(map[string]bool)}
+	matched := false
+	for _, rule := range accessPolicy.Rules {
+		if ruleMatches(rule, user, channel) {
+			grant.add(rule, !matched)
+			matched = true
+		}
+	}
+	if !matched && accessPolicy.Default != nil {
+		grant.add(*accessPolicy.Default, true)
+	}
+	return grant
+}
+
+// ruleMatches reports whether a rule applies to the user in the channel (all given selectors must match)
+func ruleMatches(rule AccessRule, user, channel string) bool {
+	if len(rule.Users) == 0 && len(rule.Groups) == 0 && len(rule.Channels) == 0 {
+		return false
+	}
+	if len(rule.Users) > 0 && !containsString(rule.Users, user) {
+		return false
+	}
+	if len(rule.Channels) > 0 && !containsString(rule.Channels, channel) {
+		return false
+	}
+	if len(rule.Groups) > 0 {
+		for _, g := range rule.Groups {
+			if isGroupMember(g, user) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// add merges a rule into the grant; limits take the most generous value (0 means unlimited)
+func (g *AccessGrant) add(rule AccessRule, first bool) {
+	for _, t := range rule.Targets {
+		if t == "*" {
+			g.AllTargets = true
+		}
+		g.Targets[strings.ToLower(t)] = true
+	}
+	for _, k := range rule.Kinds {
+		g.Kinds[strings.ToLower(k)] = true
+	}
+
+	if first || (g.MaxRows > 0 && (rule.MaxRows == 0 || rule.MaxRows > g.MaxRows)) {
+		g.MaxRows = rule.MaxRows
+	}
+	if first || (g.MaxScannedBytes > 0 && (rule.MaxScannedBytes == 0 || rule.MaxScannedBytes > g.MaxScannedBytes)) {
+		g.MaxScannedBytes = rule.MaxScannedBytes
+	}
+}
+
+// allowsKind reports whether the grant includes a query kind
+func (g AccessGrant) allowsKind(kind string) bool {
+	return g.Kinds["*"] || g.Kinds[kind]
+}
+
+// allowsTarget reports whether the grant includes a target
+func (g AccessGrant) allowsTarget(t WAFTarget) bool {
+	return g.AllTargets || g.Targets[strings.ToLower(t.Name)]
+}
+
+// checkQueryAccess checks every table a generated query reads. Queries on tables that are not registered
+// targets are only allowed with access to all targets.
+func (g AccessGrant) checkQueryAccess(query string) string {
+	if isLogsInsightsQuery(query) {
+		target, _, _, errMsg := parseLogsInsightsQuery(query)
+		if errMsg != "" {
+			return errMsg
+		}
+		if !g.allowsTarget(target) {
+			return fmt.Sprintf("the `%s` WAF is not available to you here", target.Name)
+		}
+		return ""
+	}
+
+	targets, unregistered := queryTables(query)
+	for _, target := range targets {
+		if !g.allowsTarget(target) {
+			return fmt.Sprintf("the `%s` WAF is not available to you here", target.Name)
+		}
+	}
+	switch {
+	case len(unregistered) > 0 && !g.AllTargets:
+		return fmt.Sprintf("the query reads `%s`, which is not a WAF table you have access to", unregistered[0])
+	case len(targets) == 0 && !g.AllTargets:
+		return "the query does not use a WAF table you have access to"
+	}
+	return ""
+}
+
+// applyResultLimits withholds results over the scanned bytes limit and truncates rows to the row limit
+func (g AccessGrant) applyResultLimits(rows []*athena.Row, stats QueryStats) ([]*athena.Row, string) {
+	if g.MaxScannedBytes > 0 && stats.DataScannedBytes > g.MaxScannedBytes {
+		return nil, fmt.Sprintf("the query scanned %s, more than the %s allowed for you here; please narrow the time range",
+			formatBytes(stats.DataScannedBytes), formatBytes(g.MaxScannedBytes))
+	}
+	if g.MaxRows > 0 && len(rows) > g.MaxRows+1 {
+		return rows[:g.MaxRows+1], ""
+	}
+	return rows, ""
+}
+
+// isGroupMember reports whether a user belongs to a Slack user group (memberships cached for 5 minutes)
+func isGroupMember(groupID, user string) bool {
+	groupMembersCacheMu.Lock()
+	cached, ok := groupMembersCache[groupID]
+	groupMembersCacheMu.Unlock()
+
+	if !ok || time.Since(cached.fetchedAt) > 5*time.Minute {
+		members, err := getUserGroupMembers(groupID)
+		if err != nil {
+			slog.Warn("Failed to get members of user group", "group", groupID, "error", err)
+			return false
+		}
+		cached = groupMembers{members: make(map[string]bool, len(members)), fetchedAt: time.Now()}
+		for _, m := range members {
+			cached.members[m] = true
+		}
+		groupMembersCacheMu.Lock()
+		groupMembersCache[groupID] = cached
+		groupMembersCacheMu.Unlock()
+	}
+	return cached.members[user]
+}
+
+// denyAccess marks the audit record as denied and tells the user politely (only they see the message)
+func denyAccess(audit *AuditRecord, reason string) {
+	audit.Outcome, audit.Error = "denied", reason
+	slog.Warn("Access denied", "user", audit.User, "channel", audit.Channel, "kind", audit.Kind, "reason", reason)
+	postEphemeral(audit.Channel, audit.User, fmt.Sprintf("Sorry, I can't run that for you: %s. Please ask a WAF admin if you need access.", reason))
+}
+
+// containsString reports whether a list contains a value
+func containsString(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTableReferences(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "schema qualified",
+			query: "SELECT COUNT(*) FROM db1.waf_api WHERE action = 'BLOCK'",
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "quoted",
+			query: `SELECT COUNT(*) FROM "db1"."waf_api"`,
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "backquoted",
+			query: "SELECT COUNT(*) FROM `db1`.`waf_api`",
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "aliased join",
+			query: "SELECT a.ip FROM db1.waf_api AS a JOIN db2.waf_frontend f ON a.ip = f.ip",
+			want:  []string{"db1.waf_api", "db2.waf_frontend"},
+		},
+		{
+			name:  "comma separated from list",
+			query: "SELECT a.ip FROM db1.waf_api a, db2.waf_frontend f WHERE a.ip = f.ip",
+			want:  []string{"db1.waf_api", "db2.waf_frontend"},
+		},
+		{
+			name:  "subquery",
+			query: "SELECT ip FROM (SELECT ip FROM db1.waf_api WHERE action = 'BLOCK') s",
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "cte",
+			query: "WITH blocked AS (SELECT ip FROM db1.waf_api) SELECT COUNT(*) FROM blocked",
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "union",
+			query: "SELECT ip FROM db1.waf_api UNION ALL SELECT ip FROM db2.waf_frontend",
+			want:  []string{"db1.waf_api", "db2.waf_frontend"},
+		},
+		{
+			name:  "extract and strings are not tables",
+			query: "SELECT EXTRACT(HOUR FROM time_dt) h FROM db1.waf_api WHERE uri = 'FROM db2.waf_frontend' -- FROM db3.waf_shared",
+			want:  []string{"db1.waf_api"},
+		},
+		{
+			name:  "unnest",
+			query: "SELECT r FROM db1.waf_api CROSS JOIN UNNEST(rules) AS t(r)",
+			want:  []string{"db1.waf_api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tableReferences(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tableReferences() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckQueryAccess(t *testing.T) {
+	withTargets(t, []WAFTarget{testTargetAPI, testTargetFrontend, testTargetShared})
+	apiOnly := AccessGrant{Targets: map[string]bool{"api": true}, Kinds: map[string]bool{"*": true}}
+	all := AccessGrant{AllTargets: true, Kinds: map[string]bool{"*": true}}
+
+	tests := []struct {
+		name    string
+		grant   AccessGrant
+		query   string
+		allowed bool
+	}{
+		{"allowed target", apiOnly, "SELECT COUNT(*) FROM db1.waf_api", true},
+		{"allowed target without database", apiOnly, "SELECT COUNT(*) FROM waf_api", true},
+		{"allowed quoted target", apiOnly, `SELECT COUNT(*) FROM "db1"."waf_api" a`, true},
+		{"denied target", apiOnly, "SELECT COUNT(*) FROM db2.waf_frontend", false},
+		{"denied quoted target", apiOnly, `SELECT COUNT(*) FROM "db2"."waf_frontend"`, false},
+		{"denied target in subquery", apiOnly, "SELECT ip FROM (SELECT ip FROM db2.waf_frontend) s", false},
+		{"denied target in cte", apiOnly, "WITH x AS (SELECT ip FROM db2.waf_frontend) SELECT ip FROM x", false},
+		{"denied target in union", apiOnly, "SELECT ip FROM db1.waf_api UNION SELECT ip FROM db2.waf_frontend", false},
+		{"denied target in join", apiOnly, "SELECT a.ip FROM db1.waf_api a JOIN db2.waf_frontend f ON a.ip = f.ip", false},
+		{"unregistered table", apiOnly, "SELECT * FROM db9.other_table", false},
+		{"no table", apiOnly, "SELECT 1", false},
+		{"unregistered table with all targets", all, "SELECT * FROM db9.other_table", true},
+		{"any target with all targets", all, "SELECT COUNT(*) FROM db2.waf_frontend", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.grant.checkQueryAccess(tt.query)
+			if (reason == "") != tt.allowed {
+				t.Errorf("checkQueryAccess(%q) = %q, want allowed %v", tt.query, reason, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package analyzer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// RedactionRule describes how result values are redacted before they leave the function
+type RedactionRule struct {
+	IP          string   `json:"ip"`           // none, mask24 (keep /24, IPv6 /48), mask16 (IPv6 /32) or hash
+	StripQuery  bool     `json:"strip_query"`  // Remove query strings from URIs and URLs
+	DropColumns []string `json:"drop_columns"` // Column names or patterns (e.g. "*cookie*") removed from results
+}
+
+// RedactionPolicy is the redaction configuration (REDACTION_POLICY JSON).
+// The default, target and channel rules that apply to a result are combined and the stricter setting wins.
+type RedactionPolicy struct {
+	Default  RedactionRule            `json:"default"`
+	Targets  map[string]RedactionRule `json:"targets"`  // By target name
+	Channels map[string]RedactionRule `json:"channels"` // By Slack channel ID
+}
+
+// Redaction configuration
+var (
+	redactionPolicy = loadRedactionPolicy(os.Getenv("REDACTION_POLICY"))
+	// Key for hashed IPs, so hashes cannot be reversed by hashing the IPv4 space (REDACTION_HASH_KEY)
+	redactionHashKey = os.Getenv("REDACTION_HASH_KEY")
+	// DynamoDB table (partition key: id, TTL attribute: expires_at) keeping button values that a channel's
+	// redaction rule would change, such as the raw IPs behind "Block" and "Investigate" buttons
+	redactedValueTable = os.Getenv("REDACTED_VALUE_TABLE")
+)
+
+// Button values kept server-side expire after this long
+const redactedValueTTL = 7 * 24 * time.Hour
+
+// Prefix of button values that refer to a value kept in REDACTED_VALUE_TABLE
+const buttonRefPrefix = "ref:"
+
+// IP masking levels, least to most strict
+var ipRedactionLevels = map[string]int{"": 0, "none": 0, "mask24": 1, "mask16": 2, "hash": 3}
+
+// Values that look like IP addresses, and URIs or URLs with a query string
+var (
+	ipv4Pattern     = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern     = regexp.MustCompile(`\b(?:[0-9a-fA-F]{1,4}:){2,7}[0-9a-fA-F]{0,4}(?:::?[0-9a-fA-F]{1,4})*\b`)
+	queryURLPattern = regexp.MustCompile(`((?:https?://[^\s?#]*)|(?:^|\s)/[^\s?#]*)\?[^\s#]*`)
+)
+
+// loadRedactionPolicy parses the redaction policy (no redaction when unset)
+func loadRedactionPolicy(config string) RedactionPolicy {
+	var policy RedactionPolicy
+	if config == "" {
+		return policy
+	}
+	if err := json.Unmarshal([]byte(config), &policy); err != nil {
+		// Fail closed: hash IPs (mask them when there is no hash key), strip query strings and drop header-like columns
+		slog.Error("Failed to parse REDACTION_POLICY, redacting everything", "error", err)
+		ip := "hash"
+		if redactionHashKey == "" {
+			ip = "mask16"
+		}
+		policy.Default = RedactionRule{IP: ip, StripQuery: true, DropColumns: []string{"*header*", "*cookie*", "*authorization*"}}
+		return policy
+	}
+	for name := range policy.Targets {
+		if _, ok := findTarget(name); !ok {
+			slog.Warn("REDACTION_POLICY names an unknown target", "target", name)
+		}
+	}
+	if redactionHashKey == "" && policy.usesHash() {
+		slog.Error("REDACTION_POLICY hashes IPs but REDACTION_HASH_KEY is empty; hashed IPs can be reversed by hashing every address")
+	}
+	slog.Info("Loaded redaction policy", "target_rules", len(policy.Targets), "channel_rules", len(policy.Channels))
+	return policy
+}
+
+// usesHash reports whether any rule of the policy hashes IPs
+func (p RedactionPolicy) usesHash() bool {
+	rules := []RedactionRule{p.Default}
+	for _, r := range p.Targets {
+		rules = append(rules, r)
+	}
+	for _, r := range p.Channels {
+		rules = append(rules, r)
+	}
+	for _, r := range rules {
+		if strings.EqualFold(r.IP, "hash") {
+			return true
+		}
+	}
+	return false
+}
+
+// redactionFor combines the rules for the result's targets and the channel it is posted to
+func redactionFor(targets []string, channel string) RedactionRule {
+	rule := redactionPolicy.Default
+	for _, t := range targets {
+		for name, r := range redactionPolicy.Targets {
+			if strings.EqualFold(name, t) {
+				rule = rule.merge(r)
+			}
+		}
+	}
+	if r, ok := redactionPolicy.Channels[channel]; ok && channel != "" {
+		rule = rule.merge(r)
+	}
+	return rule
+}
+
+// merge combines two rules, keeping the stricter setting of each
+func (r RedactionRule) merge(other RedactionRule) RedactionRule {
+	if ipRedactionLevels[strings.ToLower(other.IP)] > ipRedactionLevels[strings.ToLower(r.IP)] {
+		r.IP = other.IP
+	}
+	r.StripQuery = r.StripQuery || other.StripQuery
+	r.DropColumns = append(append([]string(nil), r.DropColumns...), other.DropColumns...)
+	return r
+}
+
+// isNoop reports whether the rule leaves results unchanged
+func (r RedactionRule) isNoop() bool {
+	return ipRedactionLevels[strings.ToLower(r.IP)] == 0 && !r.StripQuery && len(r.DropColumns) == 0
+}
+
+// redactRows returns a redacted copy of Athena rows (header first); the input rows are not modified
+func redactRows(rows []*athena.Row, rule RedactionRule) []*athena.Row {
+	if rule.isNoop() || len(rows) == 0 {
+		return rows
+	}
+
+	headers, values := rowValues(rows)
+	var keep []int
+	for i, h := range headers {
+		if !rule.dropsColumn(h) {
+			keep = append(keep, i)
+		}
+	}
+
+	header := make([]string, 0, len(keep))
+	for _, i := range keep {
+		header = append(header, headers[i])
+	}
+	result := []*athena.Row{stringsToRow(header)}
+	for _, v := range values {
+		out := make([]string, 0, len(keep))
+		for _, i := range keep {
+			if v[i] == "NULL" {
+				out = append(out, v[i])
+			} else {
+				out = append(out, rule.redactValue(v[i]))
+			}
+		}
+		result = append(result, stringsToRow(out))
+	}
+	return result
+}
+
+// dropsColumn reports whether a column is removed by the rule (case-insensitive, shell patterns allowed)
+func (r RedactionRule) dropsColumn(column string) bool {
+	column = strings.ToLower(column)
+	for _, pattern := range r.DropColumns {
+		pattern = strings.ToLower(pattern)
+		if ok, _ := path.Match(pattern, column); ok || pattern == column {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue masks or hashes the IPs and strips the query strings in a value
+func (r RedactionRule) redactValue(value string) string {
+	if r.StripQuery {
+		value = queryURLPattern.ReplaceAllString(value, "$1?[redacted]")
+	}
+
+	mode := strings.ToLower(r.IP)
+	if ipRedactionLevels[mode] == 0 {
+		return value
+	}
+	replace := func(s string) string {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return s
+		}
+		return redactIP(ip, mode)
+	}
+	value = ipv4Pattern.ReplaceAllStringFunc(value, replace)
+	return ipv6Pattern.ReplaceAllStringFunc(value, replace)
+}
+
+// redactIP masks an address to its network or replaces it with a keyed hash
+func redactIP(ip net.IP, mode string) string {
+	if mode == "hash" {
+		mac := hmac.New(sha256.New, []byte(redactionHashKey))
+		mac.Write([]byte(ip.String()))
+		return "ip-" + hex.EncodeToString(mac.Sum(nil))[:12]
+	}
+
+	bits := map[string][2]int{"mask24": {24, 48}, "mask16": {16, 32}}[mode]
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(bits[0], 32)), Mask: net.CIDRMask(bits[0], 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(bits[1], 128)), Mask: net.CIDRMask(bits[1], 128)}).String()
+}
+
+// displayCIDR shows a CIDR as the rule allows: "203.0.113.10/32" becomes "/32 in 203.0.113.0/24" (mask24)
+// or "ip-1a2b3c4d5e6f/32" (hash)
+func (r RedactionRule) displayCIDR(cidr string) string {
+	addr, bits, ok := strings.Cut(cidr, "/")
+	redacted := r.redactValue(addr)
+	switch {
+	case !ok || redacted == addr:
+		return r.redactValue(cidr)
+	case redacted == cidr || widerThan(cidr, redacted):
+		// The network is no more specific than the rule shows
+		return cidr
+	case strings.Contains(redacted, "/"):
+		return "/" + bits + " in " + redacted
+	default:
+		return redacted + "/" + bits
+	}
+}
+
+// widerThan reports whether a CIDR's prefix is no longer than that of the masked network shown instead of it
+func widerThan(cidr, masked string) bool {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	_, shown, err := net.ParseCIDR(masked)
+	if err != nil {
+		return false
+	}
+	ones, _ := network.Mask.Size()
+	shownOnes, _ := shown.Mask.Size()
+	return ones <= shownOnes
+}
+
+// hiddenValue is a button value kept out of Slack
+type hiddenValue struct {
+	ID        string `dynamodbav:"id"`
+	Value     string `dynamodbav:"value"`
+	ExpiresAt int64  `dynamodbav:"expires_at"`
+}
+
+// buttonValueFor returns the value a button carries in a channel: the value itself, or a reference to it kept
+// server-side when the channel's redaction rule would change it
+func buttonValueFor(value string, rule RedactionRule) (string, error) {
+	if rule.redactValue(value) == value {
+		return value, nil
+	}
+	return storeButtonValue(value)
+}
+
+// storeButtonValue keeps a button value server-side and returns the reference the button carries instead
+func storeButtonValue(value string) (string, error) {
+	if redactedValueTable == "" {
+		return "", fmt.Errorf("buttons with redacted values require REDACTED_VALUE_TABLE")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	item, err := dynamodbattribute.MarshalMap(hiddenValue{
+		ID:        hex.EncodeToString(id),
+		Value:     value,
+		ExpiresAt: time.Now().Add(redactedValueTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := getDynamoClient().PutItem(&dynamodb.PutItemInput{TableName: aws.String(redactedValueTable), Item: item}); err != nil {
+		return "", fmt.Errorf("failed to store button value: %v", err)
+	}
+	return buttonRefPrefix + hex.EncodeToString(id), nil
+}
+
+// resolveButtonValue returns the value of a button, looking up values kept server-side by buttonValueFor
+func resolveButtonValue(value string) (string, error) {
+	id, ok := strings.CutPrefix(value, buttonRefPrefix)
+	if !ok {
+		return value, nil
+	}
+	if redactedValueTable == "" {
+		return "", fmt.Errorf("REDACTED_VALUE_TABLE is not set")
+	}
+
+	out, err := getDynamoClient().GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(redactedValueTable),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read button value: %v", err)
+	}
+	var item hiddenValue
+	if err := dynamodbattribute.UnmarshalMap(out.Item, &item); err != nil {
+		return "", err
+	}
+	if item.ID == "" || (item.ExpiresAt > 0 && item.ExpiresAt < time.Now().Unix()) {
+		return "", fmt.Errorf("this button has expired")
+	}
+	return item.Value, nil
+}
@@ -0,0 +1,140 @@
+package analyzer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  RedactionRule
+		value string
+		want  string
+	}{
+		{"none", RedactionRule{}, "203.0.113.10", "203.0.113.10"},
+		{"mask24", RedactionRule{IP: "mask24"}, "203.0.113.10", "203.0.113.0/24"},
+		{"mask16", RedactionRule{IP: "mask16"}, "203.0.113.10", "203.0.0.0/16"},
+		{"mask24 ipv6", RedactionRule{IP: "mask24"}, "2001:db8:1:2::10", "2001:db8:1::/48"},
+		{"mask16 ipv6", RedactionRule{IP: "mask16"}, "2001:db8:1:2::10", "2001:db8::/32"},
+		{"ip inside text", RedactionRule{IP: "mask24"}, "from 192.0.2.55 via 198.51.100.7", "from 192.0.2.0/24 via 198.51.100.0/24"},
+		{"not an ip", RedactionRule{IP: "mask24"}, "999.1.1.1", "999.1.1.1"},
+		{"mode is case-insensitive", RedactionRule{IP: "MASK24"}, "203.0.113.10", "203.0.113.0/24"},
+		{"query string", RedactionRule{StripQuery: true}, "/login?user=alice&token=x", "/login?[redacted]"},
+		{"url query string", RedactionRule{StripQuery: true}, "GET https://example.com/a?b=c", "GET https://example.com/a?[redacted]"},
+		{"no query string", RedactionRule{StripQuery: true}, "/login", "/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.redactValue(tt.value); got != tt.want {
+				t.Errorf("redactValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactValueHash(t *testing.T) {
+	saved := redactionHashKey
+	redactionHashKey = "test-key"
+	t.Cleanup(func() { redactionHashKey = saved })
+
+	rule := RedactionRule{IP: "hash"}
+	a, b := rule.redactValue("203.0.113.10"), rule.redactValue("203.0.113.11")
+	if a == "203.0.113.10" || len(a) != len("ip-")+12 || a[:3] != "ip-" {
+		t.Errorf("redactValue() = %q, want an ip- hash", a)
+	}
+	if a == b {
+		t.Errorf("different addresses hash to the same value %q", a)
+	}
+	if again := rule.redactValue("203.0.113.10"); again != a {
+		t.Errorf("hash is not stable: %q then %q", a, again)
+	}
+}
+
+func TestRedactionRuleMerge(t *testing.T) {
+	base := RedactionRule{IP: "mask16", DropColumns: []string{"*cookie*"}}
+	got := base.merge(RedactionRule{IP: "mask24", StripQuery: true, DropColumns: []string{"uri"}})
+	want := RedactionRule{IP: "mask16", StripQuery: true, DropColumns: []string{"*cookie*", "uri"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merge() = %+v, want %+v", got, want)
+	}
+	if got := base.merge(RedactionRule{IP: "hash"}); got.IP != "hash" {
+		t.Errorf("merge() IP = %q, want the stricter hash", got.IP)
+	}
+}
+
+func TestRedactionFor(t *testing.T) {
+	saved := redactionPolicy
+	redactionPolicy = RedactionPolicy{
+		Default:  RedactionRule{IP: "mask16"},
+		Targets:  map[string]RedactionRule{"api": {StripQuery: true}},
+		Channels: map[string]RedactionRule{"C123": {IP: "hash", DropColumns: []string{"*header*"}}},
+	}
+	t.Cleanup(func() { redactionPolicy = saved })
+
+	tests := []struct {
+		name    string
+		targets []string
+		channel string
+		want    RedactionRule
+	}{
+		{"default", nil, "", RedactionRule{IP: "mask16"}},
+		{"target", []string{"API"}, "", RedactionRule{IP: "mask16", StripQuery: true}},
+		{"channel", []string{"frontend"}, "C123", RedactionRule{IP: "hash", DropColumns: []string{"*header*"}}},
+		{"target and channel", []string{"api"}, "C123", RedactionRule{IP: "hash", StripQuery: true, DropColumns: []string{"*header*"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactionFor(tt.targets, tt.channel); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("redactionFor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactRows(t *testing.T) {
+	rows := testRows(
+		[]string{"ip", "uri", "Cookie_Header", "c"},
+		[]string{"203.0.113.10", "/a?x=1", "session=abc", "3"},
+		[]string{"NULL", "/b", "NULL", "1"},
+	)
+	rule := RedactionRule{IP: "mask24", StripQuery: true, DropColumns: []string{"*cookie*"}}
+
+	headers, values := rowValues(redactRows(rows, rule))
+	got := append([][]string{headers}, values...)
+	want := [][]string{
+		{"ip", "uri", "c"},
+		{"203.0.113.0/24", "/a?[redacted]", "3"},
+		{"NULL", "/b", "1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("redactRows() = %v, want %v", got, want)
+	}
+
+	// The input is left as it was
+	if _, values := rowValues(rows); values[0][0] != "203.0.113.10" || len(values[0]) != 4 {
+		t.Errorf("redactRows() modified its input: %v", values[0])
+	}
+	if out := redactRows(rows, RedactionRule{IP: "none"}); len(out) != len(rows) || out[0] != rows[0] {
+		t.Errorf("a no-op rule should return the rows unchanged")
+	}
+}
+
+func TestDisplayCIDR(t *testing.T) {
+	tests := []struct {
+		rule RedactionRule
+		cidr string
+		want string
+	}{
+		{RedactionRule{}, "203.0.113.10/32", "203.0.113.10/32"},
+		{RedactionRule{IP: "mask24"}, "203.0.113.10/32", "/32 in 203.0.113.0/24"},
+		{RedactionRule{IP: "mask24"}, "203.0.113.0/24", "203.0.113.0/24"},
+		{RedactionRule{IP: "mask24"}, "203.0.0.0/16", "203.0.0.0/16"},
+		{RedactionRule{IP: "mask16"}, "203.0.113.0/24", "/24 in 203.0.0.0/16"},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.displayCIDR(tt.cidr); got != tt.want {
+			t.Errorf("displayCIDR(%q) with %q = %q, want %q", tt.cidr, tt.rule.IP, got, tt.want)
+		}
+	}
+}
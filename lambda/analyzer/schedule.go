@@ -0,0 +1,86 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ScheduledEvent is the EventBridge scheduled invocation payload.
+// A rule may pass a constant input such as {"task":"expire_blocks"} or
+// {"task":"digest","period":"weekly"} to select the task.
+// The handler also invokes itself with {"task":"answer"} to answer acknowledged Slack requests.
+type ScheduledEvent struct {
+	Source     string          `json:"source"`
+	DetailType string          `json:"detail-type"`
+	Task       string          `json:"task"`
+	Period     string          `json:"period"`           // digest: "daily" (default) or "weekly"
+	Channels   []string        `json:"channels"`         // digest: overrides DIGEST_CHANNELS
+	Answer     *DeferredAnswer `json:"answer,omitempty"` // answer: the request to answer
+}
+
+// Dispatch routes a raw Lambda invocation to the API Gateway handler or the scheduled task runner
+func Dispatch(ctx context.Context, raw json.RawMessage) (result interface{}, err error) {
+	beginRequestLog()
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		ctx = withLogAttrs(ctx, "request_id", lc.AwsRequestID)
+	}
+	ctx = withLambdaTraceParent(ctx)
+	defer flushTraces(ctx)
+	beginFixtureRecording(ctx, raw)
+	defer func() { finishFixtureRecording(result) }()
+
+	var probe struct {
+		HTTPMethod     string          `json:"httpMethod"`
+		RequestContext json.RawMessage `json:"requestContext"`
+	}
+	if err := json.Unmarshal(raw, &probe); err == nil && (probe.HTTPMethod != "" || probe.RequestContext != nil) {
+		var req events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			slog.ErrorContext(ctx, "Failed to parse API Gateway request", "error", err)
+			return response(400, "invalid request"), nil
+		}
+		return handler(ctx, req)
+	}
+
+	var event ScheduledEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		slog.ErrorContext(ctx, "Failed to parse invocation payload", "error", err)
+		return nil, err
+	}
+	return nil, runScheduledTask(ctx, event)
+}
+
+// runScheduledTask executes the task requested by a scheduled invocation
+func runScheduledTask(ctx context.Context, event ScheduledEvent) error {
+	ctx, span := startRequestSpan(ctx, "scheduled_task", attribute.String("task", event.Task))
+	defer span.End()
+
+	slog.InfoContext(ctx, "Scheduled invocation", "source", event.Source, "detail_type", event.DetailType, "task", event.Task)
+
+	switch event.Task {
+	case "", "expire_blocks":
+		// Default maintenance: remove expired IP set blocks
+		return expireBlocks()
+	case "digest":
+		period := event.Period
+		if period == "" {
+			period = "daily"
+		}
+		return runDigest(ctx, period, event.Channels)
+	case "detect":
+		return runAnomalyDetection(ctx)
+	case "answer":
+		if event.Answer != nil {
+			runDeferredAnswer(ctx, *event.Answer)
+		}
+		return nil
+	default:
+		slog.WarnContext(ctx, "Unknown scheduled task", "task", event.Task)
+		return nil
+	}
+}
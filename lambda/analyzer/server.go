@@ -0,0 +1,200 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// serverShuttingDown is set once a shutdown signal is received (readiness then fails)
+var serverShuttingDown atomic.Bool
+
+// runServeCommand runs the analyzer as a long-running HTTP server (ECS, laptop)
+func runServeCommand(args []string) int {
+	defaultAddr := envOrDefault("LISTEN_ADDR", ":"+envOrDefault("PORT", "8080"))
+
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", defaultAddr, "listen address (env LISTEN_ADDR or PORT)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 60*time.Second, "time to let in-flight requests finish on shutdown")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// Requests run concurrently, so only request contexts carry request attributes
+	requestLogAttrsOn.Store(false)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/", handleAPIGatewayHTTP)
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("HTTP server listening", "addr", *addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server error", "error", err)
+			return 1
+		}
+		return 0
+	case <-ctx.Done():
+	}
+
+	// Stop advertising readiness, then let in-flight requests (Athena polling) finish
+	serverShuttingDown.Store(true)
+	slog.Info("Shutdown signal received, draining requests", "timeout", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown error", "error", err)
+		return 1
+	}
+	// Answers to slash commands and buttons run after the acknowledgement
+	answersDone := make(chan struct{})
+	go func() {
+		deferredAnswers.Wait()
+		close(answersDone)
+	}()
+	select {
+	case <-answersDone:
+	case <-shutdownCtx.Done():
+		slog.Error("Shutdown timeout reached with answers still running")
+		return 1
+	}
+	slog.Info("HTTP server stopped")
+	return 0
+}
+
+// handleHealthz reports that the process is alive
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "ok")
+}
+
+// handleReadyz reports whether the server can serve Slack requests
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if serverShuttingDown.Load() {
+		problems = append(problems, "shutting down")
+	}
+	if slackToken == "" {
+		problems = append(problems, "Slack token not loaded")
+	}
+	if athenaOutput == "" {
+		problems = append(problems, "ATHENA_OUTPUT_BUCKET not set")
+	}
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, strings.Join(problems, "\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "ready")
+}
+
+// handleAPIGatewayHTTP adapts a net/http request to the API Gateway handler
+func handleAPIGatewayHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := apiGatewayRequestFromHTTP(r)
+	if err != nil {
+		slog.Warn("Failed to read HTTP request", "error", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Slack closes the connection after 3 seconds; keep processing the request regardless
+	ctx := context.WithoutCancel(r.Context())
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		slog.Error("Handler error", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeAPIGatewayResponse(w, resp)
+}
+
+// apiGatewayRequestFromHTTP converts a net/http request into an API Gateway proxy request
+func apiGatewayRequestFromHTTP(r *http.Request) (events.APIGatewayProxyRequest, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, err
+	}
+
+	headers := make(map[string]string, len(r.Header))
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			headers[k] = v[0]
+		}
+	}
+
+	query := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		if len(v) > 0 {
+			query[k] = v[0]
+		}
+	}
+
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:                      r.Method,
+		Path:                            r.URL.Path,
+		Resource:                        r.URL.Path,
+		Headers:                         headers,
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           query,
+		MultiValueQueryStringParameters: r.URL.Query(),
+		Body:                            string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			RequestID:  fmt.Sprintf("local-%d", time.Now().UnixNano()),
+			HTTPMethod: r.Method,
+			Path:       r.URL.Path,
+			Identity: events.APIGatewayRequestIdentity{
+				SourceIP: r.RemoteAddr,
+			},
+		},
+	}, nil
+}
+
+// writeAPIGatewayResponse writes an API Gateway proxy response to a net/http response writer
+func writeAPIGatewayResponse(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, values := range resp.MultiValueHeaders {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, resp.Body)
+}
@@ -0,0 +1,405 @@
+package analyzer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Hold hashes of recently sent Slack messages
+var (
+	recentSlackMessages   = make(map[string]time.Time)
+	recentSlackMessagesMu sync.Mutex
+)
+
+// markMessageSent records a message hash in the send history. It reports a duplicate (and how long ago the
+// message was sent) when the same message was sent within the last 3 minutes.
+func markMessageSent(msgHash string) (time.Duration, bool) {
+	recentSlackMessagesMu.Lock()
+	defer recentSlackMessagesMu.Unlock()
+
+	if lastTime, exists := recentSlackMessages[msgHash]; exists {
+		if timeSince := time.Since(lastTime); timeSince < 3*time.Minute {
+			return timeSince, true
+		}
+	}
+	recentSlackMessages[msgHash] = time.Now()
+
+	// Size limit: delete entries older than 10 minutes (keep cache clean)
+	if len(recentSlackMessages) > 50 {
+		now := time.Now()
+		cleanedCount := 0
+		for k, t := range recentSlackMessages {
+			if now.Sub(t) > 10*time.Minute {
+				delete(recentSlackMessages, k)
+				cleanedCount++
+			}
+		}
+		slog.Debug("Cleaned up Slack message cache", "deleted", cleanedCount, "remaining", len(recentSlackMessages))
+	}
+	return 0, false
+}
+
+type threadContextKey struct{}
+
+// withThread makes messages posted with the context reply in a Slack thread
+func withThread(ctx context.Context, threadTS string) context.Context {
+	return context.WithValue(ctx, threadContextKey{}, threadTS)
+}
+
+// threadFromContext returns the thread attached to a context ("" posts to the channel)
+func threadFromContext(ctx context.Context) string {
+	threadTS, _ := ctx.Value(threadContextKey{}).(string)
+	return threadTS
+}
+
+// postToSlack sends a message to a Slack channel
+func postToSlack(channel, msg string) error {
+	_, err := postToSlackWithTS(context.Background(), channel, msg)
+	return err
+}
+
+// postToSlackWithTS sends a message to a Slack channel, in the thread attached to the context if any, and returns
+// its ts (empty when suppressed as a duplicate)
+func postToSlackWithTS(ctx context.Context, channel, msg string) (ts string, err error) {
+	ctx, span := startSpan(ctx, "slack.post", attribute.String("slack.channel", channel), attribute.Int("slack.message_length", len(msg)))
+	defer func() {
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		span.SetAttributes(attribute.Bool("slack.duplicate", ts == "" && err == nil))
+		endSpan(span, errMsg)
+	}()
+
+	// Message duplication check (don't send identical or similar messages to the same channel)
+	// Generate message hash (improved for more reliable duplicate detection)
+	// Basic format: "channel + characteristic part of message"
+	contentSignature := msg
+
+	// Extract characteristic part if message is long
+	if len(msg) > 50 {
+		// Extract data part from logs
+		if strings.Contains(msg, "*result:*") {
+			// Get result count part (becomes important characteristic)
+			resultParts := strings.Split(msg, "*result:*")
+			if len(resultParts) > 1 {
+				countPart := strings.Split(resultParts[1], "\n")[0]
+				contentSignature = fmt.Sprintf("WAF result:%s", countPart)
+			}
+		}
+	}
+
+	msgHash := fmt.Sprintf("%s:%s", channel, contentSignature)
+	slog.Debug("Message signature", "channel", channel, "text", contentSignature)
+
+	// Check if identical or similar message was sent within the last 3 minutes
+	// Use longer time to prevent duplicate sending
+	if timeSince, duplicate := markMessageSent(msgHash); duplicate {
+		slog.Info("Suppressing duplicate Slack message", "channel", channel, "sent_ago_seconds", timeSince.Seconds())
+		putCount(ctx, "DedupeHits", map[string]string{"Kind": "message"})
+		return "", nil
+	}
+
+	// Token check
+	if slackToken == "" {
+		errMsg := "Slack token is empty. Unable to send message to Slack."
+		slog.Error(errMsg)
+		return "", errors.New(errMsg)
+	}
+
+	slackURL := "https://slack.com/api/chat.postMessage"
+
+	// Perform proper escape processing with JSON encoding
+	message := map[string]string{
+		"channel": channel,
+		"text":    msg,
+	}
+	if threadTS := threadFromContext(ctx); threadTS != "" {
+		message["thread_ts"] = threadTS
+	}
+	reqBody, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Slack JSON encoding error", "error", err)
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", slackURL, bytes.NewBuffer(reqBody))
+	if err != nil {
+		slog.Error("Slack request creation error", "error", err)
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+slackToken)
+
+	// The message text is logged according to LOG_USER_TEXT (truncated by default)
+	slog.Debug("Sending to Slack", "channel", channel, "text", msg)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Slack request error", "channel", channel, "error", err)
+		putCount(ctx, "SlackAPIErrors", map[string]string{"Method": "chat.postMessage"})
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Read response body to check details
+	var respBody []byte
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Failed to read Slack response body", "error", err)
+		return "", err
+	}
+
+	// Output response to logs (for diagnostics)
+	slog.Debug("Slack API response", "status", resp.StatusCode, "body_length", len(respBody))
+
+	// Parse response from Slack
+	var slackResp map[string]interface{}
+	if err := json.Unmarshal(respBody, &slackResp); err != nil {
+		slog.Error("Failed to parse Slack response", "error", err)
+		return "", err
+	}
+
+	// Check if successful
+	if success, ok := slackResp["ok"].(bool); ok && success {
+		slog.Info("Sent Slack message", "channel", channel)
+		ts, _ := slackResp["ts"].(string)
+		return ts, nil
+	} else {
+		// Get error details
+		errMsg := "Unknown error"
+		if slackErr, ok := slackResp["error"].(string); ok {
+			errMsg = slackErr
+		}
+		slog.Error("Slack API error", "method", "chat.postMessage", "channel", channel, "error", errMsg)
+		putCount(ctx, "SlackAPIErrors", map[string]string{"Method": "chat.postMessage"})
+		return "", fmt.Errorf("Slack API error: %s", errMsg)
+	}
+}
+
+// More detailed Slack event structure
+type SlackEventWrapper struct {
+	Token    string `json:"token"`
+	TeamID   string `json:"team_id"`
+	APIAppID string `json:"api_app_id"`
+	Event    struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		User     string `json:"user"`
+		Channel  string `json:"channel"`
+		EventTS  string `json:"event_ts"`
+		TS       string `json:"ts"`
+		ThreadTS string `json:"thread_ts"`
+	} `json:"event"`
+	Type           string `json:"type"`
+	EventID        string `json:"event_id"`
+	EventTime      int    `json:"event_time"`
+	Challenge      string `json:"challenge"`
+	AuthorizedUser string `json:"authorized_user"`
+}
+
+// callSlackAPI calls a Slack Web API method with a JSON body and returns the parsed response
+func callSlackAPI(method string, payload map[string]interface{}) (map[string]interface{}, error) {
+	if slackToken == "" {
+		return nil, errors.New("Slack token is empty. Unable to call Slack API.")
+	}
+
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", "https://slack.com/api/"+method, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+slackToken)
+
+	return doSlackRequest(method, req)
+}
+
+// callSlackAPIForm calls a Slack Web API method that only accepts form parameters (read methods)
+func callSlackAPIForm(method string, params url.Values) (map[string]interface{}, error) {
+	if slackToken == "" {
+		return nil, errors.New("Slack token is empty. Unable to call Slack API.")
+	}
+
+	req, err := http.NewRequest("POST", "https://slack.com/api/"+method, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+slackToken)
+
+	return doSlackRequest(method, req)
+}
+
+// doSlackRequest sends a prepared Slack API request and checks the "ok" field of the response
+func doSlackRequest(method string, req *http.Request) (map[string]interface{}, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Slack request error", "method", method, "error", err)
+		putCount(context.Background(), "SlackAPIErrors", map[string]string{"Method": method})
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var slackResp map[string]interface{}
+	if err := json.Unmarshal(respBody, &slackResp); err != nil {
+		slog.Error("Failed to parse Slack response", "method", method, "error", err)
+		return nil, err
+	}
+
+	if success, ok := slackResp["ok"].(bool); !ok || !success {
+		errMsg := "Unknown error"
+		if slackErr, ok := slackResp["error"].(string); ok {
+			errMsg = slackErr
+		}
+		slog.Error("Slack API error", "method", method, "error", errMsg)
+		putCount(context.Background(), "SlackAPIErrors", map[string]string{"Method": method})
+		return slackResp, fmt.Errorf("Slack API error: %s", errMsg)
+	}
+
+	return slackResp, nil
+}
+
+// postBlocksToSlack sends a Block Kit message to a Slack channel (text is used as notification fallback)
+func postBlocksToSlack(channel, text string, blocks []map[string]interface{}) error {
+	_, err := callSlackAPI("chat.postMessage", map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+		"blocks":  blocks,
+	})
+	return err
+}
+
+// postEphemeral sends a message only the user sees in the channel
+func postEphemeral(channel, user, text string) {
+	if _, err := callSlackAPI("chat.postEphemeral", map[string]interface{}{
+		"channel": channel,
+		"user":    user,
+		"text":    text,
+	}); err != nil {
+		slog.Error("Failed to post ephemeral message", "channel", channel, "user", user, "error", err)
+	}
+}
+
+// uploadFileToSlack uploads a file to a channel (files.getUploadURLExternal + files.completeUploadExternal)
+func uploadFileToSlack(channel, filename, title string, content []byte) error {
+	slackResp, err := callSlackAPIForm("files.getUploadURLExternal", url.Values{
+		"filename": {filename},
+		"length":   {strconv.Itoa(len(content))},
+	})
+	if err != nil {
+		return err
+	}
+	uploadURL, _ := slackResp["upload_url"].(string)
+	fileID, _ := slackResp["file_id"].(string)
+	if uploadURL == "" || fileID == "" {
+		return errors.New("Slack did not return an upload URL")
+	}
+
+	resp, err := http.Post(uploadURL, "application/octet-stream", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Slack file upload returned %d", resp.StatusCode)
+	}
+
+	_, err = callSlackAPI("files.completeUploadExternal", map[string]interface{}{
+		"files":      []map[string]string{{"id": fileID, "title": title}},
+		"channel_id": channel,
+	})
+	return err
+}
+
+// postToResponseURL replies to an interaction via its response_url (used to replace the original message)
+func postToResponseURL(responseURL string, payload map[string]interface{}) error {
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(responseURL, "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		slog.Error("Slack response_url request error", "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Slack response_url returned %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// getUserGroupMembers returns the user IDs belonging to a Slack user group
+func getUserGroupMembers(groupID string) ([]string, error) {
+	slackResp, err := callSlackAPIForm("usergroups.users.list", url.Values{"usergroup": {groupID}})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []string
+	if users, ok := slackResp["users"].([]interface{}); ok {
+		for _, u := range users {
+			if id, ok := u.(string); ok {
+				members = append(members, id)
+			}
+		}
+	}
+	return members, nil
+}
+
+// verifySlackSignature validates the X-Slack-Signature header of a request using the signing secret
+func verifySlackSignature(headers map[string]string, body string) bool {
+	if slackSigningSecret == "" {
+		slog.Warn("SLACK_SIGNING_SECRET is not set, cannot verify request signature")
+		return false
+	}
+
+	timestamp := headerValue(headers, "X-Slack-Request-Timestamp")
+	signature := headerValue(headers, "X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return false
+	}
+
+	// Reject requests older than 5 minutes (replay protection)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(ts, 0)) > 5*time.Minute {
+		slog.Warn("Slack request timestamp is invalid or too old", "timestamp", timestamp)
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(slackSigningSecret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
@@ -0,0 +1,151 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// SlashCommand is the form payload Slack sends for a slash command (e.g. /waf)
+type SlashCommand struct {
+	Command     string
+	Text        string
+	UserID      string
+	ChannelID   string
+	TeamID      string
+	ResponseURL string
+}
+
+// isSlashCommandRequest determines whether the request is a form-encoded slash command
+// (Events API payloads are JSON, even when a message text contains "&command=")
+func isSlashCommandRequest(headers map[string]string, body string) bool {
+	if strings.HasPrefix(strings.TrimSpace(body), "{") {
+		return false
+	}
+	if ct := headerValue(headers, "Content-Type"); ct != "" && !strings.HasPrefix(strings.ToLower(ct), "application/x-www-form-urlencoded") {
+		return false
+	}
+	return strings.HasPrefix(body, "command=") || strings.Contains(body, "&command=")
+}
+
+// parseSlashCommand decodes the slash command form body
+func parseSlashCommand(body string) (SlashCommand, error) {
+	form, err := url.ParseQuery(body)
+	if err != nil {
+		return SlashCommand{}, err
+	}
+	return SlashCommand{
+		Command:     form.Get("command"),
+		Text:        strings.TrimSpace(form.Get("text")),
+		UserID:      form.Get("user_id"),
+		ChannelID:   form.Get("channel_id"),
+		TeamID:      form.Get("team_id"),
+		ResponseURL: form.Get("response_url"),
+	}, nil
+}
+
+// slashCommandHelp is the usage shown for "/waf help"
+func slashCommandHelp() string {
+	var sb strings.Builder
+	sb.WriteString("*WAF log analyzer*\n")
+	sb.WriteString("`/waf <question>` ask a question about WAF logs, e.g. `/waf top 5 source IPs on the api WAF in the past 3 days`\n")
+	sb.WriteString("`/waf sql <query>` run a read-only SQL query as is\n")
+	sb.WriteString("`/waf export <question>` answer a question with the result as a CSV file\n")
+	sb.WriteString("`/waf audit [@user] [count]` list recent activity\n")
+	sb.WriteString("`/waf help` show this help\n\n")
+	sb.WriteString("*Targets:* ")
+	var names []string
+	for _, t := range wafTargets {
+		names = append(names, fmt.Sprintf("`%s` (%s)", t.Name, t.Description))
+	}
+	sb.WriteString(strings.Join(names, ", "))
+	return sb.String()
+}
+
+// handleSlashCommand processes a /waf slash command
+func handleSlashCommand(ctx context.Context, req events.APIGatewayProxyRequest, body string) (events.APIGatewayProxyResponse, error) {
+	if !verifySlackSignature(req.Headers, body) {
+		slog.WarnContext(ctx, "Rejecting slash command with invalid Slack signature")
+		return response(401, "invalid signature"), nil
+	}
+
+	cmd, err := parseSlashCommand(body)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse slash command", "error", err)
+		return response(400, "invalid request"), nil
+	}
+	ctx = withLogAttrs(ctx, "user", cmd.UserID, "channel", cmd.ChannelID)
+	slog.InfoContext(ctx, "Received slash command", "command", cmd.Command)
+
+	if cmd.Text == "" || strings.EqualFold(cmd.Text, "help") {
+		help := slashCommandHelp()
+		if quota := describeQuota(cmd.UserID, cmd.ChannelID); quota != "" {
+			help += "\n\n" + quota
+		}
+		return slashCommandResponse("ephemeral", help), nil
+	}
+
+	if sub, rest, _ := strings.Cut(cmd.Text, " "); strings.EqualFold(sub, accessAudit) {
+		return slashCommandResponse("ephemeral", slashAuditReply(cmd, rest)), nil
+	}
+
+	if len(cmd.Text) < 3 {
+		return slashCommandResponse("ephemeral", "Please ask a longer question. Try `/waf help`."), nil
+	}
+
+	// "sql" and "export" select the query kind checked by the access policy
+	kind, text := accessAsk, cmd.Text
+	if sub, rest, ok := strings.Cut(cmd.Text, " "); ok {
+		switch strings.ToLower(sub) {
+		case accessSQL, accessExport:
+			kind, text = strings.ToLower(sub), strings.TrimSpace(rest)
+		}
+	}
+
+	// Acknowledge in the channel within Slack's 3 seconds, then answer like a mention
+	answerLater(ctx, DeferredAnswer{Channel: cmd.ChannelID, User: cmd.UserID, Text: text, Kind: kind, Source: "slash", Team: cmd.TeamID})
+	return slashCommandResponse("in_channel", fmt.Sprintf("<@%s> asked: _%s_", cmd.UserID, cmd.Text)), nil
+}
+
+// Slack user mentions in slash command text, e.g. <@U123ABC|alice>
+var slackUserMentionPattern = regexp.MustCompile(`^<@([A-Z0-9]+)(\|[^>]*)?>$`)
+
+// slashAuditReply lists recent activity for "/waf audit [@user] [count]"
+func slashAuditReply(cmd SlashCommand, args string) string {
+	if !authorize(cmd.UserID, cmd.ChannelID).allowsKind(accessAudit) {
+		slog.Warn("Access denied", "user", cmd.UserID, "channel", cmd.ChannelID, "kind", accessAudit)
+		return "Sorry, listing activity is not enabled for you in this channel. Please ask a WAF admin if you need access."
+	}
+
+	limit, user := 10, ""
+	for _, arg := range strings.Fields(args) {
+		if m := slackUserMentionPattern.FindStringSubmatch(arg); m != nil {
+			user = m[1]
+		} else if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			limit = min(n, 50)
+		}
+	}
+
+	records, err := auditSink.Recent(limit, user)
+	if err != nil {
+		slog.Warn("Failed to list audit records", "error", err)
+		return fmt.Sprintf("Failed to list recent activity: %v", err)
+	}
+	return "*Recent activity*\n```\n" + formatAuditRecords(records, userLocation(cmd.UserID)) + "```"
+}
+
+// slashCommandResponse builds an immediate slash command reply
+func slashCommandResponse(responseType, text string) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(map[string]string{
+		"response_type": responseType,
+		"text":          text,
+	})
+	return response(200, string(body))
+}
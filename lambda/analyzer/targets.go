@@ -0,0 +1,106 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// WAFTarget is a registered WAF whose logs can be queried
+type WAFTarget struct {
+	Name        string   `json:"name"`        // Short name used in questions and reports (e.g. "api")
+	Description string   `json:"description"` // Human readable description shown in the prompt
+	Region      string   `json:"region"`      // Region where the Athena query runs
+	Database    string   `json:"database"`    // Glue database
+	Table       string   `json:"table"`       // Table name (without database)
+	AccountID   string   `json:"account_id"`  // Optional account filter
+	Keywords    []string `json:"keywords"`    // Words in a question that select this target
+	Schema      string   `json:"schema"`      // Log schema: "ocsf" (Security Lake, default) or "waf" (native WAF logs in S3)
+	LogGroup    string   `json:"log_group"`   // CloudWatch Logs log group(s), comma separated; queried with Logs Insights instead of Athena
+	RoleARN     string   `json:"role_arn"`    // Optional IAM role assumed for queries (cross-account access)
+	ExternalID  string   `json:"external_id"` // Optional external ID for the role
+	Workgroup   string   `json:"workgroup"`   // Optional Athena workgroup in the target account (default ATHENA_WORKGROUP)
+	// Optional Athena output location in the target account, e.g. s3://bucket/prefix/ (default ATHENA_OUTPUT_BUCKET)
+	OutputLocation string `json:"output_location"`
+}
+
+// FullTableName returns the database-qualified table name
+func (t WAFTarget) FullTableName() string {
+	return t.Database + "." + t.Table
+}
+
+// defaultTargets mirrors the tables described in buildPrompt
+var defaultTargets = []WAFTarget{
+	{
+		Name:        "api",
+		Description: "WAF test-api table",
+		Region:      "ap-northeast-1",
+		Database:    "amazon_security_lake_glue_db_ap_northeast_1",
+		Table:       "amazon_security_lake_table_ap_northeast_1_waf_2_0",
+		Keywords:    []string{"api"},
+	},
+	{
+		Name:        "frontend",
+		Description: "WAF test-frontend table",
+		Region:      "us-east-1",
+		Database:    "amazon_security_lake_glue_db_us_east_1",
+		Table:       "amazon_security_lake_table_us_east_1_waf_2_0",
+		Keywords:    []string{"frontend", "front-end", "front end", "global", "us-east-1"},
+	},
+}
+
+// wafTargets holds the registered WAF targets (WAF_TARGETS JSON array overrides the defaults)
+var wafTargets = loadTargets(os.Getenv("WAF_TARGETS"))
+
+// loadTargets parses the target registry, falling back to the default targets
+func loadTargets(config string) []WAFTarget {
+	if config == "" {
+		return defaultTargets
+	}
+
+	var targets []WAFTarget
+	if err := json.Unmarshal([]byte(config), &targets); err != nil {
+		slog.Error("Failed to parse WAF_TARGETS, using default targets", "error", err)
+		return defaultTargets
+	}
+	if len(targets) == 0 {
+		return defaultTargets
+	}
+
+	slog.Info("Loaded WAF targets from WAF_TARGETS", "targets", len(targets))
+	return targets
+}
+
+// findTarget looks up a registered target by name (case-insensitive)
+func findTarget(name string) (WAFTarget, bool) {
+	for _, t := range wafTargets {
+		if strings.EqualFold(t.Name, name) {
+			return t, true
+		}
+	}
+	return WAFTarget{}, false
+}
+
+// targetForQuestion returns the first target whose keywords appear in the question
+func targetForQuestion(text string) (WAFTarget, bool) {
+	lower := strings.ToLower(text)
+	for _, t := range wafTargets {
+		for _, k := range t.Keywords {
+			if k != "" && strings.Contains(lower, strings.ToLower(k)) {
+				return t, true
+			}
+		}
+	}
+	return WAFTarget{}, false
+}
+
+// isTargetRegion reports whether any registered target runs queries in the region
+func isTargetRegion(region string) bool {
+	for _, t := range wafTargets {
+		if t.Region == region {
+			return true
+		}
+	}
+	return false
+}
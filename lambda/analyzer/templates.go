@@ -0,0 +1,415 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// TemplateParam is a typed parameter of a query template
+type TemplateParam struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // target, window, ip, limit, string
+	Description string `json:"description"`
+	Default     string `json:"default,omitempty"`
+}
+
+// QueryTemplate is a vetted, parameterized Athena SQL query.
+// Besides its parameters ({{name}}), the SQL may use {{table}}, {{account_filter}} and the
+// column placeholders of the target's schema dialect ({{source_ip}}, {{action}} ...),
+// which are filled from the "target" parameter. A "window" parameter also fills {{time_range}}
+// (the condition on the time column), {{start}} and {{end}} (UTC bounds); {{window}} itself is
+// the look-back in hours and cannot express calendar ranges such as "yesterday".
+type QueryTemplate struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	SQL         string          `json:"sql"`
+	Params      []TemplateParam `json:"params"`
+}
+
+// defaultQueryTemplates is the built-in template library (QUERY_TEMPLATES / QUERY_TEMPLATES_FILE override it)
+var defaultQueryTemplates = []QueryTemplate{
+	{
+		Name:        "top_source_ips",
+		Description: "Source IPs with the most requests",
+		SQL: `SELECT {{source_ip}} AS source_ip, COUNT(*) AS request_count
+FROM {{table}}
+WHERE {{time_range}}{{account_filter}}
+GROUP BY {{source_ip}}
+ORDER BY request_count DESC
+LIMIT {{limit}}`,
+		Params: []TemplateParam{
+			{Name: "target", Type: "target", Description: "WAF to query"},
+			{Name: "window", Type: "window", Description: "Look-back window", Default: "24h"},
+			{Name: "limit", Type: "limit", Description: "Number of rows", Default: "10"},
+		},
+	},
+	{
+		Name:        "blocks_by_hour",
+		Description: "Blocked requests aggregated by hour",
+		SQL: `SELECT date_trunc('hour', {{time}}) AS hour, COUNT(*) AS block_count
+FROM {{table}}
+WHERE {{time_range}}
+    AND {{action}} = 'BLOCK'{{account_filter}}
+GROUP BY date_trunc('hour', {{time}})
+ORDER BY hour`,
+		Params: []TemplateParam{
+			{Name: "target", Type: "target", Description: "WAF to query"},
+			{Name: "window", Type: "window", Description: "Look-back window", Default: "24h"},
+		},
+	},
+	{
+		Name:        "top_rules",
+		Description: "Rules triggered the most (BLOCK or COUNT)",
+		SQL: `SELECT {{rule}} AS rule_id, {{action}} AS action, COUNT(*) AS trigger_count
+FROM {{table}}
+WHERE {{time_range}}
+    AND {{action}} IN ('BLOCK', 'COUNT'){{account_filter}}
+GROUP BY {{rule}}, {{action}}
+ORDER BY trigger_count DESC
+LIMIT {{limit}}`,
+		Params: []TemplateParam{
+			{Name: "target", Type: "target", Description: "WAF to query"},
+			{Name: "window", Type: "window", Description: "Look-back window", Default: "24h"},
+			{Name: "limit", Type: "limit", Description: "Number of rows", Default: "10"},
+		},
+	},
+	{
+		Name:        "requests_for_uri",
+		Description: "Requests to a URI path, by source IP and action",
+		SQL: `SELECT {{source_ip}} AS source_ip, {{action}} AS action, COUNT(*) AS request_count
+FROM {{table}}
+WHERE {{time_range}}
+    AND {{path}} LIKE '{{uri}}%'{{account_filter}}
+GROUP BY {{source_ip}}, {{action}}
+ORDER BY request_count DESC
+LIMIT {{limit}}`,
+		Params: []TemplateParam{
+			{Name: "target", Type: "target", Description: "WAF to query"},
+			{Name: "uri", Type: "string", Description: "URI path prefix, e.g. /login"},
+			{Name: "window", Type: "window", Description: "Look-back window", Default: "24h"},
+			{Name: "limit", Type: "limit", Description: "Number of rows", Default: "10"},
+		},
+	},
+	{
+		Name:        "requests_from_ip",
+		Description: "Activity of one source IP by hostname, action and rule",
+		SQL: `SELECT {{host}} AS hostname, {{action}} AS action, {{rule}} AS rule_id, COUNT(*) AS request_count
+FROM {{table}}
+WHERE {{time_range}}
+    AND {{source_ip}} = '{{ip}}'{{account_filter}}
+GROUP BY {{host}}, {{action}}, {{rule}}
+ORDER BY request_count DESC
+LIMIT {{limit}}`,
+		Params: []TemplateParam{
+			{Name: "target", Type: "target", Description: "WAF to query"},
+			{Name: "ip", Type: "ip", Description: "Source IP address"},
+			{Name: "window", Type: "window", Description: "Look-back window", Default: "24h"},
+			{Name: "limit", Type: "limit", Description: "Number of rows", Default: "10"},
+		},
+	},
+}
+
+// queryTemplates holds the active template library
+var queryTemplates = loadQueryTemplates()
+
+// loadQueryTemplates reads the template library from QUERY_TEMPLATES_FILE or QUERY_TEMPLATES
+func loadQueryTemplates() []QueryTemplate {
+	config := os.Getenv("QUERY_TEMPLATES")
+	if path := os.Getenv("QUERY_TEMPLATES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Failed to read QUERY_TEMPLATES_FILE, using default templates", "error", err)
+			return defaultQueryTemplates
+		}
+		config = string(data)
+	}
+	if config == "" {
+		return defaultQueryTemplates
+	}
+
+	var templates []QueryTemplate
+	if err := json.Unmarshal([]byte(config), &templates); err != nil {
+		slog.Error("Failed to parse query templates, using default templates", "error", err)
+		return defaultQueryTemplates
+	}
+
+	slog.Info("Loaded query templates", "templates", len(templates))
+	return templates
+}
+
+// findQueryTemplate looks up a template by name
+func findQueryTemplate(name string) (QueryTemplate, bool) {
+	for _, t := range queryTemplates {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return QueryTemplate{}, false
+}
+
+// TemplateMatch is Bedrock's choice of template and parameter values
+type TemplateMatch struct {
+	Template string            `json:"template"`
+	Params   map[string]string `json:"params"`
+}
+
+// buildTemplateMatchPrompt asks Bedrock to pick a template and fill its parameters
+func buildTemplateMatchPrompt(userText string, loc *time.Location) string {
+	var sb strings.Builder
+	sb.WriteString("Choose the query template that answers the user request and fill in its parameters.\n\n")
+
+	sb.WriteString("### WAF Targets:\n")
+	for _, t := range wafTargets {
+		sb.WriteString(fmt.Sprintf("- %s: %s (%s)\n", t.Name, t.Description, t.Region))
+	}
+
+	sb.WriteString("\n### Templates:\n")
+	for _, t := range queryTemplates {
+		sb.WriteString(fmt.Sprintf("- %s: %s\n", t.Name, t.Description))
+		for _, p := range t.Params {
+			def := ""
+			if p.Default != "" {
+				def = fmt.Sprintf(" (default %s)", p.Default)
+			}
+			sb.WriteString(fmt.Sprintf("    - %s [%s]: %s%s\n", p.Name, p.Type, p.Description, def))
+		}
+	}
+
+	sb.WriteString("\n" + timeContextPrompt(userText, loc, time.Now()))
+
+	sb.WriteString(`
+### Parameter Types:
+- target: one of the WAF target names above
+- window: look-back window such as 1h, 24h, 3d, 1w, or a calendar range: today, yesterday, this week, last week,
+  this month, last month (in the user's timezone)
+- ip: IPv4 or IPv6 address
+- limit: number of rows (1-100)
+- string: plain text without quotes
+
+### User Request: ` + userText + `
+
+Respond with only a JSON object like {"template": "top_source_ips", "params": {"target": "api", "window": "3d"}}.
+If no template answers the request exactly, respond with {"template": "none"}.`)
+
+	return sb.String()
+}
+
+// parseTemplateMatch extracts the JSON object from Bedrock's response
+func parseTemplateMatch(response string) (TemplateMatch, error) {
+	var match TemplateMatch
+	start := strings.Index(response, "{")
+	end := strings.LastIndex(response, "}")
+	if start < 0 || end < start {
+		return match, fmt.Errorf("no JSON object in response")
+	}
+	if err := json.Unmarshal([]byte(response[start:end+1]), &match); err != nil {
+		return match, err
+	}
+	return match, nil
+}
+
+// Allowed characters for string parameters (URI paths, hostnames, rule IDs)
+var safeStringParam = regexp.MustCompile(`^[A-Za-z0-9_./:\-~%]+$`)
+
+// renderQueryTemplate validates typed parameters and renders the template SQL.
+// Calendar windows are resolved in loc.
+func renderQueryTemplate(t QueryTemplate, params map[string]string, loc *time.Location, now time.Time) (string, error) {
+	values := make(map[string]string)
+	var target WAFTarget
+	hasTarget := false
+	var window timeWindow
+	hasWindow := false
+
+	for _, p := range t.Params {
+		value := strings.TrimSpace(params[p.Name])
+		if value == "" {
+			value = p.Default
+		}
+		if value == "" {
+			return "", fmt.Errorf("missing parameter %s", p.Name)
+		}
+
+		switch p.Type {
+		case "target":
+			tgt, ok := findTarget(value)
+			if !ok {
+				return "", fmt.Errorf("unknown target %q", value)
+			}
+			if tgt.LogGroup != "" {
+				return "", fmt.Errorf("target %q is queried with Logs Insights", value)
+			}
+			target, hasTarget = tgt, true
+			value = tgt.Name
+		case "window":
+			w, err := parseTemplateWindow(value, loc, now)
+			if err != nil {
+				return "", err
+			}
+			if w.bounded && strings.Contains(t.SQL, "{{"+p.Name+"}}") {
+				return "", fmt.Errorf("template %s only takes a look-back window, not %q", t.Name, value)
+			}
+			window, hasWindow = w, true
+			value = strconv.Itoa(w.hours)
+		case "ip":
+			if net.ParseIP(value) == nil {
+				return "", fmt.Errorf("invalid IP address %q", value)
+			}
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				return "", fmt.Errorf("invalid limit %q", value)
+			}
+		default:
+			if !safeStringParam.MatchString(value) {
+				return "", fmt.Errorf("invalid characters in parameter %s", p.Name)
+			}
+		}
+		values[p.Name] = value
+	}
+
+	if !hasTarget {
+		// Templates without an explicit target run against the first registered target
+		target = wafTargets[0]
+	}
+	values["table"] = target.FullTableName()
+	placeholders := dialectPlaceholders(target)
+	for name, value := range placeholders {
+		if _, ok := values[name]; !ok {
+			values[name] = value
+		}
+	}
+	if hasWindow {
+		values["time_range"] = window.condition(placeholders["time"])
+		values["start"] = window.start.UTC().Format("2006-01-02 15:04:05")
+		values["end"] = window.end.UTC().Format("2006-01-02 15:04:05")
+	}
+
+	sql := t.SQL
+	for name, value := range values {
+		sql = strings.ReplaceAll(sql, "{{"+name+"}}", value)
+	}
+	if strings.Contains(sql, "{{") {
+		return "", fmt.Errorf("template %s has unfilled placeholders", t.Name)
+	}
+	return sql, nil
+}
+
+// timeWindow is the time range of a template: a look-back from now, or calendar bounds
+type timeWindow struct {
+	hours      int
+	start, end time.Time
+	bounded    bool
+}
+
+// parseTemplateWindow reads a window parameter: a look-back ("24h", "3d", "past 3 days") or a calendar range
+// ("yesterday", "last week") resolved in loc like the relative phrases of questions
+func parseTemplateWindow(value string, loc *time.Location, now time.Time) (timeWindow, error) {
+	value = strings.TrimSpace(value)
+	if ranges := resolveRelativeRanges(value, loc, now); len(ranges) == 1 && strings.EqualFold(ranges[0].Phrase, value) {
+		r := ranges[0]
+		hours := max(int(math.Ceil(r.End.Sub(r.Start).Hours())), 1)
+		return timeWindow{hours: hours, start: r.Start, end: r.End, bounded: relativeDayPattern.MatchString(value)}, nil
+	}
+
+	hours, err := parseWindowHours(value)
+	if err != nil {
+		return timeWindow{}, err
+	}
+	return timeWindow{hours: hours, start: now.Add(-time.Duration(hours) * time.Hour), end: now}, nil
+}
+
+// condition returns the SQL condition selecting the window on a time column
+func (w timeWindow) condition(column string) string {
+	if !w.bounded {
+		return fmt.Sprintf("%s >= current_timestamp - INTERVAL '%d' HOUR", column, w.hours)
+	}
+	return fmt.Sprintf("%s >= TIMESTAMP '%s' AND %s < TIMESTAMP '%s'", column,
+		w.start.UTC().Format("2006-01-02 15:04:05"), column, w.end.UTC().Format("2006-01-02 15:04:05"))
+}
+
+// parseWindowHours converts a window such as "24h", "3d", "1w" or "12" into hours
+func parseWindowHours(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(value, "h"):
+		value = strings.TrimSuffix(value, "h")
+	case strings.HasSuffix(value, "d"):
+		value, multiplier = strings.TrimSuffix(value, "d"), 24
+	case strings.HasSuffix(value, "w"):
+		value, multiplier = strings.TrimSuffix(value, "w"), 24*7
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid window %q", value)
+	}
+	hours := n * multiplier
+	// Keep scans bounded (90 days)
+	if hours > 24*90 {
+		return 0, fmt.Errorf("window too large: %d hours", hours)
+	}
+	return hours, nil
+}
+
+// generateSQL turns a question into SQL, preferring a vetted template and falling back to free-form generation.
+// The returned template name is empty when free-form SQL was generated.
+func generateSQL(ctx context.Context, userText string, loc *time.Location) (string, string, error) {
+	ctx, span := startSpan(ctx, "generate_sql")
+	defer span.End()
+
+	// Targets logging to CloudWatch Logs are queried with Logs Insights
+	if target, ok := targetForQuestion(userText); ok && target.LogGroup != "" {
+		slog.InfoContext(ctx, "Question selects a CloudWatch Logs target, generating a Logs Insights query", "target", target.Name)
+		span.SetAttributes(attribute.String("target", target.Name))
+		query, err := generateLogsInsightsQuery(ctx, userText, target, loc)
+		return query, "", err
+	}
+
+	// A template answer that cannot be used is repaired by generating free-form SQL
+	if len(queryTemplates) > 0 {
+		prompt := buildPromptSpan(ctx, "template_match", func() string { return buildTemplateMatchPrompt(userText, loc) })
+		response, err := callBedrock(ctx, "template_match", prompt)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return "", "", err
+		}
+		match, err := parseTemplateMatch(response)
+		if err != nil {
+			slog.WarnContext(ctx, "Template match response could not be parsed", "error", err)
+			putCount(ctx, "SQLRepairAttempts", map[string]string{"Reason": "unparseable_template_match"})
+		} else if match.Template != "" && match.Template != "none" {
+			if t, ok := findQueryTemplate(match.Template); !ok {
+				slog.WarnContext(ctx, "Bedrock chose an unknown template", "template", match.Template)
+				putCount(ctx, "SQLRepairAttempts", map[string]string{"Reason": "unknown_template"})
+			} else if sql, err := renderQueryTemplate(t, match.Params, loc, time.Now()); err != nil {
+				slog.WarnContext(ctx, "Template rejected parameters", "template", t.Name, "params", match.Params, "error", err)
+				putCount(ctx, "SQLRepairAttempts", map[string]string{"Reason": "rejected_parameters"})
+			} else {
+				slog.InfoContext(ctx, "Using query template", "template", t.Name, "params", match.Params)
+				span.SetAttributes(attribute.String("template", t.Name))
+				return sql, t.Name, nil
+			}
+		}
+	}
+
+	slog.InfoContext(ctx, "No template matched, generating free-form SQL")
+	prompt := buildPromptSpan(ctx, "sql", func() string { return buildPrompt(userText, loc) })
+	sql, err := callBedrock(ctx, "sql", prompt)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return sql, "", err
+}
@@ -0,0 +1,123 @@
+package analyzer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTemplateWindow(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*3600)
+	// Sunday 2026-10-18 10:30 JST
+	now := time.Date(2026, 10, 18, 1, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		value     string
+		hours     int
+		start     string
+		end       string
+		bounded   bool
+		wantError bool
+	}{
+		{value: "24h", hours: 24, start: "2026-10-17 01:30:00", end: "2026-10-18 01:30:00"},
+		{value: "3d", hours: 72, start: "2026-10-15 01:30:00", end: "2026-10-18 01:30:00"},
+		{value: "1w", hours: 168, start: "2026-10-11 01:30:00", end: "2026-10-18 01:30:00"},
+		{value: "past 3 days", hours: 72, start: "2026-10-15 01:30:00", end: "2026-10-18 01:30:00"},
+		{value: "yesterday", hours: 24, start: "2026-10-16 15:00:00", end: "2026-10-17 15:00:00", bounded: true},
+		{value: "Last Week", hours: 168, start: "2026-10-04 15:00:00", end: "2026-10-11 15:00:00", bounded: true},
+		{value: "today", hours: 11, start: "2026-10-17 15:00:00", end: "2026-10-18 01:30:00", bounded: true},
+		{value: "0h", wantError: true},
+		{value: "91d", wantError: true},
+		{value: "soon", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			w, err := parseTemplateWindow(tt.value, tokyo, now)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("parseTemplateWindow(%q) = %+v, want an error", tt.value, w)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTemplateWindow(%q) failed: %v", tt.value, err)
+			}
+			start, end := w.start.UTC().Format("2006-01-02 15:04:05"), w.end.UTC().Format("2006-01-02 15:04:05")
+			if w.hours != tt.hours || start != tt.start || end != tt.end || w.bounded != tt.bounded {
+				t.Errorf("parseTemplateWindow(%q) = %d hours, %s - %s, bounded %v; want %d hours, %s - %s, bounded %v",
+					tt.value, w.hours, start, end, w.bounded, tt.hours, tt.start, tt.end, tt.bounded)
+			}
+		})
+	}
+}
+
+func TestRenderQueryTemplateWindow(t *testing.T) {
+	withTargets(t, defaultTargets)
+	now := time.Date(2026, 10, 18, 1, 30, 0, 0, time.UTC)
+	topIPs, _ := findQueryTemplate("top_source_ips")
+	column := dialectPlaceholders(defaultTargets[0])["time"]
+
+	tests := []struct {
+		name      string
+		template  QueryTemplate
+		params    map[string]string
+		want      []string
+		wantError bool
+	}{
+		{
+			name:     "look-back window",
+			template: topIPs,
+			params:   map[string]string{"target": "api", "window": "3d"},
+			want:     []string{column + " >= current_timestamp - INTERVAL '72' HOUR", "LIMIT 10"},
+		},
+		{
+			name:     "calendar window",
+			template: topIPs,
+			params:   map[string]string{"target": "api", "window": "yesterday", "limit": "5"},
+			want: []string{
+				column + " >= TIMESTAMP '2026-10-17 00:00:00' AND " + column + " < TIMESTAMP '2026-10-18 00:00:00'",
+				"LIMIT 5",
+			},
+		},
+		{
+			name: "start and end",
+			template: QueryTemplate{Name: "bounds", SQL: "SELECT COUNT(*) FROM {{table}} WHERE {{time}} BETWEEN TIMESTAMP '{{start}}' AND TIMESTAMP '{{end}}'",
+				Params: []TemplateParam{{Name: "window", Type: "window", Default: "24h"}}},
+			params: map[string]string{},
+			want:   []string{"BETWEEN TIMESTAMP '2026-10-17 01:30:00' AND TIMESTAMP '2026-10-18 01:30:00'"},
+		},
+		{
+			name: "hours only template rejects calendar windows",
+			template: QueryTemplate{Name: "hours", SQL: "SELECT COUNT(*) FROM {{table}} WHERE {{time}} > now() - INTERVAL '{{window}}' HOUR",
+				Params: []TemplateParam{{Name: "window", Type: "window"}}},
+			params:    map[string]string{"window": "last week"},
+			wantError: true,
+		},
+		{
+			name: "hours only template takes look-back windows",
+			template: QueryTemplate{Name: "hours", SQL: "SELECT COUNT(*) FROM {{table}} WHERE {{time}} > now() - INTERVAL '{{window}}' HOUR",
+				Params: []TemplateParam{{Name: "window", Type: "window"}}},
+			params: map[string]string{"window": "2d"},
+			want:   []string{"INTERVAL '48' HOUR"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, err := renderQueryTemplate(tt.template, tt.params, time.UTC, now)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("renderQueryTemplate() = %q, want an error", sql)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderQueryTemplate() failed: %v", err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(sql, w) {
+					t.Errorf("renderQueryTemplate() = %q, want it to contain %q", sql, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package analyzer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // the Lambda runtime has no zoneinfo database
+)
+
+// Timezone configuration
+var (
+	// Workspace timezone used for questions, SQL literals and displays (IANA name)
+	defaultLocation = loadLocation(envOrDefault("USER_TIMEZONE", "Asia/Tokyo"))
+	// Look up each Slack user's timezone with users.info (needs the users:read scope)
+	useSlackUserTimezone = os.Getenv("SLACK_USER_TIMEZONE") == "true"
+
+	slackUserLocations sync.Map // user ID -> *time.Location
+)
+
+// loadLocation loads an IANA timezone, falling back to UTC
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		slog.Warn("Unknown timezone, using UTC", "timezone", name, "error", err)
+		return time.UTC
+	}
+	return loc
+}
+
+// userLocation returns the timezone of a Slack user (cached), or the workspace timezone
+func userLocation(userID string) *time.Location {
+	if !useSlackUserTimezone || userID == "" {
+		return defaultLocation
+	}
+	if loc, ok := slackUserLocations.Load(userID); ok {
+		return loc.(*time.Location)
+	}
+
+	resp, err := callSlackAPIForm("users.info", url.Values{"user": {userID}})
+	if err != nil {
+		slog.Warn("Failed to look up user timezone", "user", userID, "error", err)
+		return defaultLocation
+	}
+	user, _ := resp["user"].(map[string]interface{})
+	tz, _ := user["tz"].(string)
+	if tz == "" {
+		return defaultLocation
+	}
+
+	loc := loadLocation(tz)
+	slackUserLocations.Store(userID, loc)
+	return loc
+}
+
+// timeRange is an absolute range resolved from a relative phrase in a question
+type timeRange struct {
+	Phrase string
+	Start  time.Time
+	End    time.Time
+}
+
+// Relative time phrases recognised in questions
+var (
+	relativeDayPattern    = regexp.MustCompile(`(?i)\b(today|yesterday|this week|last week|this month|last month)\b`)
+	relativeAmountPattern = regexp.MustCompile(`(?i)\b(?:last|past|previous)\s+(\d+)\s+(hour|day|week)s?\b`)
+)
+
+// resolveRelativeRanges turns relative phrases ("yesterday", "last week", "past 3 days") into absolute bounds
+// computed in the user's timezone. Calendar phrases use local midnight; weeks start on Monday.
+func resolveRelativeRanges(text string, loc *time.Location, now time.Time) []timeRange {
+	now = now.In(loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	weekStart := midnight.AddDate(0, 0, -((int(midnight.Weekday()) + 6) % 7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+
+	var ranges []timeRange
+	for _, m := range relativeDayPattern.FindAllString(text, -1) {
+		r := timeRange{Phrase: strings.ToLower(m)}
+		switch r.Phrase {
+		case "today":
+			r.Start, r.End = midnight, now
+		case "yesterday":
+			r.Start, r.End = midnight.AddDate(0, 0, -1), midnight
+		case "this week":
+			r.Start, r.End = weekStart, now
+		case "last week":
+			r.Start, r.End = weekStart.AddDate(0, 0, -7), weekStart
+		case "this month":
+			r.Start, r.End = monthStart, now
+		case "last month":
+			r.Start, r.End = monthStart.AddDate(0, -1, 0), monthStart
+		}
+		ranges = append(ranges, r)
+	}
+
+	for _, m := range relativeAmountPattern.FindAllStringSubmatch(text, -1) {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 {
+			continue
+		}
+		unit := time.Hour
+		switch strings.ToLower(m[2]) {
+		case "day":
+			unit = 24 * time.Hour
+		case "week":
+			unit = 7 * 24 * time.Hour
+		}
+		ranges = append(ranges, timeRange{Phrase: strings.ToLower(m[0]), Start: now.Add(-time.Duration(n) * unit), End: now})
+	}
+	return ranges
+}
+
+// timeContextPrompt describes the current time, the user's timezone and resolved time ranges for the SQL prompts
+func timeContextPrompt(userText string, loc *time.Location, now time.Time) string {
+	var sb strings.Builder
+	local := now.In(loc)
+	sb.WriteString("### Current Time:\n")
+	sb.WriteString(fmt.Sprintf("- %s (%s, UTC%s) = %s UTC\n",
+		local.Format("2006-01-02 15:04 MST"), loc.String(), local.Format("-07:00"), now.UTC().Format("2006-01-02 15:04")))
+	sb.WriteString("- Timestamps in the tables are UTC. Write TIMESTAMP literals in UTC; the user's dates and times are in " + loc.String() + ".\n")
+
+	if ranges := resolveRelativeRanges(userText, loc, now); len(ranges) > 0 {
+		sb.WriteString("\n### Time Ranges (use these exact UTC bounds for the time column):\n")
+		for _, r := range ranges {
+			sb.WriteString(fmt.Sprintf("- \"%s\": >= TIMESTAMP '%s' AND < TIMESTAMP '%s'\n",
+				r.Phrase, r.Start.UTC().Format("2006-01-02 15:04:05"), r.End.UTC().Format("2006-01-02 15:04:05")))
+		}
+	}
+	return sb.String()
+}
+
+// Timestamps as returned by Athena (UTC), with optional fraction and zone suffix
+var utcTimestampPattern = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2})(\.\d+)?( UTC|Z)?$`)
+
+// toLocalTimestamp converts a UTC timestamp value to the display timezone (other values are returned unchanged)
+func toLocalTimestamp(value string, loc *time.Location) string {
+	m := utcTimestampPattern.FindStringSubmatch(value)
+	if m == nil {
+		return value
+	}
+	t, err := time.Parse("2006-01-02 15:04:05", strings.Replace(m[1], "T", " ", 1))
+	if err != nil {
+		return value
+	}
+	return t.In(loc).Format("2006-01-02 15:04:05 MST")
+}
@@ -0,0 +1,195 @@
+package analyzer
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing configuration
+var (
+	// Span exporter: otlp, xray or none. Defaults to otlp when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+	// The OTLP exporter reads the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER variables.
+	tracingExporter = strings.ToLower(envOrDefault("TRACING_EXPORTER", defaultTracingExporter()))
+
+	tracer         = otel.Tracer("bedrock-slack-handler")
+	tracerProvider *sdktrace.TracerProvider
+
+	// Span of the request in flight, the parent of spans started without a request context
+	// (AWS SDK calls made without a context). Only used while requestLogAttrsOn is set.
+	requestSpan atomic.Pointer[trace.SpanContext]
+)
+
+// defaultTracingExporter enables OTLP export when an endpoint is configured
+func defaultTracingExporter() string {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		return "otlp"
+	}
+	return "none"
+}
+
+// tracingEnabled reports whether spans are exported
+func tracingEnabled() bool {
+	return tracingExporter == "otlp" || tracingExporter == "xray"
+}
+
+// InitTracing installs the tracer provider. With the xray exporter, trace IDs are X-Ray compatible and
+// spans go to the ADOT collector (Lambda layer or sidecar) on localhost unless an endpoint is set.
+func InitTracing() {
+	if !tracingEnabled() {
+		return
+	}
+
+	var opts []otlptracehttp.Option
+	if tracingExporter == "xray" && defaultTracingExporter() == "none" {
+		opts = append(opts, otlptracehttp.WithEndpoint("localhost:4318"), otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		slog.Error("Failed to create trace exporter, tracing disabled", "error", err)
+		return
+	}
+
+	serviceName := envOrDefault("OTEL_SERVICE_NAME", envOrDefault("AWS_LAMBDA_FUNCTION_NAME", "waf-log-analyzer"))
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		slog.Warn("Failed to detect trace resource attributes", "error", err)
+	}
+
+	providerOpts := []sdktrace.TracerProviderOption{sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)}
+	if tracingExporter == "xray" {
+		providerOpts = append(providerOpts, sdktrace.WithIDGenerator(xray.NewIDGenerator()))
+		otel.SetTextMapPropagator(xray.Propagator{})
+	} else {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	}
+	tracerProvider = sdktrace.NewTracerProvider(providerOpts...)
+	otel.SetTracerProvider(tracerProvider)
+	slog.Info("Tracing enabled", "exporter", tracingExporter, "service", serviceName)
+}
+
+// flushTraces exports the spans of a finished invocation (Lambda freezes the instance between invocations)
+func flushTraces(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+}
+
+// ShutdownTracing flushes and stops the tracer provider before the process exits
+func ShutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to shut down tracing", "error", err)
+	}
+}
+
+// withLambdaTraceParent continues the X-Ray trace Lambda started for the invocation (active tracing)
+func withLambdaTraceParent(ctx context.Context) context.Context {
+	header, _ := ctx.Value("x-amzn-trace-id").(string)
+	if tracingExporter != "xray" || header == "" {
+		return ctx
+	}
+	return xray.Propagator{}.Extract(ctx, propagation.MapCarrier{"X-Amzn-Trace-Id": header})
+}
+
+// startSpan starts a span under the span of the context (or of the request in flight)
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		if sc := requestSpan.Load(); sc != nil {
+			ctx = trace.ContextWithSpanContext(ctx, *sc)
+		}
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startRequestSpan starts the root span of a request, makes it the span of the request in flight
+// and adds its trace ID to the request's log records
+func startRequestSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	if sc := span.SpanContext(); sc.IsValid() {
+		if requestLogAttrsOn.Load() {
+			requestSpan.Store(&sc)
+		}
+		ctx = withLogAttrs(ctx, "trace_id", sc.TraceID().String())
+	}
+	return ctx, span
+}
+
+// endSpan ends a span, marking it as failed when errMsg is set
+func endSpan(span trace.Span, errMsg string) {
+	if errMsg != "" {
+		span.SetStatus(codes.Error, errMsg)
+	}
+	span.End()
+}
+
+// buildPromptSpan builds a prompt inside a prompt.build span
+func buildPromptSpan(ctx context.Context, purpose string, build func() string) string {
+	_, span := startSpan(ctx, "prompt.build", attribute.String("bedrock.purpose", purpose))
+	defer span.End()
+	return build()
+}
+
+type awsCallSpanKey struct{}
+
+// instrumentSession adds a span around every AWS API call made through the session (S3, DynamoDB, Athena, ...)
+func instrumentSession(sess *session.Session) *session.Session {
+	if !tracingEnabled() {
+		return sess
+	}
+	// Build and Complete run once per call, whatever the number of retries
+	sess.Handlers.Build.PushFrontNamed(request.NamedHandler{Name: "tracing.Start", Fn: func(r *request.Request) {
+		ctx, span := startSpan(r.Context(), r.ClientInfo.ServiceID+"."+r.Operation.Name,
+			attribute.String("aws.service", r.ClientInfo.ServiceID),
+			attribute.String("aws.operation", r.Operation.Name),
+			attribute.String("aws.region", aws.StringValue(r.Config.Region)))
+		r.SetContext(context.WithValue(ctx, awsCallSpanKey{}, span))
+	}})
+	sess.Handlers.Complete.PushBackNamed(request.NamedHandler{Name: "tracing.End", Fn: func(r *request.Request) {
+		// Calls that failed validation never started a span
+		span, ok := r.Context().Value(awsCallSpanKey{}).(trace.Span)
+		if !ok {
+			return
+		}
+		if r.HTTPResponse != nil && r.HTTPResponse.StatusCode != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", r.HTTPResponse.StatusCode))
+		}
+		if id := r.RequestID; id != "" {
+			span.SetAttributes(attribute.String("aws.request_id", id))
+		}
+		errMsg := ""
+		if r.Error != nil {
+			errMsg = r.Error.Error()
+		}
+		endSpan(span, errMsg)
+	}})
+	return sess
+}
@@ -0,0 +1,278 @@
+package analyzer
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// awsString converts string type to *string type for AWS SDK
+func awsString(s string) *string {
+	return &s
+}
+
+// isNumeric checks if a string contains only numbers
+func isNumeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// min function (for Go < 1.21)
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// response generates API Gateway response
+func response(code int, body string) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: code,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"X-Processed":  "true", // Header indicating processing is complete
+		},
+	}
+}
+
+// getQueryRegion detects region from SQL query
+func getQueryRegion(query string) string {
+	// Default is ap-northeast-1
+	defaultRegion := "ap-northeast-1"
+
+	// Log output
+	slog.Debug("Detecting query region", "sql", query)
+
+	// Logs Insights queries name their target in the header
+	if isLogsInsightsQuery(query) {
+		if t, _, _, errMsg := parseLogsInsightsQuery(query); errMsg == "" {
+			slog.Debug("Detected query region", "region", t.Region, "reason", "logs insights target", "target", t.Name)
+			return t.Region
+		}
+	}
+
+	// Registered targets know their own region
+	if t, ok := targetForQuery(query); ok {
+		slog.Debug("Detected query region", "region", t.Region, "reason", "registered table", "target", t.Name)
+		return t.Region
+	}
+
+	// When query explicitly references us-east-1 tables
+	if strings.Contains(query, "amazon_security_lake_glue_db_us_east_1") ||
+		strings.Contains(query, "amazon_security_lake_table_us_east_1") ||
+		strings.Contains(query, "waf_2_0_us_east_1") {
+		slog.Debug("Detected query region", "region", "us-east-1", "reason", "table reference")
+		return "us-east-1"
+	}
+
+	// When referencing frontend WAF (us-east-1)
+	if strings.Contains(query, "frontend") {
+		slog.Debug("Detected query region", "region", "us-east-1", "reason", "frontend keywords")
+		return "us-east-1"
+	}
+
+	// GLOBAL WEBACL references are us-east-1
+	if strings.Contains(query, "global/webacl") {
+		slog.Debug("Detected query region", "region", "us-east-1", "reason", "global webacl")
+		return "us-east-1"
+	}
+
+	slog.Debug("Detected query region", "region", defaultRegion, "reason", "default")
+	return defaultRegion
+}
+
+// containsFrontendKeywords determines if user text is related to frontend WAF
+func containsFrontendKeywords(text string) bool {
+	// Convert to lowercase for search
+	lowerText := strings.ToLower(text)
+
+	// List of frontend-related keywords
+	frontendKeywords := []string{
+		"frontend", "front-end", "front end",
+		"global",
+		"us-east-1", "us east 1",
+	}
+
+	// Return true if any keyword is found
+	for _, keyword := range frontendKeywords {
+		if strings.Contains(lowerText, keyword) {
+			slog.Debug("Detected frontend-related keyword", "keyword", keyword)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Cache to hold processed event IDs (LRU cache would be better)
+var processedEvents = make(map[string]bool)
+
+// Holds executed queries and their timestamps (prevents duplicate execution of same query in short time)
+var recentQueries = make(map[string]time.Time)
+
+// dedupeMu guards processedEvents and recentQueries; the HTTP server runs handlers concurrently
+var dedupeMu sync.Mutex
+
+// markEventProcessed records an event key and reports false when it was already processed
+func markEventProcessed(eventKey string) bool {
+	dedupeMu.Lock()
+	defer dedupeMu.Unlock()
+
+	if processedEvents[eventKey] {
+		return false
+	}
+	processedEvents[eventKey] = true
+
+	// Limit cache size (max 100); simple cleaning (should use LRU cache in production)
+	if len(processedEvents) > 100 {
+		slog.Debug("Clearing event cache", "size", len(processedEvents))
+		processedEvents = map[string]bool{eventKey: true}
+	}
+	return true
+}
+
+// markQueryRecent records the time a query was asked. It reports a duplicate (and how long ago the query was
+// first seen) when the same query was asked within the window; duplicates do not refresh the time.
+func markQueryRecent(queryKey string, window time.Duration) (time.Duration, bool) {
+	dedupeMu.Lock()
+	defer dedupeMu.Unlock()
+
+	if lastTime, exists := recentQueries[queryKey]; exists {
+		if timeSince := time.Since(lastTime); timeSince < window {
+			return timeSince, true
+		}
+	}
+	recentQueries[queryKey] = time.Now()
+
+	// Limit recentQueries size: delete old entries, clear all if still too large
+	if len(recentQueries) > 200 {
+		slog.Debug("Cleaning up recentQueries cache", "size", len(recentQueries))
+		now := time.Now()
+		for k, t := range recentQueries {
+			if now.Sub(t) > 10*time.Minute {
+				delete(recentQueries, k)
+			}
+		}
+		if len(recentQueries) > 150 {
+			recentQueries = map[string]time.Time{queryKey: now}
+		}
+	}
+	return 0, false
+}
+
+// resetDedupe forgets processed events, recent queries and sent messages
+func resetDedupe() {
+	dedupeMu.Lock()
+	processedEvents = make(map[string]bool)
+	recentQueries = make(map[string]time.Time)
+	dedupeMu.Unlock()
+
+	recentSlackMessagesMu.Lock()
+	recentSlackMessages = make(map[string]time.Time)
+	recentSlackMessagesMu.Unlock()
+}
+
+// headerValue looks up an HTTP header case-insensitively (API Gateway keeps the client's casing)
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// envInt reads an integer environment variable, returning def when unset or invalid
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		slog.Warn("Invalid integer setting, using the default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envOrDefault reads an environment variable, returning def when unset
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// splitList splits a comma separated setting into trimmed, non-empty values
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// envFloat reads a float environment variable, returning def when unset or invalid
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		slog.Warn("Invalid number setting, using the default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+// formatBytes renders a byte count in human readable units (e.g. "1.5 GB")
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// truncateText shortens s to at most n characters, ending in "..." when cut, without splitting multi-byte characters
+func truncateText(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+// envInt64 reads a 64-bit integer environment variable (e.g. byte counts), returning def when unset or invalid
+func envInt64(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		slog.Warn("Invalid integer setting, using the default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return n
+}
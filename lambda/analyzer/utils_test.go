@@ -0,0 +1,22 @@
+package analyzer
+
+import "testing"
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer question", 10, "a longe..."},
+		{"ブロックされたIPを教えて", 10, "ブロックされた..."},
+		{"éééééé", 5, "éé..."},
+	}
+	for _, tt := range tests {
+		if got := truncateText(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateText(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+
+	"bedrock-slack-handler/analyzer"
+)
+
+// wafask answers WAF questions from a terminal with the same pipeline as the Slack handler
+func main() {
+	analyzer.InitTracing()
+	code := analyzer.RunAskCommand(os.Args[1:])
+	analyzer.ShutdownTracing()
+	os.Exit(code)
+}